@@ -21,6 +21,7 @@ package rest
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/greenbrew/rest/api"
 )
@@ -36,6 +37,10 @@ type API struct {
 	Version    string
 	Middleware MiddlewareFunc
 	Commands   []*Command
+
+	// Extensions lists the names of the features this API supports on top
+	// of its version. They are advertised to clients through server info
+	Extensions []string
 }
 
 // Command is the basic structure for every API call.
@@ -48,36 +53,300 @@ type Command struct {
 	POST   handlerFunc
 	DELETE handlerFunc
 	PATCH  handlerFunc
+
+	// ETag optionally loads the current state of the resource, the same
+	// data its GET handler hashes with SyncResponseETag. When set, PUT,
+	// PATCH and DELETE requests with an If-Match header not matching it
+	// are rejected with 412 before running the handler
+	ETag func(r *Request) (interface{}, error)
+
+	// Expand optionally loads the resource, for it to be returned in place of
+	// the references to it when recursion level 2 is requested
+	Expand Expander
+
+	// Timeout optionally overrides the HandlerTimeout of the service for
+	// the handlers of this command
+	Timeout time.Duration
+
+	// Authenticators optionally override the ones of the service for this
+	// command. When there are any, callers not identified by them get a 401
+	// unless AllowAnonymous is set, and those not in any of Groups, if set,
+	// get a 403. So do those not in any of WriteGroups, or the ones of the
+	// service if not set, for requests other than GET, HEAD and OPTIONS
+	Authenticators []Authenticator
+	AllowAnonymous bool
+	Groups         []string
+	WriteGroups    []string
+
+	// Optional documentation used to generate the OpenAPI document.
+	// Docs are indexed by HTTP method
+	Summary string
+	Docs    map[string]*MethodDoc
+}
+
+// handler returns the handler for the given HTTP method, if any.
+// HEAD requests are attended by the GET handler
+func (c *Command) handler(method string) handlerFunc {
+	switch method {
+	case http.MethodHead, http.MethodGet:
+		return c.GET
+	case http.MethodPut:
+		return c.PUT
+	case http.MethodPost:
+		return c.POST
+	case http.MethodDelete:
+		return c.DELETE
+	case http.MethodPatch:
+		return c.PATCH
+	}
+	return nil
+}
+
+// allowedMethods returns the list of HTTP methods supported by the command
+func (c *Command) allowedMethods() []string {
+	methods := []string{}
+	for _, m := range []string{http.MethodGet, http.MethodHead, http.MethodPut,
+		http.MethodPost, http.MethodDelete, http.MethodPatch} {
+		if c.handler(m) != nil {
+			methods = append(methods, m)
+		}
+	}
+	return append(methods, http.MethodOptions)
+}
+
+// MethodDoc documents the behavior of a Command for a specific HTTP method
+type MethodDoc struct {
+	Summary     string
+	Description string
+	Parameters  []ParameterDoc
+
+	// Sample values of the request body and of the response metadata. Only
+	// their types are used to describe the expected JSON content
+	Request  interface{}
+	Response interface{}
+
+	// Async is true if the method answers with a background operation
+	Async bool
+}
+
+// ParameterDoc documents a parameter of a Command method
+type ParameterDoc struct {
+	Name string
+	// Where the parameter is placed: path, query or header. Query if empty
+	In          string
+	Description string
+	Required    bool
+	// Sample value of the parameter. Considered a string if nil
+	Type interface{}
 }
 
 var builtinAPI = &API{
 	Version: api.Version,
+	Extensions: []string{
+		"server_info",
+		"operations_retry_after",
+		"openapi",
+		"request_validation",
+		"options_method",
+		"etags",
+		"patch_formats",
+		"pagination",
+		"recursion_fields",
+		"problem_details",
+		"request_ids",
+		"request_timeout",
+		"idempotency_keys",
+		"async_wait",
+		"operations_wait",
+		"operations_filter",
+		"operation_logs",
+		"operation_results",
+		"operation_children",
+		"operation_access",
+		"authentication",
+		"unix_peer_credentials",
+	},
 	Commands: []*Command{
+		serverCmd,
+		versionCmd,
+		openAPIJSONCmd,
+		openAPIYAMLCmd,
 		eventsCmd,
 		operationsCmd,
+		// Registered before the single operation one, which would match it
+		operationsWaitCmd,
 		operationCmd,
 		operationWaitCmd,
+		operationLogsCmd,
 	},
 }
 
 var (
+	serverCmd = &Command{
+		Name:           "",
+		GET:            serverGet,
+		AllowAnonymous: true,
+		Summary:        "Server information",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {
+				Summary:  "Returns versions, endpoints, extensions and certificate of the server",
+				Response: api.Server{},
+			},
+		},
+	}
+
+	versionCmd = &Command{
+		Name:           "version",
+		GET:            versionGet,
+		AllowAnonymous: true,
+		Summary:        "Server version",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {
+				Summary:  "Returns framework and API versions",
+				Response: api.ServerVersion{},
+			},
+		},
+	}
+
+	openAPIJSONCmd = &Command{
+		Name:           "openapi.json",
+		GET:            openAPIJSONGet,
+		AllowAnonymous: true,
+		Summary:        "OpenAPI document",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {Summary: "Returns this OpenAPI document in JSON format"},
+		},
+	}
+
+	openAPIYAMLCmd = &Command{
+		Name:           "openapi.yaml",
+		GET:            openAPIYAMLGet,
+		AllowAnonymous: true,
+		Summary:        "OpenAPI document",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {Summary: "Returns this OpenAPI document in YAML format"},
+		},
+	}
+
 	eventsCmd = &Command{
-		Name: "events",
-		GET:  eventsGet,
+		Name:    "events",
+		GET:     eventsGet,
+		Summary: "Events stream",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {
+				Summary:     "Upgrades the connection to a websocket receiving server events",
+				Description: "Each message is a JSON object with the event timestamp and metadata",
+				Parameters: []ParameterDoc{
+					{Name: "type", Description: "Comma separated list of event types"},
+				},
+			},
+		},
 	}
 
 	operationsCmd = &Command{
-		Name: "operations",
-		GET:  operationsGet,
+		Name:    "operations",
+		GET:     operationsGet,
+		Summary: "Background operations",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {
+				Summary:     "Lists operations grouped by status",
+				Description: operationsListDescription,
+				Parameters:  append(append(append([]ParameterDoc{}, operationsFilterDoc...), recursionParamsDoc...), listParamsDoc...),
+				Response:    map[string][]api.Operation{},
+			},
+		},
 	}
 
 	operationCmd = &Command{
-		Name: "operations/{id:[a-zA-Z0-9-_:]+}",
-		GET:  operationGet,
+		Name:    "operations/{id:[a-zA-Z0-9-_:]+}",
+		GET:     operationGet,
+		DELETE:  operationDelete,
+		Expand:  operationExpand,
+		Summary: "Background operation",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {
+				Summary: "Returns an operation",
+				Parameters: append([]ParameterDoc{
+					{Name: "id", In: "path", Description: "Operation identifier"},
+				}, recursionParamsDoc...),
+				Response: api.Operation{},
+			},
+			http.MethodDelete: {
+				Summary: "Cancels a running operation",
+				Parameters: []ParameterDoc{
+					{Name: "id", In: "path", Description: "Operation identifier"},
+				},
+			},
+		},
 	}
 
 	operationWaitCmd = &Command{
-		Name: "operations/{id:[a-zA-Z0-9-_:]+}/wait",
-		GET:  operationWaitGet,
+		Name:    "operations/{id:[a-zA-Z0-9-_:]+}/wait",
+		GET:     operationWaitGet,
+		Summary: "Wait for a background operation",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {
+				Summary:     "Waits for an operation to reach a status and returns it",
+				Description: "Answers with 504 if the operation does not reach the status in time",
+				Parameters: append([]ParameterDoc{
+					{Name: "id", In: "path", Description: "Operation identifier"},
+				}, operationWaitParamsDoc...),
+				Response: api.Operation{},
+			},
+		},
+	}
+
+	operationLogsCmd = &Command{
+		Name:    "operations/{id:[a-zA-Z0-9-_:]+}/logs",
+		GET:     operationLogsGet,
+		Summary: "Output of a background operation",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {
+				Summary: "Returns the output of an operation as plain text",
+				Description: "The X-Log-Offset header of the response has the offset of its first byte in the whole output, " +
+					"and X-Log-Complete is set once the operation is done",
+				Parameters: []ParameterDoc{
+					{Name: "id", In: "path", Description: "Operation identifier"},
+					{Name: "offset", Description: "Offset in bytes to return the output from", Type: 0},
+					{Name: "follow", Description: "Whether to keep sending the output until the operation is done", Type: false},
+				},
+			},
+		},
+	}
+
+	operationsWaitCmd = &Command{
+		Name:    "operations/wait",
+		GET:     operationsWaitGet,
+		Summary: "Wait for background operations",
+		Docs: map[string]*MethodDoc{
+			http.MethodGet: {
+				Summary:     "Waits for any or all of a set of operations to reach a status and returns them",
+				Description: "Operations are returned in the requested order. Answers with 504 if they do not reach the status in time",
+				Parameters: append([]ParameterDoc{
+					{Name: "id", Description: "Comma separated list of operation identifiers. Can be repeated"},
+					{Name: "mode", Description: "Whether to wait for all the operations or any of them: all (default) or any"},
+				}, operationWaitParamsDoc...),
+				Response: []api.Operation{},
+			},
+		},
 	}
 )
+
+// How the listed operations are given
+const operationsListDescription = "Operation URLs are returned unless recursion is requested. " +
+	"Pages are sorted by creation time by default, keeping that order inside every status group"
+
+// Parameters filtering the listed operations
+var operationsFilterDoc = []ParameterDoc{
+	{Name: "status", Description: "Comma separated list of statuses of the operations"},
+	{Name: "resource", Description: "URL of a resource the operations affect"},
+	{Name: "description", Description: "Part of the description of the operations, case insensitive"},
+	{Name: "created_after", Description: "Time the operations were created after, in RFC 3339 format"},
+	{Name: "created_before", Description: "Time the operations were created before, in RFC 3339 format"},
+}
+
+// Parameters of the requests waiting for operations
+var operationWaitParamsDoc = []ParameterDoc{
+	{Name: "timeout", Description: "Time to wait, as a duration like 30s or a number of seconds. Forever if -1 or not set"},
+	{Name: "status", Description: "Comma separated list of statuses to wait for. The operation being done if not set"},
+}
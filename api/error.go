@@ -0,0 +1,43 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package api
+
+// ProblemContentType is the media type of problem details documents (RFC 7807)
+const ProblemContentType = "application/problem+json"
+
+// ErrorDetails holds the machine readable description of a failed request. It is
+// the metadata of error responses
+type ErrorDetails struct {
+	// Stable identifier of the kind of error, like "not_found"
+	Code      string       `json:"code" yaml:"code"`
+	Details   interface{}  `json:"details,omitempty" yaml:"details,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty" yaml:"fields,omitempty"`
+	RequestID string       `json:"request_id,omitempty" yaml:"request_id,omitempty"`
+}
+
+// Problem is an error response in the problem details format (RFC 7807),
+// served instead of the standard error response to the clients accepting it
+type Problem struct {
+	Type         string `json:"type" yaml:"type"`
+	Title        string `json:"title" yaml:"title"`
+	Status       int    `json:"status" yaml:"status"`
+	Detail       string `json:"detail,omitempty" yaml:"detail,omitempty"`
+	ErrorDetails `yaml:",inline"`
+}
@@ -20,9 +20,14 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"time"
 )
 
+// ErrNoResult is returned when reading the result of an operation without one
+var ErrNoResult = errors.New("Operation has no result")
+
 // Operation represents a background operation as result of a REST POST, PATCH,
 // DELETE or PUT
 type Operation struct {
@@ -35,4 +40,33 @@ type Operation struct {
 	Resources   map[string][]string    `json:"resources" yaml:"resources"`
 	Metadata    map[string]interface{} `json:"metadata" yaml:"metadata"`
 	Err         string                 `json:"err" yaml:"err"`
+
+	// Identifier of the request which created the operation
+	RequestID string `json:"request_id,omitempty" yaml:"request_id,omitempty"`
+
+	// Caller which created the operation
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty"`
+
+	// Value computed by the operation, once it succeeded
+	Result json.RawMessage `json:"result,omitempty" yaml:"-"`
+
+	// Operation this one is part of, and the ones part of this one
+	ParentID string      `json:"parent_id,omitempty" yaml:"parent_id,omitempty"`
+	Children []Operation `json:"children,omitempty" yaml:"children,omitempty"`
 }
+
+// ResultAsStruct parses the result of the operation into target
+func (op *Operation) ResultAsStruct(target interface{}) error {
+	if len(op.Result) == 0 {
+		return ErrNoResult
+	}
+	return json.Unmarshal(op.Result, target)
+}
+
+// Headers of the responses with the output of an operation
+const (
+	// Offset of the first byte of the response in the whole output
+	LogOffsetHeader = "X-Log-Offset"
+	// Set if the operation is done, so the response has its whole output
+	LogCompleteHeader = "X-Log-Complete"
+)
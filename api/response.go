@@ -32,6 +32,20 @@ const (
 	ResponseTypeError ResponseType = "error"
 )
 
+// RequestIDHeader is the header identifying a request and everything it
+// caused in the service: its response, the operation it spawned, the events
+// emitted and the log lines produced
+const RequestIDHeader = "X-Request-ID"
+
+// IdempotencyKeyHeader is the header where clients give a key unique to every
+// request with side effects. Requests sent again with the same key are not
+// attended again but answered with the original response
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RequestTimeoutHeader is the header where clients give how long, in seconds,
+// they wait for the response. Services give up attending requests after it
+const RequestTimeoutHeader = "X-Request-Timeout"
+
 // ResponseType represents a valid LXD response type
 type ResponseType string
 
@@ -49,6 +63,9 @@ type Response struct {
 	Status     string `json:"status" yaml:"status"`
 	StatusCode int    `json:"status_code" yaml:"status_code"`
 
+	// Cursor of the next page of a collection. Only in paginated Sync responses
+	Next string `json:"next,omitempty" yaml:"next,omitempty"`
+
 	// Valid only for Async responses
 	Operation string `json:"operation" yaml:"operation"`
 
@@ -58,6 +75,15 @@ type Response struct {
 
 	// Valid for Sync and Error responses
 	Metadata json.RawMessage `json:"metadata" yaml:"metadata"`
+
+	// Identifier of the answered request, taken from the response headers
+	RequestID string `json:"-" yaml:"-"`
+}
+
+// FieldError describes why a field of a request is not valid
+type FieldError struct {
+	Field   string `json:"field" yaml:"field"`
+	Message string `json:"message" yaml:"message"`
 }
 
 // MetadataAsMap parses the Response metadata into a map
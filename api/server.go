@@ -0,0 +1,43 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package api
+
+// ServerVersion represents the versions the REST service is running
+type ServerVersion struct {
+	FrameworkVersion string `json:"framework_version" yaml:"framework_version"`
+	APIVersion       string `json:"api_version" yaml:"api_version"`
+}
+
+// Server represents the information the REST service exposes about itself
+type Server struct {
+	ServerVersion `yaml:",inline"`
+
+	// Versions of all the APIs registered in the service
+	APIVersions []string `json:"api_versions" yaml:"api_versions"`
+
+	// Enabled endpoints: unix, http or https
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	AuthMethods   []string `json:"auth_methods" yaml:"auth_methods"`
+	APIExtensions []string `json:"api_extensions" yaml:"api_extensions"`
+
+	// Fingerprint of the server certificate. Only set when https is enabled
+	CertificateFingerprint string `json:"certificate_fingerprint" yaml:"certificate_fingerprint"`
+}
@@ -19,6 +19,8 @@
 
 package api
 
+import "strings"
+
 // StatusCode represents a valid REST operation status code
 type StatusCode int
 
@@ -66,6 +68,21 @@ func (o StatusCode) String() string {
 	}[o]
 }
 
+// ParseStatusCode returns the status code with the given name, case insensitive
+func ParseStatusCode(name string) (StatusCode, bool) {
+	for code := Created; code <= Error; code++ {
+		if strings.EqualFold(code.String(), name) {
+			return code, true
+		}
+	}
+	for _, code := range []StatusCode{Success, Failure, Cancelled} {
+		if strings.EqualFold(code.String(), name) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
 // IsFinal will return true if the status code indicates an end state
 func (o StatusCode) IsFinal() bool {
 	return int(o) >= 200
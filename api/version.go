@@ -5,6 +5,9 @@ import "path/filepath"
 // Version of the builtin API
 const Version = "1.0"
 
+// FrameworkVersion is the version of this REST framework
+const FrameworkVersion = "0.1.0"
+
 // Path prefixes API version to a path
 func Path(path ...string) string {
 	p := append([]string{"/", Version}, path...)
@@ -0,0 +1,289 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/greenbrew/rest/cert"
+	"github.com/greenbrew/rest/endpoints"
+	"github.com/greenbrew/rest/logger"
+)
+
+// Identity of the caller of a request, as given by an Authenticator
+type Identity struct {
+	// Name of the caller, unique among the ones authenticated the same way
+	Name string `json:"name"`
+	// How the caller was authenticated, like unix, tls or token
+	Method string   `json:"method"`
+	Groups []string `json:"groups"`
+}
+
+// String identifies the caller, as the method followed by its name
+func (i *Identity) String() string {
+	if len(i.Name) == 0 {
+		return i.Method
+	}
+	return i.Method + ":" + i.Name
+}
+
+// InGroup returns whether the caller belongs to any of the given groups
+func (i *Identity) InGroup(groups ...string) bool {
+	for _, g := range groups {
+		for _, ig := range i.Groups {
+			if g == ig {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the callers of requests. It returns nil if the
+// request has no credentials it understands, and an error if they are not
+// valid
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// AuthenticatorFunc adapts a function to be used as an Authenticator
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+// Authenticate calls f(r)
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+// UnixAuthenticator identifies the callers through the unix socket by the user
+// ID of their process, or all of them as the same local caller if it is not
+// known. They belong to Groups, and to the ones given in Users and UnixGroups
+// for their user and unix groups, by name or ID
+type UnixAuthenticator struct {
+	Groups     []string
+	Users      map[string][]string
+	UnixGroups map[string][]string
+}
+
+// Authenticate implements Authenticator
+func (a *UnixAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if !requestUsesUnixSocket(r) {
+		return nil, nil
+	}
+
+	identity := &Identity{Method: "unix", Groups: append([]string(nil), a.Groups...)}
+	creds, ok := endpoints.PeerCredentialsFromContext(r.Context())
+	if !ok {
+		return identity, nil
+	}
+
+	uid := strconv.FormatUint(uint64(creds.UID), 10)
+	identity.Name = uid
+
+	u, err := user.LookupId(uid)
+	if err != nil {
+		logger.Debugf("Could not look up user %s: %v", uid, err)
+		u = nil
+	}
+
+	identity.Groups = append(identity.Groups, a.Users[uid]...)
+	if u != nil {
+		identity.Groups = append(identity.Groups, a.Users[u.Username]...)
+	}
+
+	if len(a.UnixGroups) > 0 {
+		for _, gid := range unixGroupIDs(u, creds.GID) {
+			identity.Groups = append(identity.Groups, a.UnixGroups[gid]...)
+			if g, err := user.LookupGroupId(gid); err == nil {
+				identity.Groups = append(identity.Groups, a.UnixGroups[g.Name]...)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// unixGroupIDs returns the IDs of the unix groups of a process running as u
+// with the given primary group
+func unixGroupIDs(u *user.User, gid uint32) []string {
+	primary := strconv.FormatUint(uint64(gid), 10)
+	gids := []string{primary}
+	if u == nil {
+		return gids
+	}
+
+	supplementary, err := u.GroupIds()
+	if err != nil {
+		logger.Debugf("Could not look up groups of user %s: %v", u.Uid, err)
+		return gids
+	}
+	for _, g := range supplementary {
+		if g != primary {
+			gids = append(gids, g)
+		}
+	}
+	return gids
+}
+
+// TLSAuthenticator identifies clients by the fingerprint of their certificate,
+// verified by the HTTPS endpoint against its CA if there is one. If Groups is
+// set, only the certificates whose fingerprints are in it are accepted, their
+// clients belonging to the given groups
+type TLSAuthenticator struct {
+	Groups map[string][]string
+}
+
+// Authenticate implements Authenticator
+func (a *TLSAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+
+	fingerprint := cert.Fingerprint(r.TLS.PeerCertificates[0])
+	if a.Groups == nil {
+		return &Identity{Name: fingerprint, Method: "tls"}, nil
+	}
+
+	groups, ok := a.Groups[fingerprint]
+	if !ok {
+		return nil, errors.New("Client certificate not trusted")
+	}
+	return &Identity{Name: fingerprint, Method: "tls", Groups: groups}, nil
+}
+
+// TokenAuthenticator identifies clients by the bearer token in their
+// Authorization header, being the ones in Tokens mapped to its identity.
+// Other tokens are rejected
+type TokenAuthenticator struct {
+	Tokens map[string]Identity
+}
+
+// Authenticate implements Authenticator
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return nil, nil
+	}
+	token := strings.TrimSpace(auth[len("Bearer "):])
+
+	// All the tokens are compared, not to disclose which one is closer
+	var found *Identity
+	for t, identity := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			identity := identity
+			found = &identity
+		}
+	}
+	if found == nil {
+		return nil, errors.New("Invalid token")
+	}
+
+	found.Method = "token"
+	return found, nil
+}
+
+// withAuthentication identifies the caller of the requests to c with its
+// authenticators, or the ones of the service, keeping the identity in the
+// request context. Anonymous callers are rejected with a 401 unless c allows
+// them, and those not in its groups, or in its write groups for requests
+// other than GET, HEAD and OPTIONS, with a 403
+func (d *Service) withAuthentication(c *Command, next http.Handler) http.Handler {
+	authenticators := d.Authenticators
+	if len(c.Authenticators) > 0 {
+		authenticators = c.Authenticators
+	}
+	if len(authenticators) == 0 {
+		return next
+	}
+
+	writeGroups := d.WriteGroups
+	if len(c.WriteGroups) > 0 {
+		writeGroups = c.WriteGroups
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Preflight requests have no credentials
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, err := authenticate(authenticators, r)
+		if err != nil {
+			logger.Debugf("Authentication failed for %s %s (request %s): %v", r.Method, r.URL.Path, RequestID(r), err)
+			renderResponse(w, r, AuthorizationError(err))
+			return
+		}
+
+		if identity == nil && !c.AllowAnonymous {
+			renderResponse(w, r, AuthorizationError(errors.New("Authentication required")))
+			return
+		}
+		if len(c.Groups) > 0 && (identity == nil || !identity.InGroup(c.Groups...)) {
+			renderResponse(w, r, Forbidden)
+			return
+		}
+		if len(writeGroups) > 0 && !isSafeMethod(r.Method) && (identity == nil || !identity.InGroup(writeGroups...)) {
+			renderResponse(w, r, Forbidden)
+			return
+		}
+
+		if identity != nil {
+			r = r.WithContext(context.WithValue(r.Context(), identityKey, identity))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the identity given by the first authenticator
+// understanding the credentials of r
+func authenticate(authenticators []Authenticator, r *http.Request) (*Identity, error) {
+	for _, a := range authenticators {
+		identity, err := a.Authenticate(r)
+		if err != nil || identity != nil {
+			return identity, err
+		}
+	}
+	return nil, nil
+}
+
+// RequestIdentity returns the identity of the caller of the given HTTP
+// request, or nil if it was not authenticated
+func RequestIdentity(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey).(*Identity)
+	return identity
+}
+
+// Identity returns the identity of the caller, or nil if not authenticated
+func (r *Request) Identity() *Identity {
+	return RequestIdentity(r.HTTPRequest)
+}
+
+// PeerCredentials returns the credentials of the process which sent the
+// request through the unix socket, or nil if not known
+func (r *Request) PeerCredentials() *endpoints.PeerCredentials {
+	creds, _ := endpoints.PeerCredentialsFromContext(r.HTTPRequest.Context())
+	return creds
+}
@@ -0,0 +1,245 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	check "gopkg.in/check.v1"
+
+	"github.com/greenbrew/rest/api"
+)
+
+type authenticationSuite struct {
+	d *Service
+}
+
+var _ = check.Suite(&authenticationSuite{})
+
+func (s *authenticationSuite) SetUpTest(c *check.C) {
+	whoami := func(r *Request) Response {
+		return SyncResponse(true, jmap{"caller": r.Caller(), "identity": r.Identity()})
+	}
+
+	s.d = &Service{
+		Authenticators: []Authenticator{
+			&UnixAuthenticator{Groups: []string{"local"}},
+			&TokenAuthenticator{Tokens: map[string]Identity{
+				"secret": {Name: "alice", Groups: []string{"admin"}},
+				"other":  {Name: "bob"},
+			}},
+		},
+	}
+	s.d.Init([]*API{{
+		Version: api.Version,
+		Commands: []*Command{
+			{Name: "whoami", GET: whoami},
+			{Name: "admin", GET: whoami, Groups: []string{"admin"}},
+			{Name: "public", GET: whoami, AllowAnonymous: true},
+			{Name: "local", GET: whoami, Authenticators: []Authenticator{&UnixAuthenticator{}}},
+		},
+	}})
+}
+
+func (s *authenticationSuite) get(c *check.C, url, token string, unix bool) (int, jmap) {
+	r := httptest.NewRequest("GET", url, nil)
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if unix {
+		r.RemoteAddr = "@"
+	}
+
+	w := httptest.NewRecorder()
+	s.d.Router.ServeHTTP(w, r)
+
+	resp := &api.Response{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), resp), check.IsNil)
+	md := jmap{}
+	c.Assert(resp.MetadataAsStruct(&md), check.IsNil)
+	return w.Code, md
+}
+
+func (s *authenticationSuite) TestAuthenticate(c *check.C) {
+	code, md := s.get(c, "/1.0/whoami", "secret", false)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(md["caller"], check.Equals, "token:alice")
+	c.Assert(md["identity"], check.DeepEquals, map[string]interface{}{
+		"name": "alice", "method": "token", "groups": []interface{}{"admin"},
+	})
+
+	code, md = s.get(c, "/1.0/whoami", "", true)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(md["caller"], check.Equals, "unix")
+
+	// Anonymous callers and those with wrong credentials are rejected
+	code, _ = s.get(c, "/1.0/whoami", "", false)
+	c.Assert(code, check.Equals, http.StatusUnauthorized)
+	code, _ = s.get(c, "/1.0/whoami", "wrong", false)
+	c.Assert(code, check.Equals, http.StatusUnauthorized)
+
+	code, md = s.get(c, "/1.0/public", "", false)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(md["identity"], check.IsNil)
+	code, _ = s.get(c, "/1.0", "", false)
+	c.Assert(code, check.Equals, http.StatusOK)
+}
+
+func (s *authenticationSuite) TestAuthMethods(c *check.C) {
+	_, md := s.get(c, "/1.0", "", false)
+	c.Assert(md["auth_methods"], check.DeepEquals, []interface{}{"unix", "token"})
+
+	// Including the ones of the commands
+	d := &Service{}
+	d.Init([]*API{{
+		Version:  api.Version,
+		Commands: []*Command{{Name: "things", GET: func(r *Request) Response { return EmptySyncResponse }, Authenticators: []Authenticator{&TLSAuthenticator{}}}},
+	}})
+	s.d = d
+	_, md = s.get(c, "/1.0", "", false)
+	c.Assert(md["auth_methods"], check.DeepEquals, []interface{}{"tls"})
+}
+
+func (s *authenticationSuite) TestGroups(c *check.C) {
+	code, _ := s.get(c, "/1.0/admin", "secret", false)
+	c.Assert(code, check.Equals, http.StatusOK)
+	code, _ = s.get(c, "/1.0/admin", "other", false)
+	c.Assert(code, check.Equals, http.StatusForbidden)
+	code, _ = s.get(c, "/1.0/admin", "", true)
+	c.Assert(code, check.Equals, http.StatusForbidden)
+	code, _ = s.get(c, "/1.0/admin", "", false)
+	c.Assert(code, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *authenticationSuite) TestCommandAuthenticators(c *check.C) {
+	code, _ := s.get(c, "/1.0/local", "", true)
+	c.Assert(code, check.Equals, http.StatusOK)
+	code, _ = s.get(c, "/1.0/local", "secret", false)
+	c.Assert(code, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *authenticationSuite) TestTLSAuthenticator(c *check.C) {
+	a := &TLSAuthenticator{}
+	identity, err := a.Authenticate(httptest.NewRequest("GET", "/1.0", nil))
+	c.Assert(err, check.IsNil)
+	c.Assert(identity, check.IsNil)
+
+	r := callerRequest("GET", "/1.0", "alice")
+	identity, err = a.Authenticate(r)
+	c.Assert(err, check.IsNil)
+	c.Assert(identity.Method, check.Equals, "tls")
+	c.Assert(identity.String(), check.Equals, requestCaller(r))
+
+	// Only the known certificates are trusted, if given
+	a.Groups = map[string][]string{identity.Name: {"admin"}}
+	identity, err = a.Authenticate(r)
+	c.Assert(err, check.IsNil)
+	c.Assert(identity.InGroup("admin"), check.Equals, true)
+	_, err = a.Authenticate(callerRequest("GET", "/1.0", "bob"))
+	c.Assert(err, check.ErrorMatches, "Client certificate not trusted")
+}
+
+func (s *authenticationSuite) TestUnixPeerCredentials(c *check.C) {
+	tmpDir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	unix := &UnixAuthenticator{Users: map[string][]string{uid: {"admin"}}}
+	whoami := func(r *Request) Response {
+		return SyncResponse(true, jmap{"caller": r.Caller(), "identity": r.Identity(), "creds": r.PeerCredentials()})
+	}
+
+	socketPath := filepath.Join(tmpDir, "unix.socket")
+	d := &Service{
+		UnixSocketPath: socketPath,
+		Authenticators: []Authenticator{unix},
+		WriteGroups:    []string{"admin"},
+	}
+	d.Init([]*API{{
+		Version:  api.Version,
+		Commands: []*Command{{Name: "whoami", GET: whoami, POST: whoami}},
+	}})
+	c.Assert(d.Start(), check.IsNil)
+	defer d.Shutdown()
+
+	httpc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	call := func(method string) (int, jmap) {
+		req, err := http.NewRequest(method, "http://unix/1.0/whoami", nil)
+		c.Assert(err, check.IsNil)
+		resp, err := httpc.Do(req)
+		c.Assert(err, check.IsNil)
+		defer resp.Body.Close()
+
+		body := &api.Response{}
+		c.Assert(json.NewDecoder(resp.Body).Decode(body), check.IsNil)
+		md := jmap{}
+		body.MetadataAsStruct(&md)
+		return resp.StatusCode, md
+	}
+
+	// Local callers are identified by their user
+	code, md := call("GET")
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(md["caller"], check.Equals, "unix:"+uid)
+	c.Assert(md["creds"], check.DeepEquals, map[string]interface{}{
+		"UID": float64(os.Getuid()), "GID": float64(os.Getgid()), "PID": float64(os.Getpid()),
+	})
+	code, _ = call("POST")
+	c.Assert(code, check.Equals, http.StatusOK)
+
+	// Others are read-only
+	unix.Users = nil
+	code, _ = call("GET")
+	c.Assert(code, check.Equals, http.StatusOK)
+	code, _ = call("POST")
+	c.Assert(code, check.Equals, http.StatusForbidden)
+
+	// Unless in an allowed unix group
+	unix.UnixGroups = map[string][]string{gid: {"admin"}}
+	code, _ = call("POST")
+	c.Assert(code, check.Equals, http.StatusOK)
+}
+
+func (s *authenticationSuite) TestOwnerGroupsPolicy(c *check.C) {
+	policy := OwnerGroupsPolicy("admin")
+
+	admin := httptest.NewRequest("GET", "/1.0/operations", nil)
+	admin = admin.WithContext(context.WithValue(admin.Context(), identityKey, &Identity{Name: "0", Method: "unix", Groups: []string{"admin"}}))
+	other := httptest.NewRequest("GET", "/1.0/operations", nil)
+	other = other.WithContext(context.WithValue(other.Context(), identityKey, &Identity{Name: "1000", Method: "unix"}))
+
+	c.Assert(policy(&Request{HTTPRequest: admin}, "unix:1000"), check.Equals, true)
+	c.Assert(policy(&Request{HTTPRequest: other}, "unix:1000"), check.Equals, true)
+	c.Assert(policy(&Request{HTTPRequest: other}, "unix:0"), check.Equals, false)
+	c.Assert(policy(&Request{HTTPRequest: other}, ""), check.Equals, false)
+}
@@ -0,0 +1,292 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	requestType  = reflect.TypeOf(&Request{})
+	responseType = reflect.TypeOf((*Response)(nil)).Elem()
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Bind returns a handler that decodes and validates every request into a new
+// value of type T before calling the given handler, which must be of type
+// func(*Request, *T) Response, being T a struct. Requests not passing the
+// validation are answered with a bad request without calling the handler.
+// See Request.Bind for the supported struct tags.
+func Bind(handler interface{}) handlerFunc {
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 1 ||
+		t.In(0) != requestType || t.Out(0) != responseType ||
+		t.In(1).Kind() != reflect.Ptr || t.In(1).Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("Cannot bind handler of type %v. Expected func(*Request, *T) Response", t))
+	}
+
+	// Fail early on invalid rules, as they are a programming error
+	target := t.In(1).Elem()
+	if err := validate(reflect.New(target), "", fieldSet{}, &ValidationError{}); err != nil {
+		panic(fmt.Sprintf("Cannot bind handler for %v: %v", target, err))
+	}
+
+	return func(r *Request) Response {
+		v := reflect.New(target)
+		if err := r.Bind(v.Interface()); err != nil {
+			return SmartError(err)
+		}
+
+		resp, _ := fn.Call([]reflect.Value{reflect.ValueOf(r), v})[0].Interface().(Response)
+		return resp
+	}
+}
+
+// Bind decodes the request into target, a pointer to a struct, and validates it.
+// The JSON body is decoded into the struct, or into the field tagged as `body`
+// if any. Fields tagged as `path:"name"` or `query:"name"` take their value from
+// the path variables or query parameters with that name. Then the fields are
+// validated with the rules in their `validate` tag, a comma separated list of:
+//
+//	required        the value cannot be empty
+//	min=N, max=N    limits for numbers or for the length of strings, slices and maps
+//	enum=a|b|c      the value must be one of the given ones
+//	regex=EXPR      strings must match the expression. Must be the last rule
+//
+// Rules other than required only apply to the fields present in the request,
+// even if their value is zero.
+// An *ValidationError is returned if the request is not valid
+func (r *Request) Bind(target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Cannot bind request into %T. A pointer to struct is required", target)
+	}
+	v = v.Elem()
+
+	verr := &ValidationError{}
+	present := fieldSet{}
+	r.bindBody(v, present, verr)
+	r.bindParams(v, present, verr)
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+
+	if err := validate(v, "", present, verr); err != nil {
+		return err
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+
+	return nil
+}
+
+func (r *Request) bindBody(v reflect.Value, present fieldSet, verr *ValidationError) {
+	req := r.HTTPRequest
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+
+	// Decode into the field tagged as body if any. Into the whole struct otherwise,
+	// unless no field takes its value from the body, leaving it for the handler
+	name := ""
+	target := v.Addr().Interface()
+	fromBody := false
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if _, ok := f.Tag.Lookup("body"); ok {
+			name = bindFieldName(f)
+			target = v.Field(i).Addr().Interface()
+			fromBody = true
+			break
+		}
+
+		_, path := f.Tag.Lookup("path")
+		_, query := f.Tag.Lookup("query")
+		if len(f.PkgPath) == 0 && !path && !query && f.Tag.Get("json") != "-" {
+			fromBody = true
+		}
+	}
+	if !fromBody {
+		return
+	}
+
+	// The document is kept to know which fields are present
+	var raw json.RawMessage
+	err := json.NewDecoder(req.Body).Decode(&raw)
+	if err == nil {
+		var doc interface{}
+		if err = json.Unmarshal(raw, &doc); err == nil {
+			if len(name) > 0 {
+				present.add(name)
+			}
+			present.addJSON(doc, name)
+			err = json.Unmarshal(raw, target)
+		}
+	}
+
+	switch e := err.(type) {
+	case nil:
+	case *json.UnmarshalTypeError:
+		field := e.Field
+		if len(name) > 0 {
+			field = name
+			if len(e.Field) > 0 {
+				field = name + "." + e.Field
+			}
+		}
+		verr.add(field, "must be %v", e.Type)
+	default:
+		if err == io.EOF {
+			// Empty body
+			return
+		}
+		verr.add("body", "is not valid JSON: %v", err)
+	}
+}
+
+func (r *Request) bindParams(v reflect.Value, present fieldSet, verr *ValidationError) {
+	vars := mux.Vars(r.HTTPRequest)
+	query := r.HTTPRequest.URL.Query()
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		var values []string
+		if name, ok := f.Tag.Lookup("path"); ok {
+			value, ok := vars[name]
+			if !ok {
+				continue
+			}
+			values = []string{value}
+		} else if name, ok := f.Tag.Lookup("query"); ok {
+			values, ok = query[name]
+			if !ok {
+				continue
+			}
+		} else {
+			continue
+		}
+
+		present.add(bindFieldName(f))
+		if err := setFromStrings(v.Field(i), values); err != nil {
+			verr.add(bindFieldName(f), "%v", err)
+		}
+	}
+}
+
+// bindFieldName returns the name a field is known by in the request
+func bindFieldName(f reflect.StructField) string {
+	if name, ok := f.Tag.Lookup("path"); ok {
+		return name
+	}
+	if name, ok := f.Tag.Lookup("query"); ok {
+		return name
+	}
+	if _, ok := f.Tag.Lookup("body"); ok {
+		return "body"
+	}
+
+	name, _, _ := jsonFieldName(f)
+	return name
+}
+
+// setFromStrings sets the value of v from the given strings. Only slices
+// can receive more than a value
+func setFromStrings(v reflect.Value, values []string) error {
+	if v.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, s := range values {
+			if err := setFromString(slice.Index(i), s); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+	return setFromString(v, values[0])
+}
+
+func setFromString(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr {
+		elem := reflect.New(v.Type().Elem())
+		if err := setFromString(elem.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	}
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("must be a duration")
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a positive integer")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("has an unsupported type %v", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	check "gopkg.in/check.v1"
+
+	"github.com/greenbrew/rest/api"
+)
+
+type bindSuite struct{}
+
+var _ = check.Suite(&bindSuite{})
+
+type bindAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type bindThing struct {
+	ID      string        `path:"id" validate:"required,regex=^[a-z]{1,3}$"`
+	Limit   int           `query:"limit" validate:"min=1,max=100"`
+	Tags    []string      `query:"tag"`
+	Timeout time.Duration `query:"timeout"`
+	Name    string        `json:"name" validate:"required,min=3"`
+	Kind    string        `json:"kind" validate:"enum=big|small"`
+	Address *bindAddress  `json:"address"`
+}
+
+func newBindRequest(method, url, body string, vars map[string]string) *Request {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	return &Request{HTTPRequest: mux.SetURLVars(req, vars)}
+}
+
+func (s *bindSuite) TestBind(c *check.C) {
+	r := newBindRequest("PUT", "/1.0/things/abc?limit=10&tag=a&tag=b&timeout=2s",
+		`{"name": "foo", "kind": "big", "address": {"city": "Madrid"}}`, map[string]string{"id": "abc"})
+
+	thing := &bindThing{}
+	err := r.Bind(thing)
+	c.Assert(err, check.IsNil)
+	c.Assert(thing, check.DeepEquals, &bindThing{
+		ID:      "abc",
+		Limit:   10,
+		Tags:    []string{"a", "b"},
+		Timeout: 2 * time.Second,
+		Name:    "foo",
+		Kind:    "big",
+		Address: &bindAddress{City: "Madrid"},
+	})
+}
+
+func (s *bindSuite) TestValidationErrors(c *check.C) {
+	r := newBindRequest("PUT", "/1.0/things/abcd?limit=0",
+		`{"name": "fo", "kind": "medium", "address": {}}`, map[string]string{"id": "abcd"})
+
+	err := r.Bind(&bindThing{})
+	verr, ok := err.(*ValidationError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(verr.Fields, check.DeepEquals, []api.FieldError{
+		{Field: "id", Message: `must match "^[a-z]{1,3}$"`},
+		{Field: "limit", Message: "must be at least 1"},
+		{Field: "name", Message: "must have at least 3 characters"},
+		{Field: "kind", Message: "must be one of: big, small"},
+		{Field: "address.city", Message: "is required"},
+	})
+}
+
+func (s *bindSuite) TestFieldNamesIgnoreCase(c *check.C) {
+	// The decoder matches the fields ignoring case, so does the validation
+	r := newBindRequest("PUT", "/1.0/things/abc", `{"Name": "foo", "KIND": ""}`, map[string]string{"id": "abc"})
+
+	err := r.Bind(&bindThing{})
+	verr, ok := err.(*ValidationError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(verr.Fields, check.DeepEquals, []api.FieldError{
+		{Field: "kind", Message: "must be one of: big, small"},
+	})
+}
+
+func (s *bindSuite) TestDecodingErrors(c *check.C) {
+	r := newBindRequest("PUT", "/1.0/things/abc?limit=many", `{"name": 42}`, map[string]string{"id": "abc"})
+
+	err := r.Bind(&bindThing{})
+	verr, ok := err.(*ValidationError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(verr.Fields, check.DeepEquals, []api.FieldError{
+		{Field: "name", Message: "must be string"},
+		{Field: "limit", Message: "must be an integer"},
+	})
+
+	r = newBindRequest("PUT", "/1.0/things/abc", `{"name": `, map[string]string{"id": "abc"})
+	err = r.Bind(&bindThing{})
+	c.Assert(err, check.ErrorMatches, "Invalid request: body is not valid JSON: .*")
+}
+
+func (s *bindSuite) TestBodyField(c *check.C) {
+	type resource struct {
+		ID    string      `path:"id"`
+		Value interface{} `body:"" validate:"required"`
+	}
+
+	r := newBindRequest("PUT", "/1.0/things/abc", `[1, 2]`, map[string]string{"id": "abc"})
+	res := &resource{}
+	err := r.Bind(res)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.ID, check.Equals, "abc")
+	c.Assert(res.Value, check.DeepEquals, []interface{}{float64(1), float64(2)})
+
+	r = newBindRequest("PUT", "/1.0/things/abc", "", map[string]string{"id": "abc"})
+	err = r.Bind(&resource{})
+	c.Assert(err, check.ErrorMatches, "Invalid request: body is required")
+}
+
+func (s *bindSuite) TestBindHandler(c *check.C) {
+	called := false
+	handler := Bind(func(r *Request, thing *bindThing) Response {
+		called = true
+		return SyncResponse(true, thing.Name)
+	})
+
+	// Invalid request is answered without calling the handler
+	r := newBindRequest("PUT", "/1.0/things/abc", `{}`, map[string]string{"id": "abc"})
+	w := newBufferedResponseWriter()
+	err := handler(r).Render(w)
+	c.Assert(err, check.IsNil)
+	c.Assert(called, check.Equals, false)
+	c.Assert(w.statusCode, check.Equals, http.StatusBadRequest)
+
+	resp := api.Response{}
+	err = json.Unmarshal(w.buffer.Bytes(), &resp)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.Type, check.Equals, api.ResponseTypeError)
+	c.Assert(resp.Error, check.Equals, "Invalid request: name is required")
+
+	var details struct {
+		Fields []api.FieldError `json:"fields"`
+	}
+	err = resp.MetadataAsStruct(&details)
+	c.Assert(err, check.IsNil)
+	c.Assert(details.Fields, check.DeepEquals, []api.FieldError{{Field: "name", Message: "is required"}})
+
+	// Valid request reaches the handler
+	r = newBindRequest("PUT", "/1.0/things/abc", `{"name": "foo"}`, map[string]string{"id": "abc"})
+	w = newBufferedResponseWriter()
+	err = handler(r).Render(w)
+	c.Assert(err, check.IsNil)
+	c.Assert(called, check.Equals, true)
+}
+
+func (s *bindSuite) TestBindInvalidHandler(c *check.C) {
+	c.Assert(func() { Bind(func(r *Request) Response { return nil }) }, check.PanicMatches, "Cannot bind handler of type .*")
+
+	type invalidRules struct {
+		Name string `validate:"unknown"`
+	}
+	c.Assert(func() {
+		Bind(func(r *Request, v *invalidRules) Response { return nil })
+	}, check.PanicMatches, "Cannot bind handler for .*: Invalid validation rule 'unknown': unknown rule")
+}
+
+func (s *bindSuite) TestBodyLeftForHandler(c *check.C) {
+	r := newBindRequest("PATCH", "/1.0/things/abc", `[{"op": "remove", "path": "/name"}]`, map[string]string{"id": "abc"})
+
+	target := &struct {
+		ID string `path:"id"`
+	}{}
+	err := r.Bind(target)
+	c.Assert(err, check.IsNil)
+	c.Assert(target.ID, check.Equals, "abc")
+
+	body, err := ioutil.ReadAll(r.HTTPRequest.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, `[{"op": "remove", "path": "/name"}]`)
+}
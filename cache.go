@@ -21,20 +21,36 @@ package rest
 
 import (
 	"sync"
+	"time"
 
-	"github.com/pkg/errors"
+	"github.com/greenbrew/rest/errs"
 )
 
 type cache struct {
 	operations map[string]*Operation
 	mux        sync.Mutex
+
+	// Time finished operations are kept. DefaultOperationRetention if zero
+	retention time.Duration
 }
 
-func (c *cache) getOperationsMap() map[string]*Operation {
+// getOperations returns the operations in the cache at the time of the call
+func (c *cache) getOperations() []*Operation {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	return c.operations
+	ops := make([]*Operation, 0, len(c.operations))
+	for _, op := range c.operations {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func (c *cache) operationRetention() time.Duration {
+	if c.retention <= 0 {
+		return DefaultOperationRetention
+	}
+	return c.retention
 }
 
 func (c *cache) addOperation(op *Operation) {
@@ -53,7 +69,7 @@ func (c *cache) getOperationByID(id string) (*Operation, error) {
 
 	op, ok := c.operations[id]
 	if !ok {
-		return nil, errors.Errorf("Operation '%s' does not exist", id)
+		return nil, errs.NewNotFound("Operation")
 	}
 	return op, nil
 }
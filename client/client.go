@@ -20,18 +20,24 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/pborman/uuid"
+
 	"github.com/greenbrew/rest/api"
 	"github.com/greenbrew/rest/logger"
 	"github.com/greenbrew/rest/reverter"
@@ -42,6 +48,12 @@ const (
 	DefaultTransportTimeout = 30 * time.Second
 )
 
+// Default number of times a request is retried when the service answers it
+// is unavailable with a Retry-After header
+const (
+	DefaultMaxRetries = 3
+)
+
 // Doer is the implementation of the Client engine
 type Doer interface {
 	Do(*http.Request) (*http.Response, error)
@@ -52,6 +64,14 @@ type client struct {
 	Doer
 
 	serviceURL *url.URL
+	maxRetries int
+
+	// Bearer token identifying the client, if any
+	token string
+
+	// API extensions supported by the server, fetched on first use
+	extensions    []string
+	extensionsMux sync.Mutex
 
 	listener *EventListener
 	mux      sync.Mutex
@@ -97,6 +117,7 @@ func newNetworkClient(url *url.URL, tlsConfig *tls.Config) (Client, error) {
 			Timeout: DefaultTransportTimeout,
 		},
 		serviceURL: url,
+		maxRetries: DefaultMaxRetries,
 	}
 
 	return c, nil
@@ -128,23 +149,25 @@ func newUnixSocketClient(path string) (Client, error) {
 			Timeout: DefaultTransportTimeout,
 		},
 		serviceURL: unixSocketServiceURL,
+		maxRetries: DefaultMaxRetries,
 	}
 
 	return c, nil
 }
 
+// extractErrorFromResponse returns the error described by a failed response
 func extractErrorFromResponse(resp *http.Response) error {
-	var errorResponse struct {
-		Code    int    `json:"error_code"`
-		Message string `json:"error"`
-	}
-
-	err := json.NewDecoder(resp.Body).Decode(&errorResponse)
-	if err != nil {
-		return err
+	response := api.Response{}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil || response.Type != api.ResponseTypeError {
+		return &APIError{
+			StatusCode:   resp.StatusCode,
+			Message:      fmt.Sprintf("Request failed: %s", resp.Status),
+			ErrorDetails: api.ErrorDetails{RequestID: responseRequestID(resp)},
+		}
 	}
 
-	return fmt.Errorf(errorResponse.Message)
+	return newAPIError(&response, resp)
 }
 
 // SetTimeout overwrites default timeout of the client with a new one
@@ -156,9 +179,34 @@ func (c *client) SetTransportTimeout(timeout time.Duration) {
 	c.Doer.(*http.Client).Timeout = timeout
 }
 
+// SetMaxRetries sets how many times a request is retried when the service
+// replies as unavailable with a Retry-After header. Only safe requests or
+// those the caller gives an idempotency key are retried. Zero disables retries
+func (c *client) SetMaxRetries(retries int) {
+	c.maxRetries = retries
+}
+
+// SetToken sets the bearer token identifying the client in every request.
+// An empty token sends none
+func (c *client) SetToken(token string) {
+	c.token = token
+}
+
+// authorize adds the credentials of the client to header
+func (c *client) authorize(header http.Header) {
+	if len(c.token) > 0 && len(header.Get("Authorization")) == 0 {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
 // QueryStruct sends a request to the server and stores response in a struct
 func (c *client) QueryStruct(method, path string, params QueryParams, header http.Header, body io.Reader, etag string, target interface{}) (string, error) {
-	resp, etag, err := c.CallAPI(method, path, params, header, body, etag)
+	return c.QueryStructContext(context.Background(), method, path, params, header, body, etag, target)
+}
+
+// QueryStructContext is like QueryStruct, giving up the request once ctx is done
+func (c *client) QueryStructContext(ctx context.Context, method, path string, params QueryParams, header http.Header, body io.Reader, etag string, target interface{}) (string, error) {
+	resp, etag, err := c.CallAPIContext(ctx, method, path, params, header, body, etag)
 	if err != nil {
 		return "", err
 	}
@@ -208,17 +256,121 @@ func (c *client) QueryOperation(method, path string, params QueryParams, header
 	return &op, etag, nil
 }
 
-// CallAPI requests a REST api method with provided query params and body and returns related http response
+// CallAPI requests a REST api method with provided query params and body and returns related http response.
+// Requests rejected as unavailable are retried after the time asked by the service
 func (c *client) CallAPI(method, path string, params QueryParams, header http.Header, body io.Reader, etag string) (*api.Response, string, error) {
+	return c.CallAPIContext(context.Background(), method, path, params, header, body, etag)
+}
+
+// CallAPIContext is like CallAPI, giving up the request and its retries once
+// ctx is done
+func (c *client) CallAPIContext(ctx context.Context, method, path string, params QueryParams, header http.Header, body io.Reader, etag string) (*api.Response, string, error) {
+	// Keep the body around in case the request needs to be sent again
+	var content []byte
+	if body != nil {
+		var err error
+		content, err = ioutil.ReadAll(body)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// All the attempts are identified the same way
+	header = identifyRequest(header)
+	retriable := isRetriable(method, header)
+
+	for attempt := 0; ; attempt++ {
+		r, err := c.newRequest(method, path, params, header, content, etag)
+		if err != nil {
+			return nil, "", err
+		}
+		r = r.WithContext(ctx)
+
+		resp, err := c.Doer.Do(r)
+		if err != nil {
+			return nil, "", err
+		}
+
+		wait, ok := c.retryAfter(resp)
+		if !ok || !retriable || attempt >= c.maxRetries {
+			defer resp.Body.Close()
+			return c.parseResponse(resp)
+		}
+
+		resp.Body.Close()
+		logger.Debugf("Service unavailable, retrying in %v", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, "", ctx.Err()
+		}
+	}
+}
+
+// CallRaw sends a request returning the HTTP response as is, for those not
+// in the standard JSON format. Error responses are returned as errors. The
+// body of the response must be closed
+func (c *client) CallRaw(ctx context.Context, method, path string, params QueryParams, header http.Header) (*http.Response, error) {
+	r, err := c.newRequest(method, path, params, identifyRequest(header), nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Doer.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, extractErrorFromResponse(resp)
+	}
+	return resp, nil
+}
+
+// identifyRequest returns a copy of header including a request ID, keeping
+// the one already given
+func identifyRequest(header http.Header) http.Header {
+	if header == nil {
+		header = http.Header{}
+	} else {
+		header = header.Clone()
+	}
+
+	if len(header.Get(api.RequestIDHeader)) == 0 {
+		header.Set(api.RequestIDHeader, uuid.NewRandom().String())
+	}
+	return header
+}
+
+// isRetriable returns whether a request can be sent again without side
+// effects: safe methods or those carrying an idempotency key
+func isRetriable(method string, header http.Header) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return len(header.Get(api.IdempotencyKeyHeader)) > 0
+}
+
+func (c *client) newRequest(method, path string, params QueryParams, header http.Header, content []byte, etag string) (*http.Request, error) {
 	u := c.serviceURL.ResolveReference(
 		&url.URL{
 			Path: path,
 		},
 	)
 
+	var body io.Reader
+	if content != nil {
+		body = bytes.NewReader(content)
+	}
+
 	r, err := http.NewRequest(method, u.String(), body)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
 	v := r.URL.Query()
@@ -241,14 +393,47 @@ func (c *client) CallAPI(method, path string, params QueryParams, header http.He
 		}
 	}
 
-	resp, err := c.Doer.Do(r)
-	if err != nil {
-		return nil, "", err
+	c.authorize(r.Header)
+
+	// Let the service know when to give up, if not told by the caller
+	if hc, ok := c.Doer.(*http.Client); ok && hc.Timeout > 0 && len(r.Header.Get(api.RequestTimeoutHeader)) == 0 {
+		r.Header.Set(api.RequestTimeoutHeader, strconv.FormatFloat(hc.Timeout.Seconds(), 'f', -1, 64))
+	}
+
+	return r, nil
+}
+
+// retryAfter returns the time to wait before retrying a request, if the
+// response is a 503 including a Retry-After header. Waits longer than
+// the transport timeout are not honored
+func (c *client) retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	} else {
+		return 0, false
+	}
+
+	if wait < 0 {
+		wait = 0
 	}
 
-	defer resp.Body.Close()
+	if hc, ok := c.Doer.(*http.Client); ok && hc.Timeout > 0 && wait > hc.Timeout {
+		return 0, false
+	}
 
-	return c.parseResponse(resp)
+	return wait, true
 }
 
 // Internal functions
@@ -264,7 +449,13 @@ func (c *client) parseResponse(resp *http.Response) (*api.Response, string, erro
 	if err != nil {
 		// Check the return value for a cleaner error
 		if resp.StatusCode != http.StatusOK {
-			return nil, "", fmt.Errorf("Failed to fetch %s: %s", resp.Request.URL.String(), resp.Status)
+			return nil, "", &APIError{
+				StatusCode: resp.StatusCode,
+				Message:    fmt.Sprintf("Failed to fetch %s: %s", resp.Request.URL.String(), resp.Status),
+				ErrorDetails: api.ErrorDetails{
+					RequestID: responseRequestID(resp),
+				},
+			}
 		}
 
 		return nil, "", err
@@ -272,12 +463,23 @@ func (c *client) parseResponse(resp *http.Response) (*api.Response, string, erro
 
 	// Handle errors
 	if response.Type == api.ResponseTypeError {
-		return nil, "", fmt.Errorf(response.Error)
+		return nil, "", newAPIError(&response, resp)
 	}
 
+	response.RequestID = responseRequestID(resp)
 	return &response, etag, nil
 }
 
+// responseRequestID returns the ID of the request answered by resp. Services
+// not returning it are assumed to have taken the one sent
+func responseRequestID(resp *http.Response) string {
+	id := resp.Header.Get(api.RequestIDHeader)
+	if len(id) == 0 && resp.Request != nil {
+		id = resp.Request.Header.Get(api.RequestIDHeader)
+	}
+	return id
+}
+
 // APIPath prefixes API version to a path
 func APIPath(path ...string) string {
 	p := append([]string{"/", api.Version}, path...)
@@ -20,8 +20,12 @@
 package client
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -35,18 +39,36 @@ type MockClient struct {
 	Operation     *MockOperation
 	EventListener *EventListener
 	ETag          string
+	Extensions    []string
+
+	// Response to raw requests
+	RawHeader http.Header
+	RawBody   string
 }
 
 // SetTransportTimeout mocked
 func (c *MockClient) SetTransportTimeout(timeout time.Duration) {
 }
 
+// SetMaxRetries mocked
+func (c *MockClient) SetMaxRetries(retries int) {
+}
+
+// SetToken mocked
+func (c *MockClient) SetToken(token string) {
+}
+
 // QueryStruct mocked
 func (c *MockClient) QueryStruct(method, path string, params QueryParams, header http.Header, body io.Reader, ETag string, target interface{}) (string, error) {
 	err := c.Response.MetadataAsStruct(&target)
 	return c.ETag, err
 }
 
+// QueryStructContext mocked
+func (c *MockClient) QueryStructContext(ctx context.Context, method, path string, params QueryParams, header http.Header, body io.Reader, ETag string, target interface{}) (string, error) {
+	return c.QueryStruct(method, path, params, header, body, ETag, target)
+}
+
 // QueryOperation mocked
 func (c *MockClient) QueryOperation(method, path string, params QueryParams, header http.Header, body io.Reader, ETag string) (op Operation, etag string, err error) {
 	return c.Operation, c.ETag, nil
@@ -57,11 +79,47 @@ func (c *MockClient) CallAPI(method, path string, params QueryParams, header htt
 	return c.Response, c.ETag, nil
 }
 
+// CallAPIContext mocked
+func (c *MockClient) CallAPIContext(ctx context.Context, method, path string, params QueryParams, header http.Header, body io.Reader, ETag string) (response *api.Response, etag string, err error) {
+	return c.CallAPI(method, path, params, header, body, ETag)
+}
+
+// CallRaw mocked
+func (c *MockClient) CallRaw(ctx context.Context, method, path string, params QueryParams, header http.Header) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     c.RawHeader,
+		Body:       ioutil.NopCloser(strings.NewReader(c.RawBody)),
+	}, nil
+}
+
 // Websocket mocked
 func (c *MockClient) Websocket(resource string) (conn *websocket.Conn, err error) {
 	return &websocket.Conn{}, nil
 }
 
+// GetServer mocked
+func (c *MockClient) GetServer() (server *api.Server, etag string, err error) {
+	server = &api.Server{}
+	err = c.Response.MetadataAsStruct(server)
+	return server, c.ETag, err
+}
+
+// HasExtension mocked
+func (c *MockClient) HasExtension(extension string) bool {
+	return c.RequireExtension(extension) == nil
+}
+
+// RequireExtension mocked
+func (c *MockClient) RequireExtension(extension string) error {
+	for _, e := range c.Extensions {
+		if e == extension {
+			return nil
+		}
+	}
+	return fmt.Errorf("The server is missing the required %q API extension", extension)
+}
+
 // GetEvents mocked
 func (c *MockClient) GetEvents() (eventListener *EventListener, err error) {
 	return c.EventListener, nil
@@ -20,14 +20,18 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	check "gopkg.in/check.v1"
 
@@ -47,7 +51,9 @@ type clientSuite struct {
 	err               error
 	doCalls           int
 	header            http.Header
+	headers           []http.Header
 	status            int
+	statuses          []int
 }
 
 var _ = check.Suite(&clientSuite{})
@@ -69,7 +75,9 @@ func (cs *clientSuite) SetUpTest(c *check.C) {
 	cs.rsps = nil
 	cs.req = nil
 	cs.header = nil
+	cs.headers = nil
 	cs.status = 200
+	cs.statuses = nil
 	cs.doCalls = 0
 }
 
@@ -80,10 +88,19 @@ func (cs *clientSuite) Do(req *http.Request) (*http.Response, error) {
 	if cs.doCalls < len(cs.rsps) {
 		body = cs.rsps[cs.doCalls]
 	}
+	header := cs.header
+	if cs.doCalls < len(cs.headers) {
+		header = cs.headers[cs.doCalls]
+	}
+	status := cs.status
+	if cs.doCalls < len(cs.statuses) {
+		status = cs.statuses[cs.doCalls]
+	}
 	rsp := &http.Response{
 		Body:       ioutil.NopCloser(strings.NewReader(body)),
-		Header:     cs.header,
-		StatusCode: cs.status,
+		Header:     header,
+		StatusCode: status,
+		Request:    req,
 	}
 	cs.doCalls++
 	return rsp, cs.err
@@ -129,6 +146,116 @@ func (cs *clientSuite) TestPassedBackServiceError(c *check.C) {
 	c.Assert(resp.Error, check.Equals, "Service error")
 }
 
+func (cs *clientSuite) TestRetryWhenServiceUnavailable(c *check.C) {
+	cs.rsps = []string{
+		`{"type": "error", "error_code": 503, "error": "Jobs queue is full"}`,
+		`{"type": "sync", "metadata": "done"}`,
+	}
+	cs.statuses = []int{503, 200}
+	cs.headers = []http.Header{{"Retry-After": []string{"0"}}}
+
+	header := http.Header{}
+	header.Set(api.IdempotencyKeyHeader, "abc")
+	resp, _, err := cs.cli.CallAPI("POST", "/the/path", nil, header, strings.NewReader(`{"foo": "bar"}`), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(cs.doCalls, check.Equals, 2)
+	c.Assert(string(resp.Metadata), check.Equals, `"done"`)
+
+	// The body is sent again in the retried request
+	b, err := ioutil.ReadAll(cs.reqs[1].Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(b), check.Equals, `{"foo": "bar"}`)
+
+	// with the same idempotency key
+	c.Assert(cs.reqs[0].Header.Get(api.IdempotencyKeyHeader), check.Equals, "abc")
+	c.Assert(cs.reqs[1].Header.Get(api.IdempotencyKeyHeader), check.Equals, "abc")
+}
+
+func (cs *clientSuite) TestNoRetryWhenNotIdempotent(c *check.C) {
+	cs.rsps = []string{
+		`{"type": "error", "error_code": 503, "error": "Jobs queue is full"}`,
+		`{"type": "sync", "metadata": "done"}`,
+	}
+	cs.statuses = []int{503, 200}
+	cs.headers = []http.Header{{"Retry-After": []string{"0"}}}
+
+	// Other methods than the safe ones could have side effects, unless
+	// the caller gives an idempotency key
+	_, _, err := cs.cli.CallAPI("POST", "/the/path", nil, nil, strings.NewReader(`{"foo": "bar"}`), "")
+	c.Assert(err, check.ErrorMatches, "Jobs queue is full")
+	c.Assert(cs.doCalls, check.Equals, 1)
+	c.Assert(cs.reqs[0].Header.Get(api.IdempotencyKeyHeader), check.Equals, "")
+}
+
+func (cs *clientSuite) TestRequestID(c *check.C) {
+	cs.rsps = []string{
+		`{"type": "error", "error_code": 503, "error": "Jobs queue is full"}`,
+		`{"type": "sync", "metadata": "done"}`,
+	}
+	cs.statuses = []int{503, 200}
+	cs.headers = []http.Header{{"Retry-After": []string{"0"}}}
+
+	// A request ID is generated and kept between attempts
+	resp, _, err := cs.cli.CallAPI("GET", "/the/path", nil, nil, nil, "")
+	c.Assert(err, check.IsNil)
+	id := cs.reqs[0].Header.Get(api.RequestIDHeader)
+	c.Assert(id, check.Not(check.Equals), "")
+	c.Assert(cs.reqs[1].Header.Get(api.RequestIDHeader), check.Equals, id)
+	c.Assert(resp.RequestID, check.Equals, id)
+
+	// Idempotency keys are only sent when given
+	c.Assert(cs.reqs[0].Header.Get(api.IdempotencyKeyHeader), check.Equals, "")
+
+	// The one given by the caller is sent otherwise
+	cs.rsps = nil
+	cs.rsp = `{"type": "sync", "metadata": "done"}`
+	cs.status = 200
+	header := http.Header{}
+	header.Set(api.RequestIDHeader, "abc")
+	resp, _, err = cs.cli.CallAPI("GET", "/the/path", nil, header, nil, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(cs.req.Header.Get(api.RequestIDHeader), check.Equals, "abc")
+	c.Assert(resp.RequestID, check.Equals, "abc")
+}
+
+func (cs *clientSuite) TestRequestTimeout(c *check.C) {
+	var timeout string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout = r.Header.Get(api.RequestTimeoutHeader)
+		w.Write([]byte(`{"type": "sync", "metadata": "done"}`))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	c.Assert(err, check.IsNil)
+	cli, err := New(u, nil)
+	c.Assert(err, check.IsNil)
+
+	// The service is told how long the client waits
+	cli.SetTransportTimeout(1500 * time.Millisecond)
+	_, _, err = cli.CallAPI("GET", "/the/path", nil, nil, nil, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(timeout, check.Equals, "1.5")
+
+	// Unless the caller sets it
+	header := http.Header{}
+	header.Set(api.RequestTimeoutHeader, "0.5")
+	_, _, err = cli.CallAPI("GET", "/the/path", nil, header, nil, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(timeout, check.Equals, "0.5")
+}
+
+func (cs *clientSuite) TestNoRetryWhenDisabled(c *check.C) {
+	cs.rsp = `{"type": "error", "error_code": 503, "error": "Jobs queue is full"}`
+	cs.status = 503
+	cs.header = http.Header{"Retry-After": []string{"0"}}
+
+	cs.cli.SetMaxRetries(0)
+	_, _, err := cs.cli.CallAPI("POST", "/the/path", nil, nil, nil, "")
+	c.Assert(err, check.ErrorMatches, "Jobs queue is full")
+	c.Assert(cs.doCalls, check.Equals, 1)
+}
+
 func (cs *clientSuite) TestResponseMetadataAsStruct(c *check.C) {
 	type Metadata struct {
 		Name1      string `json:"name1"`
@@ -280,7 +407,267 @@ func (cs *clientSuite) TestResponseMetadataAsStringSlice(c *check.C) {
 	c.Assert(arr[2], check.Equals, "foo3")
 }
 
+func (cs *clientSuite) TestGetServer(c *check.C) {
+	cs.rsp = `{"type": "sync", "metadata": {"framework_version": "0.1.0", "api_version": "1.0", "api_versions": ["1.0"], "endpoints": ["unix"]}}`
+	cs.header = http.Header{"Etag": []string{"abc"}}
+
+	server, etag, err := cs.cli.GetServer()
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.Method, check.Equals, "GET")
+	c.Check(cs.req.URL.Path, check.Equals, "/1.0")
+	c.Assert(etag, check.Equals, "abc")
+	c.Assert(server.APIVersion, check.Equals, "1.0")
+	c.Assert(server.APIVersions, check.DeepEquals, []string{"1.0"})
+	c.Assert(server.Endpoints, check.DeepEquals, []string{"unix"})
+}
+
+func (cs *clientSuite) TestExtensions(c *check.C) {
+	cs.rsp = `{"type": "sync", "metadata": {"api_extensions": ["foo", "bar"]}}`
+
+	c.Assert(cs.cli.HasExtension("foo"), check.Equals, true)
+	c.Assert(cs.cli.HasExtension("other"), check.Equals, false)
+	c.Assert(cs.cli.RequireExtension("bar"), check.IsNil)
+	c.Assert(cs.cli.RequireExtension("other"), check.ErrorMatches, `The server is missing the required "other" API extension`)
+
+	// Server extensions are only requested once
+	c.Assert(cs.doCalls, check.Equals, 1)
+}
+
 func (cs *clientSuite) TestAPIPath(c *check.C) {
 	str := APIPath("a", "path")
 	c.Assert(str, check.Equals, fmt.Sprintf("/%s/%s/%s", api.Version, "a", "path"))
 }
+
+func (cs *clientSuite) TestListPages(c *check.C) {
+	cs.rsps = []string{
+		`{"type": "sync", "next": "abc", "metadata": ["a", "b"]}`,
+		`{"type": "sync", "metadata": ["c"]}`,
+	}
+
+	items := []string{}
+	pages := ListPages(cs.cli, "/1.0/things", QueryParams{"limit": "2"})
+	for {
+		page := []string{}
+		if !pages.Next(&page) {
+			break
+		}
+		items = append(items, page...)
+	}
+	c.Assert(pages.Err(), check.IsNil)
+	c.Assert(items, check.DeepEquals, []string{"a", "b", "c"})
+
+	c.Assert(cs.reqs, check.HasLen, 2)
+	c.Assert(cs.reqs[0].URL.Query().Get("cursor"), check.Equals, "")
+	c.Assert(cs.reqs[1].URL.Query().Get("cursor"), check.Equals, "abc")
+	c.Assert(cs.reqs[1].URL.Query().Get("limit"), check.Equals, "2")
+}
+
+func (cs *clientSuite) TestListPagesError(c *check.C) {
+	cs.rsps = []string{
+		`{"type": "sync", "next": "abc", "metadata": ["a", "b"]}`,
+		`{"type": "error", "error_code": 400, "error": "Invalid request: cursor is not valid"}`,
+	}
+
+	pages := ListPages(cs.cli, "/1.0/things", nil)
+	page := []string{}
+	c.Assert(pages.Next(&page), check.Equals, true)
+	c.Assert(pages.Next(&page), check.Equals, false)
+	c.Assert(pages.Err(), check.ErrorMatches, "Invalid request: cursor is not valid")
+	c.Assert(pages.Next(&page), check.Equals, false)
+}
+
+func (cs *clientSuite) TestAPIError(c *check.C) {
+	cs.rsp = `{"type": "error", "error_code": 400, "error": "Invalid request: name is required",
+		"metadata": {"code": "invalid_request", "fields": [{"field": "name", "message": "is required"}], "request_id": "abc"}}`
+	cs.status = 400
+
+	_, _, err := cs.cli.CallAPI("POST", "/the/path", nil, nil, nil, "")
+	apiErr, ok := err.(*APIError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(apiErr.StatusCode, check.Equals, 400)
+	c.Assert(apiErr.Code, check.Equals, "invalid_request")
+	c.Assert(apiErr.Error(), check.Equals, "Invalid request: name is required")
+	c.Assert(apiErr.Fields, check.DeepEquals, []api.FieldError{{Field: "name", Message: "is required"}})
+	c.Assert(apiErr.RequestID, check.Equals, "abc")
+}
+
+func (cs *clientSuite) TestErrorHelpers(c *check.C) {
+	cs.rsp = `{"type": "error", "error_code": 404, "error": "Thing not found", "metadata": {"code": "not_found"}}`
+	cs.status = 404
+	cs.header = http.Header{"X-Request-Id": []string{"abc"}}
+
+	_, _, err := cs.cli.CallAPI("GET", "/the/path", nil, nil, nil, "")
+	c.Assert(IsNotFound(err), check.Equals, true)
+	c.Assert(IsNotFound(fmt.Errorf("Cannot load thing: %w", err)), check.Equals, true)
+	c.Assert(IsConflict(err), check.Equals, false)
+	c.Assert(IsPreconditionFailed(err), check.Equals, false)
+	c.Assert(err.(*APIError).RequestID, check.Equals, "abc")
+
+	c.Assert(IsNotFound(errors.New("Thing not found")), check.Equals, false)
+	c.Assert(IsNotFound(nil), check.Equals, false)
+}
+
+func (cs *clientSuite) TestErrorNotJSON(c *check.C) {
+	cs.rsp = `Bad gateway`
+	cs.status = 502
+	cs.cli.SetMaxRetries(0)
+
+	_, err := cs.cli.QueryStruct("GET", "/the/path", nil, nil, nil, "", nil)
+	c.Assert(IsStatus(err, 502), check.Equals, true)
+}
+
+func (cs *clientSuite) TestWaitForOperation(c *check.C) {
+	ops := UpgradeToOperationsClient(cs.cli)
+
+	// Long waits are split in several requests
+	cs.rsps = []string{
+		`{"type": "error", "error_code": 504, "error": "Timeout waiting for operations"}`,
+		`{"type": "sync", "metadata": {"id": "abc", "status_code": 103}}`,
+	}
+	cs.statuses = []int{504, 200}
+	op, err := ops.WaitForOperation(context.Background(), "abc", &WaitOptions{Statuses: []api.StatusCode{api.Running}})
+	c.Assert(err, check.IsNil)
+	c.Assert(op.StatusCode, check.Equals, api.Running)
+	c.Assert(cs.reqs, check.HasLen, 2)
+	c.Assert(cs.reqs[1].URL.Path, check.Equals, "/1.0/operations/abc/wait")
+	c.Assert(cs.reqs[1].URL.Query().Get("timeout"), check.Equals, "10s")
+	c.Assert(cs.reqs[1].URL.Query().Get("status"), check.Equals, "Running")
+
+	// Up to the given timeout
+	cs.reqs = nil
+	cs.rsps = nil
+	cs.rsp = `{"type": "error", "error_code": 504, "error": "Timeout waiting for operations"}`
+	cs.status = 504
+	_, err = ops.WaitForOperationToFinish("abc", 2*time.Second)
+	c.Assert(IsTimeout(err), check.Equals, true)
+	c.Assert(cs.reqs, check.HasLen, 1)
+	timeout, err := time.ParseDuration(cs.req.URL.Query().Get("timeout"))
+	c.Assert(err, check.IsNil)
+	c.Assert(timeout > time.Second && timeout <= 2*time.Second, check.Equals, true)
+}
+
+func (cs *clientSuite) TestWaitForOperationTimeout(c *check.C) {
+	// The service answers a bit after the requested timeout elapses
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, _ := time.ParseDuration(r.URL.Query().Get("timeout"))
+		time.Sleep(timeout + 50*time.Millisecond)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte(`{"type": "error", "error_code": 504, "error": "Timeout waiting for operations"}`))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	c.Assert(err, check.IsNil)
+	cli, err := New(u, nil)
+	c.Assert(err, check.IsNil)
+	ops := UpgradeToOperationsClient(cli)
+
+	_, err = ops.WaitForOperation(context.Background(), "abc", &WaitOptions{Timeout: 100 * time.Millisecond})
+	c.Assert(IsTimeout(err), check.Equals, true, check.Commentf("%v", err))
+
+	// The deadline of the context is a timeout as well
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = ops.WaitForOperation(ctx, "abc", nil)
+	c.Assert(IsTimeout(err), check.Equals, true, check.Commentf("%v", err))
+}
+
+func (cs *clientSuite) TestWaitForOperations(c *check.C) {
+	cs.rsp = `{"type": "sync", "metadata": [{"id": "a", "status_code": 200}, {"id": "b", "status_code": 103}]}`
+	cs.status = 200
+
+	ops, err := UpgradeToOperationsClient(cs.cli).WaitForOperations(context.Background(), []string{"a", "b"}, &WaitOptions{Any: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(ops, check.HasLen, 2)
+	c.Assert(ops[0].ID, check.Equals, "a")
+	c.Assert(cs.req.URL.Path, check.Equals, "/1.0/operations/wait")
+	c.Assert(cs.req.URL.Query().Get("id"), check.Equals, "a,b")
+	c.Assert(cs.req.URL.Query().Get("mode"), check.Equals, "any")
+
+	// Waits are given up with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cs.cli.Doer = &http.Client{}
+	_, err = UpgradeToOperationsClient(cs.cli).WaitForOperations(ctx, []string{"a"}, nil)
+	c.Assert(errors.Is(err, context.Canceled), check.Equals, true)
+}
+
+func (cs *clientSuite) TestListOperationsFilter(c *check.C) {
+	cs.rsp = `{"type": "sync", "metadata": {
+		"success": [{"id": "b", "created_at": "2026-01-01T10:00:02Z"}],
+		"running": [{"id": "a", "created_at": "2026-01-01T10:00:01Z"}, {"id": "c", "created_at": "2026-01-01T10:00:03Z"}]}}`
+	cs.status = 200
+
+	after := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	ops, err := UpgradeToOperationsClient(cs.cli).ListOperationsFiltered(&OperationsFilter{
+		Statuses:     []api.StatusCode{api.Running, api.Success},
+		Resource:     "/1.0/things/abc",
+		Description:  "creating",
+		CreatedAfter: after,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(ops, check.HasLen, 3)
+	c.Assert([]string{ops[0].ID, ops[1].ID, ops[2].ID}, check.DeepEquals, []string{"a", "b", "c"})
+
+	query := cs.req.URL.Query()
+	c.Assert(query.Get("status"), check.Equals, "Running,Success")
+	c.Assert(query.Get("resource"), check.Equals, "/1.0/things/abc")
+	c.Assert(query.Get("description"), check.Equals, "creating")
+	c.Assert(query.Get("created_after"), check.Equals, "2026-01-01T10:00:00Z")
+	c.Assert(query.Get("created_before"), check.Equals, "")
+}
+
+func (cs *clientSuite) TestTailOperationLogs(c *check.C) {
+	ops := UpgradeToOperationsClient(cs.cli)
+
+	// Streams cut before the operation is done are resumed
+	cs.rsps = []string{"first\n", "second\n"}
+	cs.statuses = []int{200, 200}
+	cs.headers = []http.Header{
+		{api.LogOffsetHeader: []string{"0"}},
+		{api.LogOffsetHeader: []string{"6"}, api.LogCompleteHeader: []string{"true"}},
+	}
+	out := &bytes.Buffer{}
+	err := ops.TailOperationLogs(context.Background(), "abc", out, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(out.String(), check.Equals, "first\nsecond\n")
+	c.Assert(cs.reqs, check.HasLen, 2)
+	c.Assert(cs.reqs[0].URL.Path, check.Equals, "/1.0/operations/abc/logs")
+	c.Assert(cs.reqs[0].URL.Query().Get("follow"), check.Equals, "true")
+	c.Assert(cs.reqs[1].URL.Query().Get("offset"), check.Equals, "6")
+
+	// Output discarded before being read is reported
+	cs.reqs = nil
+	cs.doCalls = 0
+	cs.rsps = []string{"first\n", "fourth\n"}
+	cs.headers = []http.Header{
+		{api.LogOffsetHeader: []string{"0"}},
+		{api.LogOffsetHeader: []string{"20"}, api.LogCompleteHeader: []string{"true"}},
+	}
+	out.Reset()
+	err = ops.TailOperationLogs(context.Background(), "abc", out, true)
+	c.Assert(err, check.DeepEquals, &LogTruncatedError{Skipped: 14})
+	c.Assert(out.String(), check.Equals, "first\nfourth\n")
+	c.Assert(cs.reqs[1].URL.Query().Get("offset"), check.Equals, "6")
+
+	cs.rsps = nil
+	cs.statuses = nil
+	cs.headers = nil
+	cs.rsp = `{"type": "error", "error_code": 404, "error": "Operation not found"}`
+	cs.status = 404
+	err = ops.TailOperationLogs(context.Background(), "abc", out, false)
+	c.Assert(err, check.ErrorMatches, "Operation not found")
+}
+
+func (cs *clientSuite) TestToken(c *check.C) {
+	cs.rsp = `{"type": "sync", "metadata": "done"}`
+	cs.cli.SetToken("secret")
+	_, _, err := cs.cli.CallAPI("GET", "/the/path", nil, nil, nil, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(cs.req.Header.Get("Authorization"), check.Equals, "Bearer secret")
+
+	cs.cli.SetToken("")
+	_, _, err = cs.cli.CallAPI("GET", "/the/path", nil, nil, nil, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(cs.req.Header.Get("Authorization"), check.Equals, "")
+}
@@ -0,0 +1,73 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package client
+
+// PageIterator walks transparently the pages of a collection, following
+// the cursor of the next page returned by the server
+type PageIterator struct {
+	c      Client
+	path   string
+	params QueryParams
+	next   string
+	done   bool
+	err    error
+}
+
+// ListPages returns an iterator over the pages of the collection at path.
+// Params can include the page limit, sort keys and filter expression
+func ListPages(c Client, path string, params QueryParams) *PageIterator {
+	p := QueryParams{}
+	for k, v := range params {
+		p[k] = v
+	}
+	return &PageIterator{c: c, path: path, params: p}
+}
+
+// Next requests the next page and stores its metadata in target. False is
+// returned when there are no more pages or the request failed, which can
+// be checked with Err
+func (it *PageIterator) Next(target interface{}) bool {
+	if it.done {
+		return false
+	}
+
+	if len(it.next) > 0 {
+		it.params["cursor"] = it.next
+	}
+
+	resp, _, err := it.c.CallAPI("GET", it.path, it.params, nil, nil, "")
+	if err == nil {
+		err = resp.MetadataAsStruct(target)
+	}
+	if err != nil {
+		it.err = err
+		it.done = true
+		return false
+	}
+
+	it.next = resp.Next
+	it.done = len(it.next) == 0
+	return true
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *PageIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/greenbrew/rest/api"
+)
+
+// APIError is returned when the service answers a request with an error
+type APIError struct {
+	// HTTP status of the response
+	StatusCode int
+	Message    string
+	api.ErrorDetails
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// newAPIError returns the error described by an error response. The request
+// ID is taken from the HTTP response if not included in the error details
+func newAPIError(resp *api.Response, httpResp *http.Response) *APIError {
+	err := &APIError{StatusCode: resp.Code, Message: resp.Error}
+
+	// Services not describing errors in detail only give the status
+	if len(resp.Metadata) > 0 {
+		json.Unmarshal(resp.Metadata, &err.ErrorDetails)
+	}
+
+	if len(err.RequestID) == 0 && httpResp != nil {
+		err.RequestID = responseRequestID(httpResp)
+	}
+	return err
+}
+
+// OperationError is returned when waiting for an operation that failed or
+// was cancelled in the service
+type OperationError struct {
+	Operation api.Operation
+}
+
+func (e *OperationError) Error() string {
+	if len(e.Operation.Err) > 0 {
+		return e.Operation.Err
+	}
+	return e.Operation.Status
+}
+
+// LogTruncatedError is returned once the output of an operation is written
+// if part of it was discarded by the service before it could be read
+type LogTruncatedError struct {
+	// Bytes of output missed
+	Skipped int64
+}
+
+func (e *LogTruncatedError) Error() string {
+	return fmt.Sprintf("%d bytes of operation output were discarded", e.Skipped)
+}
+
+// IsStatus returns whether err is, or wraps, an error response of the service
+// with the given HTTP status
+func IsStatus(err error, status int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+// IsNotFound returns whether err is a not found error response
+func IsNotFound(err error) bool {
+	return IsStatus(err, http.StatusNotFound)
+}
+
+// IsConflict returns whether err is a conflict error response
+func IsConflict(err error) bool {
+	return IsStatus(err, http.StatusConflict)
+}
+
+// IsPreconditionFailed returns whether err is a precondition failed error response
+func IsPreconditionFailed(err error) bool {
+	return IsStatus(err, http.StatusPreconditionFailed)
+}
+
+// IsForbidden returns whether err is a forbidden error response
+func IsForbidden(err error) bool {
+	return IsStatus(err, http.StatusForbidden)
+}
+
+// IsTimeout returns whether err is an error response of the service for
+// a request not attended in time
+func IsTimeout(err error) bool {
+	return IsStatus(err, http.StatusGatewayTimeout)
+}
+
+// IsUnauthorized returns whether err is an unauthorized error response
+func IsUnauthorized(err error) bool {
+	return IsStatus(err, http.StatusUnauthorized)
+}
@@ -40,6 +40,7 @@ type Operation interface {
 	Get() (op api.Operation)
 	RemoveHandler(target Target) (err error)
 	Refresh() (err error)
+	Result(target interface{}) (err error)
 	Wait(ctx context.Context) (err error)
 }
 
@@ -47,21 +48,35 @@ type Operation interface {
 type Operations interface {
 	ListOperationUUIDs() (uuids []string, err error)
 	ListOperations() (operations []api.Operation, err error)
+	ListOperationsFiltered(filter *OperationsFilter) (operations []api.Operation, err error)
 	RetrieveOperationByID(uuid string) (op *api.Operation, etag string, err error)
 	WaitForOperationToFinish(uuid string, timeout time.Duration) (op *api.Operation, err error)
+	WaitForOperation(ctx context.Context, uuid string, opts *WaitOptions) (op *api.Operation, err error)
+	WaitForOperations(ctx context.Context, uuids []string, opts *WaitOptions) (ops []api.Operation, err error)
+	TailOperationLogs(ctx context.Context, uuid string, w io.Writer, follow bool) (err error)
 	DeleteOperation(uuid string) (err error)
 }
 
 // The Client interface represents all available REST client operations
 type Client interface {
 	SetTransportTimeout(timeout time.Duration)
+	SetMaxRetries(retries int)
+	SetToken(token string)
 
 	QueryStruct(method, path string, params QueryParams, header http.Header, body io.Reader, ETag string, target interface{}) (etag string, err error)
+	QueryStructContext(ctx context.Context, method, path string, params QueryParams, header http.Header, body io.Reader, ETag string, target interface{}) (etag string, err error)
 	QueryOperation(method, path string, params QueryParams, header http.Header, body io.Reader, ETag string) (operation Operation, etag string, err error)
 	CallAPI(method, path string, params QueryParams, header http.Header, body io.Reader, ETag string) (response *api.Response, etag string, err error)
+	CallAPIContext(ctx context.Context, method, path string, params QueryParams, header http.Header, body io.Reader, ETag string) (response *api.Response, etag string, err error)
+	CallRaw(ctx context.Context, method, path string, params QueryParams, header http.Header) (response *http.Response, err error)
 
 	Websocket(resource string) (conn *websocket.Conn, err error)
 
+	// Server information functions
+	GetServer() (server *api.Server, etag string, err error)
+	HasExtension(extension string) (supported bool)
+	RequireExtension(extension string) (err error)
+
 	// Event handling functions
 	GetEvents() (listener *EventListener, err error)
 }
@@ -36,6 +36,7 @@ type operation struct {
 
 	c            *operations
 	listener     *EventListener
+	listenerErr  error
 	handlerReady bool
 	mux          sync.Mutex
 	doneCh       chan bool
@@ -114,6 +115,15 @@ func (op *operation) Refresh() error {
 	return nil
 }
 
+// Result parses the value computed by the operation into target. The reason
+// why the operation did not succeed is returned instead if that is the case
+func (op *operation) Result(target interface{}) error {
+	if err := op.theError(); err != nil {
+		return err
+	}
+	return op.Operation.ResultAsStruct(target)
+}
+
 // Wait lets you wait until the operation reaches a final state
 func (op *operation) Wait(ctx context.Context) error {
 	// Check if not done already
@@ -146,9 +156,14 @@ func (op *operation) Wait(ctx context.Context) error {
 	return op.theError()
 }
 
+// theError returns the reason why the operation could not be completed, as
+// an *OperationError if it failed in the service
 func (op *operation) theError() error {
-	if len(op.Err) > 0 {
-		return errors.New(op.Err)
+	if op.listenerErr != nil {
+		return op.listenerErr
+	}
+	if len(op.Err) > 0 || op.StatusCode == api.Failure || op.StatusCode == api.Cancelled {
+		return &OperationError{Operation: op.Operation}
 	}
 	return nil
 }
@@ -225,6 +240,10 @@ func (op *operation) setupListener() error {
 			op.mux.Lock()
 			if op.listener != nil {
 				op.Err = fmt.Sprintf("%v", op.listener.err)
+				op.listenerErr = op.listener.err
+				if op.listenerErr == nil {
+					op.listenerErr = errors.New("Events listener disconnected")
+				}
 				close(op.doneCh)
 			}
 			op.mux.Unlock()
@@ -244,11 +263,7 @@ func (op *operation) setupListener() error {
 	// Check if not done already
 	if op.StatusCode.IsFinal() {
 		op.done()
-
-		if len(op.Err) > 0 {
-			return errors.New(op.Err)
-		}
-		return nil
+		return op.theError()
 	}
 
 	// Start processing background updates
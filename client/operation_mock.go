@@ -76,6 +76,11 @@ func (op *MockOperation) RemoveHandler(target Target) error {
 	return errors.New("Target not found")
 }
 
+// Result mocked
+func (op *MockOperation) Result(target interface{}) error {
+	return op.Operation.ResultAsStruct(target)
+}
+
 // Refresh mocked
 func (op *MockOperation) Refresh() error {
 	return nil
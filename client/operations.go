@@ -20,12 +20,23 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/greenbrew/rest/api"
 )
 
+// Number of operations requested per page when listing them
+const operationsPageSize = 100
+
 type operations struct {
 	Client
 }
@@ -43,25 +54,80 @@ func (c *operations) ListOperationUUIDs() ([]string, error) {
 	return urls, err
 }
 
-// ListOperations returns a list of Operation struct
+// OperationsFilter selects the operations to list. Zero fields do not filter
+type OperationsFilter struct {
+	Statuses []api.StatusCode
+	// URL of a resource the operations affect
+	Resource string
+	// Part of the description of the operations, case insensitive
+	Description   string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// addParams adds the query parameters requesting the filter to params
+func (f *OperationsFilter) addParams(params QueryParams) {
+	if len(f.Statuses) > 0 {
+		names := []string{}
+		for _, status := range f.Statuses {
+			names = append(names, status.String())
+		}
+		params["status"] = strings.Join(names, ",")
+	}
+	if len(f.Resource) > 0 {
+		params["resource"] = f.Resource
+	}
+	if len(f.Description) > 0 {
+		params["description"] = f.Description
+	}
+	if !f.CreatedAfter.IsZero() {
+		params["created_after"] = f.CreatedAfter.Format(time.RFC3339Nano)
+	}
+	if !f.CreatedBefore.IsZero() {
+		params["created_before"] = f.CreatedBefore.Format(time.RFC3339Nano)
+	}
+}
+
+// ListOperations returns all the operations, sorted by creation time
 func (c *operations) ListOperations() ([]api.Operation, error) {
-	apiOps := map[string][]api.Operation{}
+	return c.ListOperationsFiltered(nil)
+}
 
+// ListOperationsFiltered returns the operations selected by the filter, all
+// of them if nil, sorted by creation time
+func (c *operations) ListOperationsFiltered(filter *OperationsFilter) ([]api.Operation, error) {
 	params := QueryParams{
 		"recursion": "1",
+		"limit":     strconv.Itoa(operationsPageSize),
+	}
+	if filter != nil {
+		filter.addParams(params)
 	}
-	resource := APIPath("operations")
-	_, err := c.QueryStruct("GET", resource, params, nil, nil, "", &apiOps)
 
-	// Turn it into just a list of operations
+	// Turn every page into just a list of operations
 	ops := []api.Operation{}
-	for _, v := range apiOps {
-		for _, op := range v {
-			ops = append(ops, op)
+	pages := ListPages(c, APIPath("operations"), params)
+	for {
+		apiOps := map[string][]api.Operation{}
+		if !pages.Next(&apiOps) {
+			break
+		}
+
+		// Pages group operations by status, so they are sorted again
+		page := []api.Operation{}
+		for _, v := range apiOps {
+			page = append(page, v...)
 		}
+		sort.SliceStable(page, func(i, j int) bool {
+			if page[i].CreatedAt.Equal(page[j].CreatedAt) {
+				return page[i].ID < page[j].ID
+			}
+			return page[i].CreatedAt.Before(page[j].CreatedAt)
+		})
+		ops = append(ops, page...)
 	}
 
-	return ops, err
+	return ops, pages.Err()
 }
 
 // RetrieveOperationByID returns a websocket connection for the provided operation id
@@ -72,19 +138,169 @@ func (c *operations) RetrieveOperationByID(uuid string) (*api.Operation, string,
 	return op, etag, err
 }
 
+// Longest wait asked to the service in a single request, for waits not to be
+// cut by the transport timeout
+const operationWaitSlice = 10 * time.Second
+
+// Time every wait request is given over the wait asked to the service, for
+// its answer to arrive
+const operationWaitGrace = 5 * time.Second
+
+// waitTimeoutError returns the error given once the time to wait elapses in
+// the client, as the one of the service
+func waitTimeoutError() error {
+	return &APIError{
+		StatusCode:   http.StatusGatewayTimeout,
+		Message:      "Timeout waiting for operations",
+		ErrorDetails: api.ErrorDetails{Code: "wait_timeout"},
+	}
+}
+
+// WaitOptions tune the waits for operations
+type WaitOptions struct {
+	// Time to wait. Forever, or until the context is done, if zero
+	Timeout time.Duration
+	// Statuses to wait for. The operations being done if empty
+	Statuses []api.StatusCode
+	// Whether waiting for multiple operations ends once any of them is
+	// done, instead of all them
+	Any bool
+}
+
 // WaitForOperationToFinish blocks until operation is finished or timeout
 func (c *operations) WaitForOperationToFinish(uuid string, timeout time.Duration) (*api.Operation, error) {
+	return c.WaitForOperation(context.Background(), uuid, &WaitOptions{Timeout: timeout})
+}
+
+// WaitForOperation blocks until the operation reaches any of the statuses
+// of opts or is done. Once the timeout elapses an error is returned for
+// which IsTimeout is true
+func (c *operations) WaitForOperation(ctx context.Context, uuid string, opts *WaitOptions) (*api.Operation, error) {
 	op := &api.Operation{}
 	resource := APIPath("operations", url.QueryEscape(uuid), "wait")
-	var params QueryParams
-	if timeout > 0 {
-		params := make(map[string]string)
-		params["timeout"] = timeout.String()
-	}
-	_, err := c.QueryStruct("GET", resource, params, nil, nil, "", op)
+	err := c.wait(ctx, resource, QueryParams{}, opts, op)
 	return op, err
 }
 
+// WaitForOperations blocks until all the operations, or any of them if set
+// in opts, reach any of its statuses or are done. Operations are returned
+// in the same order
+func (c *operations) WaitForOperations(ctx context.Context, uuids []string, opts *WaitOptions) ([]api.Operation, error) {
+	params := QueryParams{"id": strings.Join(uuids, ",")}
+	if opts != nil && opts.Any {
+		params["mode"] = "any"
+	}
+
+	ops := []api.Operation{}
+	err := c.wait(ctx, APIPath("operations", "wait"), params, opts, &ops)
+	return ops, err
+}
+
+// wait requests the wait endpoint at path as many times as needed to wait
+// for the timeout of opts, or until the deadline of ctx, with no request
+// longer than operationWaitSlice. Once the time to wait elapses a timeout
+// error is returned
+func (c *operations) wait(ctx context.Context, path string, params QueryParams, opts *WaitOptions, target interface{}) error {
+	if opts == nil {
+		opts = &WaitOptions{}
+	}
+
+	var deadline time.Time
+	if opts.Timeout > 0 {
+		deadline = time.Now().Add(opts.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	if len(opts.Statuses) > 0 {
+		names := []string{}
+		for _, status := range opts.Statuses {
+			names = append(names, status.String())
+		}
+		params["status"] = strings.Join(names, ",")
+	}
+
+	for {
+		slice := operationWaitSlice
+		if !deadline.IsZero() && time.Until(deadline) < slice {
+			slice = time.Until(deadline)
+		}
+		if slice < 0 {
+			slice = 0
+		}
+		params["timeout"] = slice.String()
+
+		reqCtx, cancel := context.WithTimeout(ctx, slice+operationWaitGrace)
+		_, err := c.QueryStructContext(reqCtx, "GET", path, params, nil, nil, "", target)
+		cancel()
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return waitTimeoutError()
+		}
+		if !IsTimeout(err) || slice < operationWaitSlice {
+			return err
+		}
+	}
+}
+
+// TailOperationLogs writes the output of the operation to w. If follow is set,
+// it keeps writing it until the operation is done or ctx is given up. Once
+// written, a *LogTruncatedError is returned if part of it was discarded by
+// the service before it could be read
+func (c *operations) TailOperationLogs(ctx context.Context, uuid string, w io.Writer, follow bool) error {
+	resource := APIPath("operations", url.QueryEscape(uuid), "logs")
+
+	var offset, skipped int64
+	for {
+		params := QueryParams{"offset": strconv.FormatInt(offset, 10)}
+		if follow {
+			params["follow"] = "true"
+		}
+
+		resp, err := c.CallRaw(ctx, "GET", resource, params, nil)
+		if err != nil {
+			return err
+		}
+
+		// The service starts after the requested offset once discarded
+		start, _ := strconv.ParseInt(resp.Header.Get(api.LogOffsetHeader), 10, 64)
+		if start > offset {
+			skipped += start - offset
+		}
+		complete := resp.Header.Get(api.LogCompleteHeader) == "true"
+		n, err := io.Copy(w, resp.Body)
+		resp.Body.Close()
+		offset = start + n
+
+		// Streams cut by timeouts are requested again from where they ended
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			return err
+		}
+
+		if !follow || complete {
+			if skipped > 0 {
+				return &LogTruncatedError{Skipped: skipped}
+			}
+			return nil
+		}
+
+		// Do not flood services not following the output
+		if n == 0 {
+			timer := time.NewTimer(time.Second)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+	}
+}
+
 // DeleteOperation deletes (cancels) a running operation
 func (c *operations) DeleteOperation(uuid string) error {
 	resource := APIPath("operations", url.QueryEscape(uuid))
@@ -20,6 +20,7 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
@@ -125,3 +126,33 @@ func (s *operationsSuite) TestDeleteOperation(c *check.C) {
 	err := opsCli.DeleteOperation("op1")
 	c.Assert(err, check.IsNil)
 }
+
+func (s *operationsSuite) TestWaitFailedOperation(c *check.C) {
+	op := &operation{
+		Operation: api.Operation{ID: "op1", Status: "Failure", StatusCode: api.Failure, Err: "Disk is full"},
+		doneCh:    make(chan bool),
+	}
+
+	err := op.Wait(context.Background())
+	opErr, ok := err.(*OperationError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(opErr.Operation.ID, check.Equals, "op1")
+	c.Assert(opErr.Error(), check.Equals, "Disk is full")
+
+	op.Operation = api.Operation{ID: "op2", Status: "Success", StatusCode: api.Success}
+	c.Assert(op.Wait(context.Background()), check.IsNil)
+}
+
+func (s *operationsSuite) TestOperationResult(c *check.C) {
+	op := &operation{Operation: api.Operation{ID: "op1", StatusCode: api.Success, Result: json.RawMessage(`{"count": 3}`)}}
+	result := map[string]int{}
+	c.Assert(op.Result(&result), check.IsNil)
+	c.Assert(result, check.DeepEquals, map[string]int{"count": 3})
+
+	op = &operation{Operation: api.Operation{ID: "op1", StatusCode: api.Success}}
+	c.Assert(op.Result(&result), check.Equals, api.ErrNoResult)
+
+	op = &operation{Operation: api.Operation{ID: "op1", StatusCode: api.Failure, Err: "Runtime error"}}
+	err := op.Result(&result)
+	c.Assert(err, check.FitsTypeOf, &OperationError{})
+}
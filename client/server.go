@@ -0,0 +1,87 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/greenbrew/rest/api"
+)
+
+// GetServer returns the information the server exposes about itself
+func (c *client) GetServer() (*api.Server, string, error) {
+	server := &api.Server{}
+	etag, err := c.QueryStruct("GET", APIPath(), nil, nil, nil, "", server)
+	if err != nil {
+		return nil, "", err
+	}
+	return server, etag, nil
+}
+
+// HasExtension returns true if the server supports the given API extension.
+// The list of extensions is requested once and cached for later calls
+func (c *client) HasExtension(extension string) bool {
+	extensions, err := c.getExtensions()
+	if err != nil {
+		return false
+	}
+
+	for _, e := range extensions {
+		if e == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireExtension returns an error if the server does not support the given API extension
+func (c *client) RequireExtension(extension string) error {
+	extensions, err := c.getExtensions()
+	if err != nil {
+		return fmt.Errorf("Could not get server API extensions: %v", err)
+	}
+
+	for _, e := range extensions {
+		if e == extension {
+			return nil
+		}
+	}
+	return fmt.Errorf("The server is missing the required %q API extension", extension)
+}
+
+func (c *client) getExtensions() ([]string, error) {
+	c.extensionsMux.Lock()
+	defer c.extensionsMux.Unlock()
+
+	if c.extensions != nil {
+		return c.extensions, nil
+	}
+
+	server, _, err := c.GetServer()
+	if err != nil {
+		return nil, err
+	}
+
+	c.extensions = server.APIExtensions
+	if c.extensions == nil {
+		c.extensions = []string{}
+	}
+	return c.extensions, nil
+}
@@ -25,7 +25,9 @@ import (
 	"net/http"
 
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 
+	"github.com/greenbrew/rest/api"
 	"github.com/greenbrew/rest/logger"
 )
 
@@ -63,8 +65,16 @@ func (c *client) dialWebsocket(url string) (*websocket.Conn, error) {
 	}
 
 	// Establish the connection
-	conn, _, err := dialer.Dial(url, http.Header{})
+	header := http.Header{}
+	header.Set(api.RequestIDHeader, uuid.NewRandom().String())
+	c.authorize(header)
+	conn, resp, err := dialer.Dial(url, header)
 	if err != nil {
+		// Handshakes rejected by the service include the reason
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			defer resp.Body.Close()
+			return nil, extractErrorFromResponse(resp)
+		}
 		return nil, err
 	}
 
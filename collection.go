@@ -0,0 +1,599 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListParams holds the pagination, sorting and filtering requested for a
+// collection through these query parameters:
+//
+//	limit=N           maximum number of items per page. All of them if not set
+//	cursor=C          position to start from, as returned in the previous page
+//	sort=a,-b         fields to sort by. Prefixed with '-' for descending order
+//	filter=EXPR       expression items must match, like "status eq Running".
+//	                  Conditions are combined with 'and' and 'or', being 'and'
+//	                  evaluated first. Supported operators are eq, ne, gt, ge,
+//	                  lt and le. Values with spaces must be double quoted
+//
+// Fields are referred by their JSON name, using dots for nested ones.
+// Cursors of sorted collections point to the values of the sort keys of the
+// last item returned, so that pages do not skip or repeat items when the
+// collection changes in between. For that, sort keys must identify the items,
+// like ending with an unique ID. Otherwise, they point to an offset
+type ListParams struct {
+	Limit  int
+	Sort   []string
+	Filter string
+
+	cursor *listCursor
+	filter [][]filterCondition
+}
+
+// listCursor is the position a page starts after
+type listCursor struct {
+	// Offset of the page, for collections not sorted
+	Offset int `json:"o,omitempty"`
+	// Sort keys, and their values for the last item of the previous page
+	Sort []string          `json:"s,omitempty"`
+	Keys []json.RawMessage `json:"k,omitempty"`
+}
+
+// A condition of a filter expression
+type filterCondition struct {
+	field string
+	op    string
+	value string
+}
+
+// ListParams parses the collection parameters of the request. An
+// *ValidationError is returned if any of them is not valid
+func (r *Request) ListParams() (*ListParams, error) {
+	query := r.HTTPRequest.URL.Query()
+	verr := &ValidationError{}
+	p := &ListParams{}
+
+	if v := query.Get("limit"); len(v) > 0 {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			verr.add("limit", "must be a positive number")
+		}
+		p.Limit = limit
+	}
+
+	if v := query.Get("cursor"); len(v) > 0 {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			verr.add("cursor", "is not valid")
+		}
+		p.cursor = cursor
+	}
+
+	if v := query.Get("sort"); len(v) > 0 {
+		for _, key := range strings.Split(v, ",") {
+			key = strings.TrimSpace(key)
+			if len(strings.TrimPrefix(key, "-")) == 0 {
+				verr.add("sort", "has an empty key")
+				continue
+			}
+			p.Sort = append(p.Sort, key)
+		}
+	}
+
+	if v := query.Get("filter"); len(v) > 0 {
+		filter, err := parseFilter(v)
+		if err != nil {
+			verr.add("filter", "%v", err)
+		}
+		p.Filter = v
+		p.filter = filter
+	}
+
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+	return p, nil
+}
+
+// Page is a page of a collection
+type Page struct {
+	// Items of the page, a slice of the same type as the collection
+	Items interface{}
+	// Cursor of the next page. Empty if this is the last one
+	Next string
+	// Number of items matching the filter, in all pages
+	Total int
+}
+
+// Apply filters, sorts and slices the items of a collection, which must be a
+// slice of structs, maps with string keys or pointers to them. Items sort
+// keys compare equal keep the order they have in the collection.
+// An *ValidationError is returned if the fields cannot be sorted or filtered
+func (p *ListParams) Apply(items interface{}) (*Page, error) {
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("Cannot list %T. A slice is required", items)
+	}
+
+	verr := &ValidationError{}
+	matching := []int{}
+	for i := 0; i < v.Len(); i++ {
+		ok, err := p.matches(v.Index(i))
+		if err != nil {
+			verr.add("filter", "%v", err)
+			return nil, verr
+		}
+		if ok {
+			matching = append(matching, i)
+		}
+	}
+
+	// Fields are the same for every item of the collection, except for maps
+	if v.Len() > 0 && v.Type().Elem().Kind() != reflect.Map {
+		for _, key := range p.Sort {
+			if _, ok := lookupField(v.Index(0), strings.TrimPrefix(key, "-")); !ok {
+				verr.add("sort", "unknown field %q", strings.TrimPrefix(key, "-"))
+				return nil, verr
+			}
+		}
+	}
+
+	var sortErr error
+	sort.SliceStable(matching, func(a, b int) bool {
+		for _, key := range p.Sort {
+			field := strings.TrimPrefix(key, "-")
+			va, _ := lookupField(v.Index(matching[a]), field)
+			vb, _ := lookupField(v.Index(matching[b]), field)
+			c, err := compareValues(va, vb)
+			if err != nil {
+				sortErr = err
+				return false
+			}
+			if c != 0 {
+				return (c < 0) != strings.HasPrefix(key, "-")
+			}
+		}
+		return false
+	})
+	if sortErr != nil {
+		verr.add("sort", "%v", sortErr)
+		return nil, verr
+	}
+
+	start, err := p.start(v, matching)
+	if err != nil {
+		verr.add("cursor", "%v", err)
+		return nil, verr
+	}
+	end := len(matching)
+	if p.Limit > 0 && start+p.Limit < end {
+		end = start + p.Limit
+	}
+
+	page := reflect.MakeSlice(v.Type(), 0, end-start)
+	for _, i := range matching[start:end] {
+		page = reflect.Append(page, v.Index(i))
+	}
+
+	next := ""
+	if end < len(matching) {
+		next, err = p.nextCursor(v.Index(matching[end-1]), end)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Page{Items: page.Interface(), Next: next, Total: len(matching)}, nil
+}
+
+// start returns the position in the sorted matching items where the page
+// requested by the cursor starts
+func (p *ListParams) start(items reflect.Value, matching []int) (int, error) {
+	if p.cursor == nil {
+		return 0, nil
+	}
+
+	if len(p.cursor.Keys) == 0 {
+		if len(p.Sort) > 0 {
+			return 0, fmt.Errorf("is not valid for the requested sort")
+		}
+		if p.cursor.Offset > len(matching) {
+			return len(matching), nil
+		}
+		return p.cursor.Offset, nil
+	}
+
+	if strings.Join(p.cursor.Sort, ",") != strings.Join(p.Sort, ",") || len(p.cursor.Keys) != len(p.Sort) {
+		return 0, fmt.Errorf("is not valid for the requested sort")
+	}
+
+	// The first item sorted after the last one of the previous page
+	var err error
+	start := sort.Search(len(matching), func(i int) bool {
+		c, e := p.compareToCursor(items.Index(matching[i]))
+		if e != nil {
+			err = e
+		}
+		return c > 0
+	})
+	return start, err
+}
+
+// compareToCursor compares the sort keys of the item with the ones in the
+// cursor, in the requested order
+func (p *ListParams) compareToCursor(item reflect.Value) (int, error) {
+	for i, key := range p.Sort {
+		field := strings.TrimPrefix(key, "-")
+		v, _ := lookupField(item, field)
+
+		cursor := reflect.Value{}
+		if string(p.cursor.Keys[i]) != "null" {
+			if !v.IsValid() {
+				// Missing values are lower than any other
+				return reverseIf(-1, strings.HasPrefix(key, "-")), nil
+			}
+			value := reflect.New(v.Type())
+			if err := json.Unmarshal(p.cursor.Keys[i], value.Interface()); err != nil {
+				return 0, fmt.Errorf("is not valid")
+			}
+			cursor = value.Elem()
+		}
+
+		c, err := compareValues(v, cursor)
+		if err != nil {
+			return 0, err
+		}
+		if c != 0 {
+			return reverseIf(c, strings.HasPrefix(key, "-")), nil
+		}
+	}
+	return 0, nil
+}
+
+func reverseIf(c int, reverse bool) int {
+	if reverse {
+		return -c
+	}
+	return c
+}
+
+// nextCursor returns the cursor of the page after the given last item, at
+// the given offset
+func (p *ListParams) nextCursor(last reflect.Value, offset int) (string, error) {
+	cursor := &listCursor{Offset: offset}
+	if len(p.Sort) > 0 {
+		cursor = &listCursor{Sort: p.Sort}
+		for _, key := range p.Sort {
+			v, _ := lookupField(last, strings.TrimPrefix(key, "-"))
+
+			value := json.RawMessage("null")
+			if v.IsValid() {
+				b, err := json.Marshal(v.Interface())
+				if err != nil {
+					return "", err
+				}
+				value = b
+			}
+			cursor.Keys = append(cursor.Keys, value)
+		}
+	}
+	return encodeCursor(cursor)
+}
+
+// PageResponse returns a sync response with the given metadata for a page of
+// a collection. The next page, if any, is announced both in the Link header
+// and in the next field of the response
+func PageResponse(r *Request, metadata interface{}, page *Page) Response {
+	resp := &syncResponse{success: true, metadata: metadata, next: page.Next}
+	if len(page.Next) > 0 {
+		u := *r.HTTPRequest.URL
+		query := u.Query()
+		query.Set("cursor", page.Next)
+		u.RawQuery = query.Encode()
+		resp.headers = map[string]string{"Link": fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI())}
+	}
+	return resp
+}
+
+// Cursors are opaque to clients, allowing to change the kind of positions
+// they hold
+func encodeCursor(cursor *listCursor) (string, error) {
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(value string) (*listCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := &listCursor{}
+	if err := json.Unmarshal(b, cursor); err != nil || cursor.Offset < 0 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// parseFilter parses a filter expression into a list of alternatives, each
+// one being a list of conditions that must all be met
+func parseFilter(expr string) ([][]filterCondition, error) {
+	tokens, err := filterTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := [][]filterCondition{{}}
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("incomplete condition %q", strings.Join(tokens, " "))
+		}
+
+		cond := filterCondition{field: tokens[0], op: strings.ToLower(tokens[1]), value: tokens[2]}
+		switch cond.op {
+		case "eq", "ne", "gt", "ge", "lt", "le":
+		default:
+			return nil, fmt.Errorf("unknown operator %q", tokens[1])
+		}
+
+		last := len(filter) - 1
+		filter[last] = append(filter[last], cond)
+		tokens = tokens[3:]
+		if len(tokens) == 0 {
+			break
+		}
+
+		switch strings.ToLower(tokens[0]) {
+		case "and":
+		case "or":
+			filter = append(filter, []filterCondition{})
+		default:
+			return nil, fmt.Errorf("expected 'and' or 'or' instead of %q", tokens[0])
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("missing condition after %q", "and/or")
+		}
+	}
+	return filter, nil
+}
+
+// filterTokens splits a filter expression by spaces, keeping together
+// the double quoted strings
+func filterTokens(expr string) ([]string, error) {
+	tokens := []string{}
+	for expr = strings.TrimSpace(expr); len(expr) > 0; expr = strings.TrimSpace(expr) {
+		if expr[0] != '"' {
+			end := strings.IndexAny(expr, " \t")
+			if end < 0 {
+				end = len(expr)
+			}
+			tokens = append(tokens, expr[:end])
+			expr = expr[end:]
+			continue
+		}
+
+		end := strings.Index(expr[1:], `"`)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated quoted value")
+		}
+		tokens = append(tokens, expr[1:end+1])
+		expr = expr[end+2:]
+	}
+	return tokens, nil
+}
+
+// matches returns whether the item meets the filter
+func (p *ListParams) matches(item reflect.Value) (bool, error) {
+	if len(p.filter) == 0 {
+		return true, nil
+	}
+
+	for _, conditions := range p.filter {
+		all := true
+		for _, cond := range conditions {
+			ok, err := cond.matches(item)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *filterCondition) matches(item reflect.Value) (bool, error) {
+	v, ok := lookupField(item, c.field)
+	if !ok {
+		return false, fmt.Errorf("unknown field %q", c.field)
+	}
+
+	// Missing values, like nil pointers, only match 'ne'
+	if !v.IsValid() {
+		return c.op == "ne", nil
+	}
+
+	literal := reflect.New(v.Type()).Elem()
+	if v.Type() == timeType {
+		t, err := time.Parse(time.RFC3339, c.value)
+		if err != nil {
+			return false, fmt.Errorf("%q is not a valid time for %q", c.value, c.field)
+		}
+		literal.Set(reflect.ValueOf(t))
+	} else if err := setFromString(literal, c.value); err != nil {
+		return false, fmt.Errorf("%q is not valid for %q: %v", c.value, c.field, err)
+	}
+
+	cmp, err := compareValues(v, literal)
+	if err != nil {
+		return false, err
+	}
+
+	switch c.op {
+	case "eq":
+		return cmp == 0, nil
+	case "ne":
+		return cmp != 0, nil
+	case "gt":
+		return cmp > 0, nil
+	case "ge":
+		return cmp >= 0, nil
+	case "lt":
+		return cmp < 0, nil
+	default:
+		return cmp <= 0, nil
+	}
+}
+
+// lookupField returns the value of the field with the given JSON name,
+// using dots for nested fields. The returned value is not valid when a nil
+// pointer or a missing map key is found in the way. False is returned if
+// the field does not exist
+func lookupField(v reflect.Value, name string) (reflect.Value, bool) {
+	for _, part := range strings.Split(name, ".") {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return reflect.Value{}, true
+			}
+			v = v.Elem()
+		}
+
+		switch v.Kind() {
+		case reflect.Struct:
+			found := false
+			t := v.Type()
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if len(f.PkgPath) > 0 {
+					continue
+				}
+				if n, _, skip := jsonFieldName(f); !skip && n == part {
+					v = v.Field(i)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return reflect.Value{}, false
+			}
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return reflect.Value{}, false
+			}
+			v = v.MapIndex(reflect.ValueOf(part).Convert(v.Type().Key()))
+			if !v.IsValid() {
+				return v, true
+			}
+		default:
+			return reflect.Value{}, false
+		}
+	}
+
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, true
+		}
+		v = v.Elem()
+	}
+	return v, true
+}
+
+// compareValues compares two values of the same comparable type, returning
+// a negative number, zero or a positive number if a is lower, equal or
+// greater than b. Missing values are lower than any other
+func compareValues(a, b reflect.Value) (int, error) {
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return 0, nil
+	case !a.IsValid():
+		return -1, nil
+	case !b.IsValid():
+		return 1, nil
+	case a.Kind() != b.Kind():
+		return 0, fmt.Errorf("cannot compare %v with %v", a.Type(), b.Type())
+	}
+
+	if a.Type() == timeType {
+		ta, tb := a.Interface().(time.Time), b.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1, nil
+		case ta.After(tb):
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	switch a.Kind() {
+	case reflect.String:
+		return strings.Compare(a.String(), b.String()), nil
+	case reflect.Bool:
+		return boolToInt(a.Bool()) - boolToInt(b.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareFloats(float64(a.Int()), float64(b.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareFloats(float64(a.Uint()), float64(b.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return compareFloats(a.Float(), b.Float()), nil
+	}
+	return 0, fmt.Errorf("cannot compare values of type %v", a.Type())
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Pagination related documentation for collection endpoints
+var listParamsDoc = []ParameterDoc{
+	{Name: "limit", Description: "Maximum number of items to return", Type: 0},
+	{Name: "cursor", Description: "Cursor of the page to return, as given by the previous one"},
+	{Name: "sort", Description: "Comma separated list of fields to sort by, prefixed with '-' for descending order"},
+	{Name: "filter", Description: "Filter expression like 'status eq Running and created_at gt 2018-01-01T00:00:00Z'"},
+}
@@ -0,0 +1,186 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	check "gopkg.in/check.v1"
+
+	"github.com/greenbrew/rest/api"
+)
+
+type collectionSuite struct{}
+
+var _ = check.Suite(&collectionSuite{})
+
+type collectionItem struct {
+	Name    string            `json:"name"`
+	Size    int               `json:"size"`
+	Created time.Time         `json:"created_at"`
+	Labels  map[string]string `json:"labels"`
+}
+
+var collectionItems = []collectionItem{
+	{Name: "a", Size: 3, Created: time.Date(2018, 1, 3, 0, 0, 0, 0, time.UTC), Labels: map[string]string{"env": "prod"}},
+	{Name: "b", Size: 1, Created: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), Labels: map[string]string{"env": "dev"}},
+	{Name: "c", Size: 2, Created: time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)},
+	{Name: "d e", Size: 2, Created: time.Date(2018, 1, 4, 0, 0, 0, 0, time.UTC)},
+}
+
+func listParams(c *check.C, query url.Values) (*ListParams, error) {
+	r := &Request{HTTPRequest: httptest.NewRequest("GET", "/1.0/things?"+query.Encode(), nil)}
+	return r.ListParams()
+}
+
+func itemNames(page *Page) []string {
+	names := []string{}
+	for _, item := range page.Items.([]collectionItem) {
+		names = append(names, item.Name)
+	}
+	return names
+}
+
+func (s *collectionSuite) TestSortAndFilter(c *check.C) {
+	for _, t := range []struct {
+		sort   string
+		filter string
+		names  []string
+	}{
+		{"", "", []string{"a", "b", "c", "d e"}},
+		{"size", "", []string{"b", "c", "d e", "a"}},
+		{"-size,-name", "", []string{"a", "d e", "c", "b"}},
+		{"created_at", "", []string{"b", "c", "a", "d e"}},
+		{"", "size eq 2", []string{"c", "d e"}},
+		{"", `name eq "d e" or size gt 2`, []string{"a", "d e"}},
+		{"", "size ge 2 and created_at lt 2018-01-03T00:00:00Z", []string{"c"}},
+		{"", "labels.env eq prod or labels.env eq dev", []string{"a", "b"}},
+		{"", "labels.env ne prod", []string{"b", "c", "d e"}},
+	} {
+		params, err := listParams(c, url.Values{"sort": {t.sort}, "filter": {t.filter}})
+		c.Assert(err, check.IsNil)
+
+		page, err := params.Apply(collectionItems)
+		c.Assert(err, check.IsNil)
+		c.Assert(itemNames(page), check.DeepEquals, t.names, check.Commentf("sort %q filter %q", t.sort, t.filter))
+		c.Assert(page.Total, check.Equals, len(t.names))
+		c.Assert(page.Next, check.Equals, "")
+	}
+}
+
+func (s *collectionSuite) TestPagination(c *check.C) {
+	names := []string{}
+	query := url.Values{"limit": {"3"}, "sort": {"name"}}
+	for {
+		params, err := listParams(c, query)
+		c.Assert(err, check.IsNil)
+
+		page, err := params.Apply(collectionItems)
+		c.Assert(err, check.IsNil)
+		c.Assert(page.Total, check.Equals, 4)
+		names = append(names, itemNames(page)...)
+		if len(page.Next) == 0 {
+			break
+		}
+		query.Set("cursor", page.Next)
+	}
+	c.Assert(names, check.DeepEquals, []string{"a", "b", "c", "d e"})
+}
+
+func (s *collectionSuite) TestPaginationOfChangingCollection(c *check.C) {
+	query := url.Values{"limit": {"2"}, "sort": {"name"}}
+	params, err := listParams(c, query)
+	c.Assert(err, check.IsNil)
+	page, err := params.Apply(collectionItems)
+	c.Assert(err, check.IsNil)
+	c.Assert(itemNames(page), check.DeepEquals, []string{"a", "b"})
+
+	// Items are removed and added before the position of the next page
+	items := append([]collectionItem{{Name: "aa"}}, collectionItems[1:]...)
+	query.Set("cursor", page.Next)
+	params, err = listParams(c, query)
+	c.Assert(err, check.IsNil)
+	page, err = params.Apply(items)
+	c.Assert(err, check.IsNil)
+	c.Assert(itemNames(page), check.DeepEquals, []string{"c", "d e"})
+	c.Assert(page.Next, check.Equals, "")
+
+	// The cursor only applies to the same sort
+	query.Set("sort", "size")
+	params, err = listParams(c, query)
+	c.Assert(err, check.IsNil)
+	_, err = params.Apply(items)
+	c.Assert(err, check.ErrorMatches, "Invalid request: cursor is not valid for the requested sort")
+}
+
+func (s *collectionSuite) TestInvalidParams(c *check.C) {
+	for _, t := range []struct {
+		query url.Values
+		field api.FieldError
+	}{
+		{url.Values{"limit": {"0"}}, api.FieldError{Field: "limit", Message: "must be a positive number"}},
+		{url.Values{"cursor": {"xyz"}}, api.FieldError{Field: "cursor", Message: "is not valid"}},
+		{url.Values{"sort": {"name,"}}, api.FieldError{Field: "sort", Message: "has an empty key"}},
+		{url.Values{"filter": {"name eq"}}, api.FieldError{Field: "filter", Message: `incomplete condition "name eq"`}},
+		{url.Values{"filter": {"name is a"}}, api.FieldError{Field: "filter", Message: `unknown operator "is"`}},
+		{url.Values{"filter": {"name eq a xor size eq 1"}}, api.FieldError{Field: "filter", Message: `expected 'and' or 'or' instead of "xor"`}},
+		{url.Values{"filter": {`name eq "a`}}, api.FieldError{Field: "filter", Message: "unterminated quoted value"}},
+	} {
+		_, err := listParams(c, t.query)
+		verr, ok := err.(*ValidationError)
+		c.Assert(ok, check.Equals, true, check.Commentf("%v", t.query))
+		c.Assert(verr.Fields, check.DeepEquals, []api.FieldError{t.field})
+	}
+
+	for _, t := range []struct {
+		query url.Values
+		field api.FieldError
+	}{
+		{url.Values{"sort": {"color"}}, api.FieldError{Field: "sort", Message: `unknown field "color"`}},
+		{url.Values{"sort": {"labels"}}, api.FieldError{Field: "sort", Message: "cannot compare values of type map[string]string"}},
+		{url.Values{"filter": {"color eq red"}}, api.FieldError{Field: "filter", Message: `unknown field "color"`}},
+		{url.Values{"filter": {"size gt big"}}, api.FieldError{Field: "filter", Message: `"big" is not valid for "size": must be an integer`}},
+	} {
+		params, err := listParams(c, t.query)
+		c.Assert(err, check.IsNil)
+
+		_, err = params.Apply(collectionItems)
+		verr, ok := err.(*ValidationError)
+		c.Assert(ok, check.Equals, true, check.Commentf("%v", t.query))
+		c.Assert(verr.Fields, check.DeepEquals, []api.FieldError{t.field})
+	}
+}
+
+func (s *collectionSuite) TestPageResponse(c *check.C) {
+	r := &Request{HTTPRequest: httptest.NewRequest("GET", "/1.0/things?limit=2", nil)}
+	params, err := r.ListParams()
+	c.Assert(err, check.IsNil)
+
+	page, err := params.Apply(collectionItems)
+	c.Assert(err, check.IsNil)
+
+	w := httptest.NewRecorder()
+	err = PageResponse(r, page.Items, page).Render(w)
+	c.Assert(err, check.IsNil)
+	c.Assert(w.Header().Get("Link"), check.Equals, `</1.0/things?cursor=`+page.Next+`&limit=2>; rel="next"`)
+	c.Assert(w.Body.String(), check.Matches, `(?s).*"next":"`+page.Next+`".*`)
+}
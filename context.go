@@ -0,0 +1,159 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/greenbrew/rest/api"
+	"github.com/greenbrew/rest/logger"
+)
+
+var errAbandoned = errors.New("Request abandoned before answering")
+
+// handlerPanic carries a panic of a handler, along with the stack where it
+// happened, to the goroutine attending the request
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// requestTracker keeps track of what attending a request leads to. Set in
+// the context of the requests whose state must be kept as long as needed
+type requestTracker struct {
+	// Closed once the handler given up returns. Nil if it was not given up
+	finished chan struct{}
+	// Operation created for the request, if any
+	op *Operation
+}
+
+// trackOperation records op as the one created for the request r
+func trackOperation(r *http.Request, op *Operation) {
+	if t, ok := r.Context().Value(requestTrackerKey).(*requestTracker); ok {
+		t.op = op
+	}
+}
+
+// requestContext returns the context for the handlers attending r. It is done
+// when the client goes away, the service shuts down or the given timeout
+// expires. Clients can shorten the timeout with the request timeout header
+func (d *Service) requestContext(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if t := clientTimeout(r); t > 0 && (timeout <= 0 || t < timeout) {
+		timeout = t
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+
+	if d.ctx != nil {
+		go func() {
+			select {
+			case <-d.ctx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// clientTimeout returns the time the client waits for the response of r, or
+// zero if not given or not valid
+func clientTimeout(r *http.Request) time.Duration {
+	seconds, err := strconv.ParseFloat(r.Header.Get(api.RequestTimeoutHeader), 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// runHandler returns the response of handler, or gives up once ctx is done.
+// The response given after that is discarded. Panics of the handler are
+// raised again in the calling goroutine
+func (d *Service) runHandler(ctx context.Context, handler handlerFunc, req *Request) Response {
+	done := make(chan Response, 1)
+	panicked := make(chan *handlerPanic, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				panicked <- &handlerPanic{value: rec, stack: debug.Stack()}
+			}
+		}()
+		done <- handler(req)
+	}()
+
+	select {
+	case resp := <-done:
+		return resp
+	case p := <-panicked:
+		panic(p)
+	case <-ctx.Done():
+	}
+
+	finished := make(chan struct{})
+	if t, ok := ctx.Value(requestTrackerKey).(*requestTracker); ok {
+		t.finished = finished
+	}
+
+	go func() {
+		defer close(finished)
+		select {
+		case resp := <-done:
+			discardResponse(resp)
+		case <-panicked:
+		}
+	}()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return GatewayTimeout
+	}
+	return ServiceUnavailable
+}
+
+// discardResponse releases a response that is never going to be rendered.
+// Operations are discarded, as nobody knows about them to follow them
+func discardResponse(resp Response) {
+	or, ok := resp.(*operationResponse)
+	if !ok || or.op.getStatus() != api.Pending {
+		return
+	}
+
+	logger.Debugf("Discarding operation of abandoned request: %s", or.op.logID())
+	or.op.discard(errAbandoned)
+}
+
+// Context returns the context of the request. It is done when the client goes
+// away, the service shuts down or the handler times out, so it must not be used
+// by operations outliving the request. Handlers must give up once it is done,
+// as their response is discarded, including the operations they created
+func (r *Request) Context() context.Context {
+	return r.HTTPRequest.Context()
+}
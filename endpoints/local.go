@@ -49,6 +49,9 @@ func NewLocalEndpoint(r *mux.Router, unixSocketPath, owner string) Endpoint {
 		endpoint{
 			server: &http.Server{
 				Handler: r,
+				// Requests carry the credentials of the processes
+				// sending them
+				ConnContext: withPeerCredentials,
 			},
 		},
 		unixSocketPath,
@@ -0,0 +1,58 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package endpoints
+
+import (
+	"context"
+	"net"
+
+	"github.com/greenbrew/rest/logger"
+)
+
+// PeerCredentials of the process on the other side of a unix socket
+// connection
+type PeerCredentials struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+type contextKey int
+
+const peerCredentialsKey contextKey = iota
+
+// withPeerCredentials keeps in ctx the credentials of the peer of c, for the
+// requests received through it
+func withPeerCredentials(ctx context.Context, c net.Conn) context.Context {
+	creds, err := peerCredentials(c)
+	if err != nil {
+		logger.Debugf("Could not get peer credentials: %v", err)
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey, creds)
+}
+
+// PeerCredentialsFromContext returns the credentials of the peer of the
+// connection which received the request with the given context, if it was
+// received through the local endpoint
+func PeerCredentialsFromContext(ctx context.Context) (*PeerCredentials, bool) {
+	creds, ok := ctx.Value(peerCredentialsKey).(*PeerCredentials)
+	return creds, ok
+}
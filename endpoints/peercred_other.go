@@ -1,5 +1,7 @@
 // -*- Mode: Go; indent-tabs-mode: t -*-
 
+//go:build !linux
+
 /*
  * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
  *
@@ -17,16 +19,14 @@
  *
  */
 
-package rest
+package endpoints
 
-import "net/http"
+import (
+	"net"
 
-// Hijack used for not writting to response any content but maintaining
-// the headers. This is used to attend HEAD requests
-type hijack struct {
-	http.ResponseWriter
-}
+	"github.com/pkg/errors"
+)
 
-func (h *hijack) Write([]byte) (int, error) {
-	return 0, nil
+func peerCredentials(c net.Conn) (*PeerCredentials, error) {
+	return nil, errors.New("Peer credentials are not supported in this platform")
 }
@@ -0,0 +1,66 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package endpoints
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	check "gopkg.in/check.v1"
+)
+
+type peerCredentialsSuite struct{}
+
+var _ = check.Suite(&peerCredentialsSuite{})
+
+func (s *peerCredentialsSuite) TestPeerCredentials(c *check.C) {
+	tmpDir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	listener, err := net.Listen("unix", filepath.Join(tmpDir, "unix.socket"))
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	ctx := withPeerCredentials(context.Background(), conn)
+	creds, ok := PeerCredentialsFromContext(ctx)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(creds.UID, check.Equals, uint32(os.Getuid()))
+	c.Assert(creds.GID, check.Equals, uint32(os.Getgid()))
+	c.Assert(creds.PID, check.Equals, int32(os.Getpid()))
+
+	// Only unix socket connections have them
+	server, other := net.Pipe()
+	defer server.Close()
+	defer other.Close()
+	_, ok = PeerCredentialsFromContext(withPeerCredentials(context.Background(), server))
+	c.Assert(ok, check.Equals, false)
+}
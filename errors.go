@@ -0,0 +1,131 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/greenbrew/rest/errs"
+)
+
+// errorMapping maps a kind of error to the status and code describing it
+type errorMapping struct {
+	match  func(err error) bool
+	status int
+	code   string
+	// Message answered instead of the one of the error, if set
+	msg string
+}
+
+var (
+	errorMappings    []errorMapping
+	errorMappingsMux sync.RWMutex
+)
+
+func init() {
+	// Most of the builtin mappings answer with the message of the response,
+	// not exposing details of the error like file paths
+	registerErrorResponse(os.ErrNotExist, NotFound, "")
+	registerErrorResponse(sql.ErrNoRows, NotFound, "")
+	registerErrorResponse(errs.ErrNoSuchObject, NotFound, "")
+	RegisterErrorType(errs.ErrNotFound{}, http.StatusNotFound, "")
+	registerErrorResponse(os.ErrPermission, Forbidden, "")
+	registerErrorResponse(errs.ErrAlreadyExists, Conflict, "already_exists")
+	RegisterError(errs.ErrPreconditionFailed, http.StatusPreconditionFailed, "")
+	registerErrorResponse(context.DeadlineExceeded, GatewayTimeout, "")
+	registerErrorResponse(context.Canceled, ServiceUnavailable, "")
+}
+
+// RegisterError maps the errors matching target, as errors.Is finds them,
+// to the given HTTP status and machine readable code in the responses built
+// by SmartError. If code is empty, one is derived from the status, like
+// "not_found" for 404. Later registrations take precedence over former ones
+func RegisterError(target error, status int, code string) {
+	addErrorMapping(func(err error) bool {
+		return errors.Is(err, target)
+	}, status, code, "")
+}
+
+// registerErrorResponse maps the errors matching target to the status and
+// message of resp
+func registerErrorResponse(target error, resp *errorResponse, code string) {
+	addErrorMapping(func(err error) bool {
+		return errors.Is(err, target)
+	}, resp.code, code, resp.msg)
+}
+
+// RegisterErrorType maps the errors of the same type as prototype, as
+// errors.As finds them, to the given HTTP status and machine readable code
+// in the responses built by SmartError. See RegisterError
+func RegisterErrorType(prototype error, status int, code string) {
+	t := reflect.TypeOf(prototype)
+	addErrorMapping(func(err error) bool {
+		return errors.As(err, reflect.New(t).Interface())
+	}, status, code, "")
+}
+
+func addErrorMapping(match func(err error) bool, status int, code, msg string) {
+	if len(code) == 0 {
+		code = errorCode(status)
+	}
+
+	errorMappingsMux.Lock()
+	defer errorMappingsMux.Unlock()
+	errorMappings = append(errorMappings, errorMapping{match: match, status: status, code: code, msg: msg})
+}
+
+// lookupErrorMapping returns the latest registered mapping matching err
+func lookupErrorMapping(err error) (errorMapping, bool) {
+	errorMappingsMux.RLock()
+	defer errorMappingsMux.RUnlock()
+
+	for i := len(errorMappings) - 1; i >= 0; i-- {
+		if errorMappings[i].match(err) {
+			return errorMappings[i], true
+		}
+	}
+	return errorMapping{}, false
+}
+
+// errorCode returns the machine readable code of an HTTP error status,
+// like "not_found" or "internal_server_error"
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if len(text) == 0 {
+		return "unknown_error"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r == ' ' || r == '-':
+			return '_'
+		}
+		return -1
+	}, strings.ToLower(text))
+}
@@ -27,6 +27,10 @@ var ErrAlreadyExists = errors.New("Already exists")
 // ErrInvalidInstanceType describes the error when an invalid instance type was used
 var ErrInvalidInstanceType = errors.New("Invalid instance type")
 
+// ErrPreconditionFailed describes the error when a resource does not match
+// the state required by a conditional request
+var ErrPreconditionFailed = errors.New("Precondition failed")
+
 // ErrNoSuchObject describes the error when a resource does not exists
 var ErrNoSuchObject = errors.New("Not found")
 
@@ -23,6 +23,10 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
 // Hashes the provided data and returns the sha256
@@ -35,3 +39,105 @@ func etagHash(data interface{}) (string, error) {
 
 	return fmt.Sprintf("%x", etag.Sum(nil)), nil
 }
+
+// ifMatch returns whether the etag is among the ones listed in the value of
+// an If-Match header. As it guards modifications, the comparison is strong:
+// weak etags never match. '*' matches any etag
+func ifMatch(header, etag string) bool {
+	return etagMatches(header, etag, false)
+}
+
+// ifNoneMatch returns whether the etag is among the ones listed in the value
+// of an If-None-Match header. The comparison is weak, so weak etags match
+// too. '*' matches any etag
+func ifNoneMatch(header, etag string) bool {
+	return etagMatches(header, etag, true)
+}
+
+func etagMatches(header, etag string, weak bool) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(v, "W/") {
+			if !weak {
+				continue
+			}
+			v = strings.TrimPrefix(v, "W/")
+		}
+
+		if strings.Trim(v, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified returns a 304 response when the request is a GET or HEAD one
+// whose If-None-Match header matches the etag of the response, or nil otherwise
+func notModified(r *http.Request, resp Response) Response {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+
+	header := r.Header.Get("If-None-Match")
+	sr, ok := resp.(*syncResponse)
+	if len(header) == 0 || !ok || !sr.success || sr.etag == nil {
+		return nil
+	}
+
+	etag, err := etagHash(sr.etag)
+	if err != nil || !ifNoneMatch(header, etag) {
+		return nil
+	}
+	return &notModifiedResponse{etag: etag}
+}
+
+// checkPrecondition verifies the If-Match header of a PUT, PATCH or DELETE
+// request against the current etag of the resource, as loaded by the
+// command. A failure response is returned on mismatch, or nil otherwise
+func (c *Command) checkPrecondition(r *Request) Response {
+	switch r.HTTPRequest.Method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return nil
+	}
+
+	header := r.HTTPRequest.Header.Get("If-Match")
+	if c.ETag == nil || len(header) == 0 {
+		return nil
+	}
+
+	current, err := c.ETag(r)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	etag, err := etagHash(current)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if !ifMatch(header, etag) {
+		return PreconditionFailed(errors.Errorf("ETag doesn't match: %s vs %s", header, etag))
+	}
+	return nil
+}
+
+// notModifiedResponse answers a conditional request whose resource did not change
+type notModifiedResponse struct {
+	etag string
+}
+
+func (r *notModifiedResponse) Render(w http.ResponseWriter) error {
+	w.Header().Del("Content-Type")
+	w.Header().Set("ETag", r.etag)
+	w.WriteHeader(http.StatusNotModified)
+	return nil
+}
+
+func (r *notModifiedResponse) String() string {
+	return "not modified"
+}
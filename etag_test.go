@@ -0,0 +1,52 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	check "gopkg.in/check.v1"
+)
+
+type etagSuite struct{}
+
+var _ = check.Suite(&etagSuite{})
+
+func (s *etagSuite) TestIfMatch(c *check.C) {
+	c.Assert(ifMatch("abc", "abc"), check.Equals, true)
+	c.Assert(ifMatch(`"abc"`, "abc"), check.Equals, true)
+	c.Assert(ifMatch(`"xyz", "abc"`, "abc"), check.Equals, true)
+	c.Assert(ifMatch("*", "abc"), check.Equals, true)
+	c.Assert(ifMatch(`"xyz"`, "abc"), check.Equals, false)
+	c.Assert(ifMatch("", "abc"), check.Equals, false)
+
+	// Weak etags are not enough to modify a resource
+	c.Assert(ifMatch(`W/"abc"`, "abc"), check.Equals, false)
+	c.Assert(ifMatch(`W/"x"`, "x"), check.Equals, false)
+	c.Assert(ifMatch(`W/"abc", "abc"`, "abc"), check.Equals, true)
+}
+
+func (s *etagSuite) TestIfNoneMatch(c *check.C) {
+	c.Assert(ifNoneMatch("abc", "abc"), check.Equals, true)
+	c.Assert(ifNoneMatch(`"abc"`, "abc"), check.Equals, true)
+	c.Assert(ifNoneMatch(`W/"abc"`, "abc"), check.Equals, true)
+	c.Assert(ifNoneMatch(`"xyz", "abc"`, "abc"), check.Equals, true)
+	c.Assert(ifNoneMatch("*", "abc"), check.Equals, true)
+	c.Assert(ifNoneMatch(`"xyz"`, "abc"), check.Equals, false)
+	c.Assert(ifNoneMatch("", "abc"), check.Equals, false)
+}
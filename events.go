@@ -40,17 +40,26 @@ type eventsListener struct {
 	running    bool
 	doneCh     chan struct{}
 	mux        sync.Mutex
+
+	// Whether the listener can receive the events about what the given
+	// owner did. It receives all of them if not set
+	canSee func(owner string) bool
 }
 
-func (m *eventsManager) send(eventMessage interface{}) error {
+// send broadcasts the message to all the listeners allowed to see what owner
+// did, identifying the request which caused it if any
+func (m *eventsManager) send(eventMessage interface{}, requestID, owner string) error {
 	event := jmap{}
 	event["timestamp"] = time.Now()
 	event["metadata"] = eventMessage
+	if len(requestID) > 0 {
+		event["request_id"] = requestID
+	}
 
-	return m.broadcast(event)
+	return m.broadcast(event, owner)
 }
 
-func (m *eventsManager) broadcast(event jmap) error {
+func (m *eventsManager) broadcast(event jmap, owner string) error {
 	body, err := json.Marshal(event)
 	if err != nil {
 		return err
@@ -59,6 +68,10 @@ func (m *eventsManager) broadcast(event jmap) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 	for _, listener := range m.listeners {
+		if listener.canSee != nil && !listener.canSee(owner) {
+			continue
+		}
+
 		go func(listener *eventsListener, body []byte) {
 			// Check that the listener still exists
 			if listener == nil {
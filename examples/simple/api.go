@@ -19,34 +19,68 @@
 
 package simple
 
-import "github.com/greenbrew/rest"
+import (
+	"net/http"
+
+	"github.com/greenbrew/rest"
+)
 
 // API simple example exposed API
 var API = rest.API{
 	Version: "1.0",
 	Commands: []*rest.Command{
-		serviceCmd,
 		resourcesCmd,
 		resourceCmd,
 	},
 }
 
 var (
-	serviceCmd = &rest.Command{
-		Name: "",
-		GET:  serviceGet,
-	}
-
 	resourcesCmd = &rest.Command{
-		Name: "resources",
-		GET:  resourcesGet,
-		POST: resourcesPost,
+		Name:    "resources",
+		GET:     resourcesGet,
+		POST:    rest.Bind(resourcesPost),
+		Summary: "Resources",
+		Docs: map[string]*rest.MethodDoc{
+			http.MethodGet: {
+				Summary:  "Lists resource URLs, or resources if recursion is requested",
+				Response: []interface{}{},
+			},
+			http.MethodPost: {
+				Summary: "Creates a new resource",
+				Request: map[string]interface{}{},
+				Async:   true,
+			},
+		},
 	}
 
 	resourceCmd = &rest.Command{
-		Name:   "resources/{id:[a-zA-Z0-9-_]+}",
-		GET:    resourceGet,
-		PUT:    resourcePut,
-		DELETE: resourceDelete,
+		Name:    "resources/{id:[a-zA-Z0-9-_]+}",
+		GET:     rest.Bind(resourceGet),
+		PUT:     rest.Bind(resourcePut),
+		PATCH:   rest.Bind(resourcePatch),
+		DELETE:  rest.Bind(resourceDelete),
+		Expand:  resourceExpand,
+		Summary: "Resource",
+		Docs: map[string]*rest.MethodDoc{
+			http.MethodGet: {
+				Summary:    "Returns the resource",
+				Parameters: []rest.ParameterDoc{{Name: "id", In: "path", Description: "Resource identifier"}},
+			},
+			http.MethodPut: {
+				Summary: "Updates the value of the resource",
+				Request: map[string]interface{}{},
+				Async:   true,
+			},
+			http.MethodPatch: {
+				Summary:     "Patches the value of the resource",
+				Description: "Accepts JSON Merge Patch and JSON Patch documents",
+				Request:     map[string]interface{}{},
+				Async:       true,
+			},
+			http.MethodDelete: {
+				Summary: "Deletes the resource",
+				Async:   true,
+			},
+		},
 	}
 )
@@ -20,12 +20,10 @@
 package simple
 
 import (
-	"encoding/json"
 	"path/filepath"
 
-	"github.com/gorilla/mux"
-
 	"github.com/greenbrew/rest"
+	"github.com/greenbrew/rest/errs"
 	"github.com/greenbrew/rest/random"
 )
 
@@ -36,8 +34,20 @@ const (
 
 var resources map[string]interface{}
 
-func serviceGet(r *rest.Request) rest.Response {
-	return rest.SyncResponse(true, "Service Alive and Kicking")
+// Request to create a resource. The whole body is the resource value
+type resourceCreation struct {
+	Value interface{} `body:"" validate:"required"`
+}
+
+// Request addressing an existing resource
+type resourceRequest struct {
+	ID string `path:"id" validate:"required"`
+}
+
+// Request to update an existing resource
+type resourceUpdate struct {
+	ID    string      `path:"id" validate:"required"`
+	Value interface{} `body:"" validate:"required"`
 }
 
 func resourcesGet(r *rest.Request) rest.Response {
@@ -50,15 +60,15 @@ func resourcesGet(r *rest.Request) rest.Response {
 		}
 	}
 
-	return rest.SyncResponse(success, list)
-}
-
-func resourcesPost(r *rest.Request) rest.Response {
-	var resource interface{}
-	if err := json.NewDecoder(r.HTTPRequest.Body).Decode(&resource); err != nil {
-		return rest.BadRequest(err)
+	shaped, err := r.ShapeResource(list)
+	if err != nil {
+		return rest.InternalError(err)
 	}
 
+	return rest.SyncResponse(success, shaped)
+}
+
+func resourcesPost(r *rest.Request, req *resourceCreation) rest.Response {
 	id := random.New(8)
 	new := map[string][]string{}
 	new["resources"] = []string{id}
@@ -69,7 +79,8 @@ func resourcesPost(r *rest.Request) rest.Response {
 		if resources == nil {
 			resources = make(map[string]interface{})
 		}
-		resources[id] = resource
+		resources[id] = req.Value
+		op.Logf("Stored resource %s", id)
 
 		return nil
 	}
@@ -82,41 +93,46 @@ func resourcesPost(r *rest.Request) rest.Response {
 	return rest.OperationResponse(op)
 }
 
-func resourceGet(r *rest.Request) rest.Response {
-	id := mux.Vars(r.HTTPRequest)["id"]
-	if len(id) == 0 {
+func resourceGet(r *rest.Request, req *resourceRequest) rest.Response {
+	res, ok := resources[req.ID]
+	if !ok {
 		return rest.NotFoundError("Resource")
 	}
 
-	res, ok := resources[id]
-	if !ok {
-		return rest.NotFoundError("Resource")
+	shaped, err := r.ShapeResource(res)
+	if err != nil {
+		return rest.InternalError(err)
 	}
 
-	return rest.SyncResponse(success, res)
+	return rest.SyncResponseETag(success, shaped, res)
 }
 
-func resourcePut(r *rest.Request) rest.Response {
-	id := mux.Vars(r.HTTPRequest)["id"]
-	if len(id) == 0 {
-		return rest.NotFoundError("Resource")
+// resourceExpand loads the resource addressed by the request, to be returned
+// in place of the references to it
+func resourceExpand(r *rest.Request) (interface{}, error) {
+	req := &resourceRequest{}
+	if err := r.Bind(req); err != nil {
+		return nil, err
 	}
 
-	_, ok := resources[id]
+	res, ok := resources[req.ID]
 	if !ok {
-		return rest.NotFoundError("Resource")
+		return nil, errs.NewNotFound("Resource")
 	}
+	return res, nil
+}
 
-	var resource interface{}
-	if err := json.NewDecoder(r.HTTPRequest.Body).Decode(&resource); err != nil {
-		return rest.BadRequest(err)
+func resourcePut(r *rest.Request, req *resourceUpdate) rest.Response {
+	_, ok := resources[req.ID]
+	if !ok {
+		return rest.NotFoundError("Resource")
 	}
 
 	updated := map[string][]string{}
-	updated["resources"] = []string{id}
+	updated["resources"] = []string{req.ID}
 
 	run := func(op *rest.Operation) error {
-		resources[id] = resource
+		resources[req.ID] = req.Value
 		return nil
 	}
 
@@ -128,22 +144,43 @@ func resourcePut(r *rest.Request) rest.Response {
 	return rest.OperationResponse(op)
 }
 
-func resourceDelete(r *rest.Request) rest.Response {
-	id := mux.Vars(r.HTTPRequest)["id"]
-	if len(id) == 0 {
+func resourcePatch(r *rest.Request, req *resourceRequest) rest.Response {
+	value, ok := resources[req.ID]
+	if !ok {
 		return rest.NotFoundError("Resource")
 	}
 
-	_, ok := resources[id]
+	if err := r.Patch(&value); err != nil {
+		return rest.SmartError(err)
+	}
+
+	updated := map[string][]string{}
+	updated["resources"] = []string{req.ID}
+
+	run := func(op *rest.Operation) error {
+		resources[req.ID] = value
+		return nil
+	}
+
+	op, err := r.CreateOperation("Patching resource", updated, nil, run, nil)
+	if err != nil {
+		return rest.SmartError(err)
+	}
+
+	return rest.OperationResponse(op)
+}
+
+func resourceDelete(r *rest.Request, req *resourceRequest) rest.Response {
+	_, ok := resources[req.ID]
 	if !ok {
 		return rest.NotFoundError("Resource")
 	}
 
 	deleted := map[string][]string{}
-	deleted["resources"] = []string{id}
+	deleted["resources"] = []string{req.ID}
 
 	run := func(op *rest.Operation) error {
-		delete(resources, id)
+		delete(resources, req.ID)
 		return nil
 	}
 
@@ -20,5 +20,5 @@
 package rest
 
 func eventsGet(r *Request) Response {
-	return &eventsResponse{req: r.HTTPRequest, events: r.daemon.events}
+	return &eventsResponse{req: r.HTTPRequest, events: r.daemon.events, canSee: r.canAccess}
 }
@@ -0,0 +1,65 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func openAPIJSONGet(r *Request) Response {
+	return &openAPIDocResponse{doc: r.daemon.openAPI(), format: "json"}
+}
+
+func openAPIYAMLGet(r *Request) Response {
+	return &openAPIDocResponse{doc: r.daemon.openAPI(), format: "yaml"}
+}
+
+// The OpenAPI document is rendered as is, with no response envelope,
+// so that it can be consumed directly by any OpenAPI tool
+type openAPIDocResponse struct {
+	doc    *openAPIDocument
+	format string
+}
+
+func (r *openAPIDocResponse) Render(w http.ResponseWriter) error {
+	var body []byte
+	var err error
+
+	if r.format == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+		body, err = yaml.Marshal(r.doc)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		body, err = json.MarshalIndent(r.doc, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+func (r *openAPIDocResponse) String() string {
+	return "openapi " + r.format
+}
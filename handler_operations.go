@@ -20,55 +20,226 @@
 package rest
 
 import (
+	"context"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/greenbrew/rest/api"
 )
 
+// operationsFilter selects the operations to list
+type operationsFilter struct {
+	statuses      []api.StatusCode
+	resource      string
+	description   string
+	createdAfter  time.Time
+	createdBefore time.Time
+}
+
+// parseOperationsFilter returns the filter given in the query of r. Operations
+// can be filtered by a comma separated list of statuses, a resource URL, part of
+// the description and the times they were created after or before, in RFC 3339
+func parseOperationsFilter(r *Request) (*operationsFilter, error) {
+	query := r.HTTPRequest.URL.Query()
+	verr := &ValidationError{}
+	f := &operationsFilter{
+		resource:    strings.Trim(query.Get("resource"), "/"),
+		description: strings.ToLower(query.Get("description")),
+	}
+
+	f.statuses = parseStatuses(query.Get("status"), verr)
+
+	times := []struct {
+		name string
+		t    *time.Time
+	}{{"created_after", &f.createdAfter}, {"created_before", &f.createdBefore}}
+	for _, p := range times {
+		v := query.Get(p.name)
+		if len(v) == 0 {
+			continue
+		}
+		var err error
+		*p.t, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			verr.add(p.name, "must be a RFC 3339 time")
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+	return f, nil
+}
+
+func (f *operationsFilter) matches(op *api.Operation) bool {
+	if len(f.statuses) > 0 {
+		found := false
+		for _, status := range f.statuses {
+			found = found || op.StatusCode == status
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.resource) > 0 {
+		found := false
+		for _, urls := range op.Resources {
+			for _, url := range urls {
+				found = found || strings.Trim(url, "/") == f.resource
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.description) > 0 && !strings.Contains(strings.ToLower(op.Description), f.description) {
+		return false
+	}
+	if !f.createdAfter.IsZero() && !op.CreatedAt.After(f.createdAfter) {
+		return false
+	}
+	if !f.createdBefore.IsZero() && !op.CreatedAt.Before(f.createdBefore) {
+		return false
+	}
+	return true
+}
+
 func operationsGet(r *Request) Response {
+	params, err := r.ListParams()
+	if err != nil {
+		return SmartError(err)
+	}
+
+	filter, err := parseOperationsFilter(r)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	// Operations are listed by creation time unless other order is requested.
+	// The ID ends the sort keys to identify the last one of every page
+	if len(params.Sort) == 0 {
+		params.Sort = []string{"created_at", "id"}
+	} else if key := params.Sort[len(params.Sort)-1]; strings.TrimPrefix(key, "-") != "id" {
+		params.Sort = append(params.Sort, "id")
+	}
+
+	urls := map[string]string{}
+	bodies := []*api.Operation{}
+	for _, op := range r.daemon.cache.getOperations() {
+		if !r.canAccess(op.owner) {
+			continue
+		}
+
+		url, body, err := op.Render()
+		if err != nil || !filter.matches(body) {
+			continue
+		}
+
+		urls[body.ID] = url
+		bodies = append(bodies, body)
+	}
+
+	page, err := params.Apply(bodies)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	// Grouped by status, keeping the requested order inside every group
 	md := jmap{}
 	recursion := r.IsRecursionRequest()
-	ops := r.daemon.cache.getOperationsMap()
-
-	for _, v := range ops {
-		status := strings.ToLower(v.status.String())
+	for _, body := range page.Items.([]*api.Operation) {
+		status := strings.ToLower(body.Status)
 		_, ok := md[status]
 		if !ok {
 			if recursion {
-				md[status] = make([]*api.Operation, 0)
+				md[status] = make([]interface{}, 0)
 			} else {
 				md[status] = make([]string, 0)
 			}
 		}
 
 		if !recursion {
-			md[status] = append(md[status].([]string), v.url)
+			md[status] = append(md[status].([]string), urls[body.ID])
 			continue
 		}
 
-		_, body, err := v.Render()
+		item, err := r.ShapeResource(body)
 		if err != nil {
-			continue
+			return InternalError(err)
 		}
-
-		md[status] = append(md[status].([]*api.Operation), body)
+		md[status] = append(md[status].([]interface{}), item)
 	}
 
-	return SyncResponse(true, md)
+	return PageResponse(r, md, page)
 }
 
 func operationGet(r *Request) Response {
+	body, err := operationExpand(r)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	item, err := r.ShapeResource(body)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	return SyncResponse(true, item)
+}
+
+// operationExpand returns the operation addressed by the request
+func operationExpand(r *Request) (interface{}, error) {
 	id := mux.Vars(r.HTTPRequest)["id"]
 
-	op, err := r.daemon.cache.getOperationByID(id)
+	op, err := r.operationByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, body, err := op.Render()
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// operationDelete cancels an operation
+func operationDelete(r *Request) Response {
+	id := mux.Vars(r.HTTPRequest)["id"]
+	op, err := r.operationByID(id)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if err := op.Cancel(); err != nil {
+		return BadRequest(err)
+	}
+	return EmptySyncResponse
+}
+
+func operationWaitGet(r *Request) Response {
+	ctx, cancel, statuses, err := operationWaitParams(r)
+	if err != nil {
+		return SmartError(err)
+	}
+	defer cancel()
+
+	id := mux.Vars(r.HTTPRequest)["id"]
+	op, err := r.operationByID(id)
 	if err != nil {
 		return SmartError(err)
 	}
 
-	var body *api.Operation
-	_, body, err = op.Render()
+	if err := op.Wait(ctx, statuses...); err != nil {
+		return operationWaitError(err)
+	}
+
+	_, body, err := op.Render()
 	if err != nil {
 		return SmartError(err)
 	}
@@ -76,32 +247,191 @@ func operationGet(r *Request) Response {
 	return SyncResponse(true, body)
 }
 
-func operationWaitGet(r *Request) Response {
-	var err error
-	timeout := -1
-	t := r.HTTPRequest.FormValue("timeout")
-	if len(t) > 0 {
-		timeout, err = strconv.Atoi(t)
+// operationLogsGet returns the output of an operation from the requested offset
+// on, following it until the operation is done if requested
+func operationLogsGet(r *Request) Response {
+	query := r.HTTPRequest.URL.Query()
+	verr := &ValidationError{}
+
+	var offset int64
+	if v := query.Get("offset"); len(v) > 0 {
+		var err error
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			verr.add("offset", "must be a positive number")
+		}
+	}
+
+	var follow bool
+	if v := query.Get("follow"); len(v) > 0 {
+		var err error
+		follow, err = strconv.ParseBool(v)
 		if err != nil {
-			return SmartError(err)
+			verr.add("follow", "must be a boolean")
 		}
 	}
 
+	if len(verr.Fields) > 0 {
+		return SmartError(verr)
+	}
+
 	id := mux.Vars(r.HTTPRequest)["id"]
-	op, err := r.daemon.cache.getOperationByID(id)
+	op, err := r.operationByID(id)
 	if err != nil {
 		return SmartError(err)
 	}
 
-	err = op.WaitFinal(timeout)
+	return &operationLogResponse{log: op.getLog(), offset: offset, follow: follow, ctx: r.Context()}
+}
+
+// operationsWaitGet waits for any or all of a set of operations, returning
+// them in the requested order
+func operationsWaitGet(r *Request) Response {
+	ctx, cancel, statuses, err := operationWaitParams(r)
 	if err != nil {
-		return InternalError(err)
+		return SmartError(err)
 	}
+	defer cancel()
 
-	_, body, err := op.Render()
+	query := r.HTTPRequest.URL.Query()
+	verr := &ValidationError{}
+	ids := []string{}
+	for _, v := range query["id"] {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); len(id) > 0 {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		verr.add("id", "is required")
+	}
+
+	mode := query.Get("mode")
+	if len(mode) == 0 {
+		mode = "all"
+	}
+	if mode != "all" && mode != "any" {
+		verr.add("mode", "must be one of: all, any")
+	}
+
+	if len(verr.Fields) > 0 {
+		return SmartError(verr)
+	}
+
+	ops := []*Operation{}
+	for _, id := range ids {
+		op, err := r.operationByID(id)
+		if err != nil {
+			return SmartError(err)
+		}
+		ops = append(ops, op)
+	}
+
+	if mode == "all" {
+		err = waitAllOperations(ctx, ops, statuses)
+	} else {
+		err = waitAnyOperation(ctx, ops, statuses)
+	}
 	if err != nil {
-		return SmartError(err)
+		return operationWaitError(err)
 	}
 
-	return SyncResponse(true, body)
+	bodies := []*api.Operation{}
+	for _, op := range ops {
+		_, body, err := op.Render()
+		if err != nil {
+			return SmartError(err)
+		}
+		bodies = append(bodies, body)
+	}
+
+	return SyncResponse(true, bodies)
+}
+
+func waitAllOperations(ctx context.Context, ops []*Operation, statuses []api.StatusCode) error {
+	for _, op := range ops {
+		if err := op.Wait(ctx, statuses...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waitAnyOperation(ctx context.Context, ops []*Operation, statuses []api.StatusCode) error {
+	// The rest of waits are given up once any of them ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, len(ops))
+	for _, op := range ops {
+		go func(op *Operation) {
+			errCh <- op.Wait(ctx, statuses...)
+		}(op)
+	}
+	return <-errCh
+}
+
+// operationWaitParams returns the context for a request waiting for
+// operations, done once the requested timeout elapses, and the statuses
+// to wait for. The timeout is given as a duration ("30s") or a number of
+// seconds, waiting until the request is given up if not set or -1
+func operationWaitParams(r *Request) (context.Context, context.CancelFunc, []api.StatusCode, error) {
+	query := r.HTTPRequest.URL.Query()
+	verr := &ValidationError{}
+
+	timeout := time.Duration(-1)
+	if v := query.Get("timeout"); len(v) > 0 && v != "-1" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+			timeout = time.Duration(seconds) * time.Second
+		} else if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			timeout = d
+		} else {
+			verr.add("timeout", "must be a duration or a number of seconds")
+		}
+	}
+
+	statuses := parseStatuses(query.Get("status"), verr)
+
+	if len(verr.Fields) > 0 {
+		return nil, nil, nil, verr
+	}
+
+	if timeout < 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, statuses, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, statuses, nil
+}
+
+// parseStatuses returns the statuses in the comma separated list of names,
+// adding an error to verr for the unknown ones
+func parseStatuses(names string, verr *ValidationError) []api.StatusCode {
+	statuses := []api.StatusCode{}
+	if len(names) == 0 {
+		return statuses
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		status, ok := api.ParseStatusCode(strings.TrimSpace(name))
+		if !ok {
+			verr.add("status", "has an unknown status %q", name)
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// operationWaitError returns the response for a wait given up with err
+func operationWaitError(err error) Response {
+	if err == context.DeadlineExceeded {
+		return &errorResponse{
+			code:    http.StatusGatewayTimeout,
+			msg:     "Timeout waiting for operations",
+			errCode: "wait_timeout",
+		}
+	}
+	return SmartError(err)
 }
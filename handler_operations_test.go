@@ -0,0 +1,490 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	check "gopkg.in/check.v1"
+
+	"github.com/greenbrew/rest/api"
+)
+
+type handlerOperationsSuite struct {
+	d *Service
+}
+
+var _ = check.Suite(&handlerOperationsSuite{})
+
+func (s *handlerOperationsSuite) SetUpTest(c *check.C) {
+	s.d = &Service{}
+	s.d.Init(nil)
+}
+
+// startOperation starts an operation running until release is closed
+func (s *handlerOperationsSuite) startOperation(c *check.C, release chan struct{}) *Operation {
+	r := &Request{HTTPRequest: httptest.NewRequest("POST", "/1.0/things", nil), daemon: s.d, version: api.Version}
+	op, err := r.CreateOperation("Creating thing", nil, nil, func(*Operation) error {
+		<-release
+		return nil
+	}, nil)
+	c.Assert(err, check.IsNil)
+	return op
+}
+
+func (s *handlerOperationsSuite) get(c *check.C, url string) (int, *api.Response) {
+	w := httptest.NewRecorder()
+	s.d.Router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+
+	resp := &api.Response{}
+	err := json.Unmarshal(w.Body.Bytes(), resp)
+	c.Assert(err, check.IsNil)
+	return w.Code, resp
+}
+
+func (s *handlerOperationsSuite) TestWaitStatus(c *check.C) {
+	release := make(chan struct{})
+	defer close(release)
+	op := s.startOperation(c, release)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Check(op.Run(), check.IsNil)
+	}()
+
+	code, resp := s.get(c, "/1.0/operations/"+op.id+"/wait?status=running&timeout=5s")
+	c.Assert(code, check.Equals, http.StatusOK)
+	md, err := resp.MetadataAsOperation()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.StatusCode, check.Equals, api.Running)
+
+	// Not done in time
+	code, resp = s.get(c, "/1.0/operations/"+op.id+"/wait?timeout=10ms")
+	c.Assert(code, check.Equals, http.StatusGatewayTimeout)
+	details := api.ErrorDetails{}
+	err = resp.MetadataAsStruct(&details)
+	c.Assert(err, check.IsNil)
+	c.Assert(details.Code, check.Equals, "wait_timeout")
+
+	code, resp = s.get(c, "/1.0/operations/"+op.id+"/wait?timeout=soon&status=done")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+	c.Assert(resp.Error, check.Equals, `Invalid request: timeout must be a duration or a number of seconds; status has an unknown status "done"`)
+}
+
+func (s *handlerOperationsSuite) TestWaitDone(c *check.C) {
+	release := make(chan struct{})
+	op := s.startOperation(c, release)
+	c.Assert(op.Run(), check.IsNil)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+
+	code, resp := s.get(c, "/1.0/operations/"+op.id+"/wait?timeout=5")
+	c.Assert(code, check.Equals, http.StatusOK)
+	md, err := resp.MetadataAsOperation()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.StatusCode, check.Equals, api.Success)
+}
+
+func (s *handlerOperationsSuite) TestWaitMultiple(c *check.C) {
+	release1, release2 := make(chan struct{}), make(chan struct{})
+	op1, op2 := s.startOperation(c, release1), s.startOperation(c, release2)
+	c.Assert(op1.Run(), check.IsNil)
+	c.Assert(op2.Run(), check.IsNil)
+	defer close(release2)
+
+	// Waiting for all does not end while any is running
+	close(release1)
+	url := "/1.0/operations/wait?id=" + op1.id + "," + op2.id
+	code, _ := s.get(c, url+"&timeout=50ms")
+	c.Assert(code, check.Equals, http.StatusGatewayTimeout)
+
+	code, resp := s.get(c, url+"&mode=any&timeout=5s")
+	c.Assert(code, check.Equals, http.StatusOK)
+	ops := []api.Operation{}
+	err := resp.MetadataAsStruct(&ops)
+	c.Assert(err, check.IsNil)
+	c.Assert(ops, check.HasLen, 2)
+	c.Assert(ops[0].ID, check.Equals, op1.id)
+	c.Assert(ops[0].StatusCode, check.Equals, api.Success)
+	c.Assert(ops[1].ID, check.Equals, op2.id)
+	c.Assert(ops[1].StatusCode, check.Equals, api.Running)
+
+	code, resp = s.get(c, "/1.0/operations/wait?mode=some")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+	c.Assert(resp.Error, check.Equals, "Invalid request: id is required; mode must be one of: all, any")
+}
+
+func (s *handlerOperationsSuite) TestListFilters(c *check.C) {
+	release := make(chan struct{})
+	defer close(release)
+
+	newOp := func(description string, resources map[string][]string) *Operation {
+		r := &Request{HTTPRequest: httptest.NewRequest("POST", "/1.0/things", nil), daemon: s.d, version: api.Version}
+		op, err := r.CreateOperation(description, resources, nil, func(*Operation) error {
+			<-release
+			return nil
+		}, nil)
+		c.Assert(err, check.IsNil)
+		return op
+	}
+
+	op1 := newOp("Creating thing", map[string][]string{"things": {"abc"}})
+	c.Assert(op1.Run(), check.IsNil)
+	middle := time.Now()
+	time.Sleep(time.Millisecond)
+	op2 := newOp("Deleting thing", map[string][]string{"things": {"def"}})
+
+	list := func(query string) []string {
+		code, resp := s.get(c, "/1.0/operations?recursion=1&"+query)
+		c.Assert(code, check.Equals, http.StatusOK)
+		md := map[string][]api.Operation{}
+		err := resp.MetadataAsStruct(&md)
+		c.Assert(err, check.IsNil)
+
+		ids := []string{}
+		for _, status := range []string{"running", "pending"} {
+			for _, op := range md[status] {
+				ids = append(ids, op.ID)
+			}
+		}
+		return ids
+	}
+
+	c.Assert(list(""), check.DeepEquals, []string{op1.id, op2.id})
+	c.Assert(list("status=running"), check.DeepEquals, []string{op1.id})
+	c.Assert(list("status=Pending,Success"), check.DeepEquals, []string{op2.id})
+	c.Assert(list("resource=/1.0/things/def"), check.DeepEquals, []string{op2.id})
+	c.Assert(list("description=CREATING"), check.DeepEquals, []string{op1.id})
+	c.Assert(list("created_after="+middle.Format(time.RFC3339Nano)), check.DeepEquals, []string{op2.id})
+	c.Assert(list("created_before="+middle.Format(time.RFC3339Nano)), check.DeepEquals, []string{op1.id})
+
+	code, resp := s.get(c, "/1.0/operations?status=done&created_after=yesterday")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+	c.Assert(resp.Error, check.Equals, `Invalid request: status has an unknown status "done"; created_after must be a RFC 3339 time`)
+}
+
+func (s *handlerOperationsSuite) TestLogs(c *check.C) {
+	release := make(chan struct{})
+	op := s.startOperation(c, release)
+	op.Logf("first")
+	fmt.Fprintf(op.LogWriter(), "second\n")
+
+	w := httptest.NewRecorder()
+	s.d.Router.ServeHTTP(w, httptest.NewRequest("GET", "/1.0/operations/"+op.id+"/logs?offset=6", nil))
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(w.Header().Get(api.LogOffsetHeader), check.Equals, "6")
+	c.Assert(w.Header().Get(api.LogCompleteHeader), check.Equals, "")
+	c.Assert(w.Body.String(), check.Equals, "second\n")
+
+	// Following ends once the operation is done
+	c.Assert(op.Run(), check.IsNil)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		op.Logf("third")
+		close(release)
+	}()
+
+	w = httptest.NewRecorder()
+	s.d.Router.ServeHTTP(w, httptest.NewRequest("GET", "/1.0/operations/"+op.id+"/logs?follow=true", nil))
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(w.Header().Get(api.LogOffsetHeader), check.Equals, "0")
+	c.Assert(w.Body.String(), check.Equals, "first\nsecond\nthird\n")
+
+	w = httptest.NewRecorder()
+	s.d.Router.ServeHTTP(w, httptest.NewRequest("GET", "/1.0/operations/"+op.id+"/logs?offset=13", nil))
+	c.Assert(w.Header().Get(api.LogCompleteHeader), check.Equals, "true")
+	c.Assert(w.Body.String(), check.Equals, "third\n")
+
+	code, resp := s.get(c, "/1.0/operations/"+op.id+"/logs?offset=-1&follow=always")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+	c.Assert(resp.Error, check.Equals, "Invalid request: offset must be a positive number; follow must be a boolean")
+}
+
+func (s *handlerOperationsSuite) TestLogsTrimmed(c *check.C) {
+	l := newOperationLog()
+	_, err := l.Write(make([]byte, maxOperationLogSize+10))
+	c.Assert(err, check.IsNil)
+
+	data, start, end, closed, _ := l.read(0)
+	c.Assert(len(data), check.Equals, maxOperationLogSize)
+	c.Assert(start, check.Equals, int64(10))
+	c.Assert(end, check.Equals, int64(maxOperationLogSize+10))
+	c.Assert(closed, check.Equals, false)
+
+	// Writes add to the output kept until the limit
+	for i := 0; i < 3; i++ {
+		_, err = l.Write(bytes.Repeat([]byte{byte('a' + i)}, operationLogChunkSize/2+1))
+		c.Assert(err, check.IsNil)
+	}
+	data, start, end, _, _ = l.read(0)
+	c.Assert(len(data), check.Equals, maxOperationLogSize)
+	c.Assert(end, check.Equals, int64(maxOperationLogSize+10+3*(operationLogChunkSize/2+1)))
+	c.Assert(start, check.Equals, end-maxOperationLogSize)
+	c.Assert(string(data[len(data)-3*(operationLogChunkSize/2+1):]), check.Equals,
+		strings.Repeat("a", operationLogChunkSize/2+1)+strings.Repeat("b", operationLogChunkSize/2+1)+strings.Repeat("c", operationLogChunkSize/2+1))
+
+	data, start, _, _, _ = l.read(end - 3)
+	c.Assert(string(data), check.Equals, "ccc")
+	c.Assert(start, check.Equals, end-3)
+
+	l.close()
+	_, err = l.Write([]byte("late"))
+	c.Assert(err, check.Equals, errOperationLogClosed)
+}
+
+// flushHookRecorder calls onFlush the first time the response is flushed
+type flushHookRecorder struct {
+	*httptest.ResponseRecorder
+	onFlush func()
+}
+
+func (w *flushHookRecorder) Flush() {
+	if w.onFlush != nil {
+		w.onFlush()
+		w.onFlush = nil
+	}
+	w.ResponseRecorder.Flush()
+}
+
+func (s *handlerOperationsSuite) TestLogsFollowEndsWhenDiscarded(c *check.C) {
+	l := newOperationLog()
+	l.Write([]byte("first\n"))
+
+	// Following stops once output not sent yet is discarded
+	w := &flushHookRecorder{ResponseRecorder: httptest.NewRecorder(), onFlush: func() {
+		l.Write(make([]byte, maxOperationLogSize+4))
+	}}
+	resp := &operationLogResponse{log: l, follow: true, ctx: context.Background()}
+	c.Assert(resp.Render(w), check.IsNil)
+	c.Assert(w.Header().Get(api.LogOffsetHeader), check.Equals, "0")
+	c.Assert(w.Body.String(), check.Equals, "first\n")
+
+	// Requested again, it starts where the output kept does
+	w = &flushHookRecorder{ResponseRecorder: httptest.NewRecorder()}
+	resp = &operationLogResponse{log: l, offset: 6, ctx: context.Background()}
+	c.Assert(resp.Render(w), check.IsNil)
+	c.Assert(w.Header().Get(api.LogOffsetHeader), check.Equals, "10")
+	c.Assert(w.Body.Len(), check.Equals, maxOperationLogSize)
+}
+
+func (s *handlerOperationsSuite) TestResult(c *check.C) {
+	r := &Request{HTTPRequest: httptest.NewRequest("POST", "/1.0/things", nil), daemon: s.d, version: api.Version}
+	op, err := r.CreateOperation("Counting things", nil, nil, WithResult(func(*Operation) (interface{}, error) {
+		return map[string]int{"count": 3}, nil
+	}), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(op.Run(), check.IsNil)
+
+	code, resp := s.get(c, "/1.0/operations/"+op.id+"/wait?timeout=5s")
+	c.Assert(code, check.Equals, http.StatusOK)
+	md, err := resp.MetadataAsOperation()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.StatusCode, check.Equals, api.Success)
+	result := map[string]int{}
+	c.Assert(md.ResultAsStruct(&result), check.IsNil)
+	c.Assert(result, check.DeepEquals, map[string]int{"count": 3})
+
+	// Results which cannot be served fail the operation
+	op, err = r.CreateOperation("Counting things", nil, nil, WithResult(func(*Operation) (interface{}, error) {
+		return make(chan int), nil
+	}), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(op.Run(), check.IsNil)
+
+	code, resp = s.get(c, "/1.0/operations/"+op.id+"/wait?timeout=5s")
+	c.Assert(code, check.Equals, http.StatusOK)
+	md, err = resp.MetadataAsOperation()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.StatusCode, check.Equals, api.Failure)
+	c.Assert(md.ResultAsStruct(&result), check.Equals, api.ErrNoResult)
+}
+
+func (s *handlerOperationsSuite) TestChildren(c *check.C) {
+	release, created := make(chan struct{}), make(chan struct{})
+	var children []*Operation
+	r := &Request{HTTPRequest: httptest.NewRequest("POST", "/1.0/things", nil), daemon: s.d, version: api.Version}
+	op, err := r.CreateOperation("Deleting things", nil, nil, func(op *Operation) error {
+		for i := 0; i < 2; i++ {
+			child, err := op.CreateChild("Deleting thing", nil, nil, func(*Operation) error {
+				<-release
+				return nil
+			}, nil)
+			if err != nil {
+				return err
+			}
+			children = append(children, child)
+		}
+		close(created)
+		return nil
+	}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(op.Run(), check.IsNil)
+	<-created
+
+	// The parent runs while its children do
+	code, resp := s.get(c, "/1.0/operations/"+op.id+"/wait?status=running&timeout=5s")
+	c.Assert(code, check.Equals, http.StatusOK)
+	md, err := resp.MetadataAsOperation()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.StatusCode, check.Equals, api.Running)
+	c.Assert(md.Children, check.HasLen, 2)
+	c.Assert(md.Children[0].ID, check.Equals, children[0].id)
+	c.Assert(md.Children[0].ParentID, check.Equals, op.id)
+	c.Assert(md.Metadata["children"], check.DeepEquals, map[string]interface{}{"Running": 2.0})
+
+	children[0].SetProgress(50)
+	_, md, err = op.Render()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.Metadata["progress"], check.Equals, 25)
+
+	close(release)
+	code, resp = s.get(c, "/1.0/operations/"+op.id+"/wait?timeout=5s")
+	c.Assert(code, check.Equals, http.StatusOK)
+	md, err = resp.MetadataAsOperation()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.StatusCode, check.Equals, api.Success)
+	c.Assert(md.Metadata["progress"], check.Equals, 100.0)
+	c.Assert(md.Metadata["children"], check.DeepEquals, map[string]interface{}{"Success": 2.0})
+}
+
+func (s *handlerOperationsSuite) TestChildrenFail(c *check.C) {
+	r := &Request{HTTPRequest: httptest.NewRequest("POST", "/1.0/things", nil), daemon: s.d, version: api.Version}
+	op, err := r.CreateOperation("Deleting things", nil, nil, func(op *Operation) error {
+		_, err := op.CreateChild("Deleting thing", nil, nil, func(*Operation) error {
+			return nil
+		}, nil)
+		if err != nil {
+			return err
+		}
+		_, err = op.CreateChild("Deleting thing", nil, nil, func(*Operation) error {
+			return errors.New("Thing is in use")
+		}, nil)
+		return err
+	}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(op.Run(), check.IsNil)
+
+	c.Assert(op.Wait(context.Background()), check.IsNil)
+	_, md, err := op.Render()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.StatusCode, check.Equals, api.Failure)
+	c.Assert(md.Err, check.Equals, "1 of 2 child operations did not succeed")
+	c.Assert(md.Children[1].Err, check.Equals, "Thing is in use")
+}
+
+func (s *handlerOperationsSuite) TestChildrenCancel(c *check.C) {
+	ready := make(chan *Operation)
+	r := &Request{HTTPRequest: httptest.NewRequest("POST", "/1.0/things", nil), daemon: s.d, version: api.Version}
+	op, err := r.CreateOperation("Deleting things", nil, nil, func(op *Operation) error {
+		child, err := op.CreateChild("Deleting thing", nil, nil, func(child *Operation) error {
+			<-child.doneCh
+			return nil
+		}, nil)
+		ready <- child
+		return err
+	}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(op.Run(), check.IsNil)
+	child := <-ready
+
+	c.Assert(op.Cancel(), check.IsNil)
+	c.Assert(op.Wait(context.Background()), check.IsNil)
+	c.Assert(child.getStatus(), check.Equals, api.Cancelled)
+	c.Assert(op.getStatus(), check.Equals, api.Cancelled)
+
+	_, err = op.CreateChild("Deleting thing", nil, nil, nil, nil)
+	c.Assert(err, check.ErrorMatches, "Only running operations can have children")
+}
+
+// callerRequest returns a request sent by a client with a certificate
+// identified by name, or by a local one if it is "unix"
+func callerRequest(method, url, name string) *http.Request {
+	r := httptest.NewRequest(method, url, nil)
+	if name == "unix" {
+		r.RemoteAddr = "@"
+	} else {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: []byte(name)}}}
+	}
+	return r
+}
+
+func (s *handlerOperationsSuite) TestAccess(c *check.C) {
+	s.d.OperationPolicy = OwnerPolicy("unix")
+
+	release := make(chan struct{})
+	defer close(release)
+	r := &Request{HTTPRequest: callerRequest("POST", "/1.0/things", "alice"), daemon: s.d, version: api.Version}
+	op, err := r.CreateOperation("Creating thing", nil, nil, func(*Operation) error {
+		<-release
+		return nil
+	}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(op.Run(), check.IsNil)
+
+	serve := func(method, url, caller string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.d.Router.ServeHTTP(w, callerRequest(method, url, caller))
+		return w
+	}
+
+	// Only the owner and the privileged callers can see it
+	w := serve("GET", "/1.0/operations/"+op.id, "alice")
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	resp := &api.Response{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), resp), check.IsNil)
+	md, err := resp.MetadataAsOperation()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.Owner, check.Equals, r.Caller())
+	c.Assert(serve("GET", "/1.0/operations/"+op.id, "unix").Code, check.Equals, http.StatusOK)
+	c.Assert(serve("GET", "/1.0/operations/"+op.id, "bob").Code, check.Equals, http.StatusNotFound)
+	c.Assert(serve("GET", "/1.0/operations/"+op.id+"/wait?timeout=0", "bob").Code, check.Equals, http.StatusNotFound)
+	c.Assert(serve("GET", "/1.0/operations/"+op.id+"/logs", "bob").Code, check.Equals, http.StatusNotFound)
+
+	w = serve("GET", "/1.0/operations", "bob")
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(w.Body.Bytes(), resp), check.IsNil)
+	list, err := resp.MetadataAsMap()
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 0)
+
+	// Neither can others cancel it
+	c.Assert(serve("DELETE", "/1.0/operations/"+op.id, "bob").Code, check.Equals, http.StatusNotFound)
+	c.Assert(serve("DELETE", "/1.0/operations/"+op.id, "alice").Code, check.Equals, http.StatusOK)
+	c.Assert(op.getStatus(), check.Equals, api.Cancelled)
+	c.Assert(serve("DELETE", "/1.0/operations/"+op.id, "alice").Code, check.Equals, http.StatusBadRequest)
+
+	// Nor receive its events
+	bob := &Request{HTTPRequest: callerRequest("GET", "/1.0/events", "bob"), daemon: s.d}
+	c.Assert(bob.canAccess(op.owner), check.Equals, false)
+	c.Assert(bob.canAccess(bob.Caller()), check.Equals, true)
+}
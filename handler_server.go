@@ -0,0 +1,115 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"github.com/greenbrew/rest/api"
+	"github.com/greenbrew/rest/cert"
+	"github.com/greenbrew/rest/logger"
+	"github.com/greenbrew/rest/system"
+)
+
+func serverGet(r *Request) Response {
+	d := r.daemon
+
+	server := &api.Server{
+		ServerVersion: serverVersion(),
+		APIVersions:   d.apiVersions(),
+		Endpoints:     []string{},
+		AuthMethods:   d.authMethods(),
+		APIExtensions: d.apiExtensions(),
+	}
+
+	if len(d.UnixSocketPath) > 0 {
+		server.Endpoints = append(server.Endpoints, "unix")
+	}
+
+	if len(d.Host) > 0 || d.Port > 0 {
+		server.Endpoints = append(server.Endpoints, d.schema)
+
+		if d.tlsEnabled() {
+			fingerprint, err := serverCertificateFingerprint(d.ServerCertPath)
+			if err != nil {
+				logger.Errorf("Could not get server certificate fingerprint: %v", err)
+			}
+			server.CertificateFingerprint = fingerprint
+		}
+	}
+
+	return SyncResponseETag(true, server, server)
+}
+
+// authMethods returns the ways callers can be authenticated: through the
+// unix socket, by a certificate signed by the CA, and by the authenticators
+// of the service and its commands
+func (d *Service) authMethods() []string {
+	methods := []string{}
+	seen := map[string]bool{}
+	add := func(method string) {
+		if len(method) > 0 && !seen[method] {
+			seen[method] = true
+			methods = append(methods, method)
+		}
+	}
+
+	if len(d.UnixSocketPath) > 0 {
+		add("unix")
+	}
+	if (len(d.Host) > 0 || d.Port > 0) && d.tlsEnabled() && system.PathExists(d.CAPath) {
+		add("tls")
+	}
+
+	authenticators := append([]Authenticator{}, d.Authenticators...)
+	for _, api := range d.apis {
+		for _, c := range api.Commands {
+			authenticators = append(authenticators, c.Authenticators...)
+		}
+	}
+	for _, a := range authenticators {
+		switch a.(type) {
+		case *UnixAuthenticator:
+			add("unix")
+		case *TLSAuthenticator:
+			add("tls")
+		case *TokenAuthenticator:
+			add("token")
+		}
+	}
+	return methods
+}
+
+func versionGet(r *Request) Response {
+	return SyncResponse(true, serverVersion())
+}
+
+func serverVersion() api.ServerVersion {
+	return api.ServerVersion{
+		FrameworkVersion: api.FrameworkVersion,
+		APIVersion:       api.Version,
+	}
+}
+
+func serverCertificateFingerprint(certPath string) (string, error) {
+	c, err := cert.Read(certPath)
+	if err != nil {
+		return "", err
+	}
+	return cert.Fingerprint(c), nil
+}
@@ -0,0 +1,66 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// headWriter is used to attend HEAD requests by running the GET handler.
+// It discards the content written to the response but counts it, so that
+// the headers sent, including Content-Length, are the same a GET would get
+type headWriter struct {
+	w      http.ResponseWriter
+	status int
+	length int
+}
+
+func (h *headWriter) Header() http.Header {
+	return h.w.Header()
+}
+
+func (h *headWriter) WriteHeader(status int) {
+	if h.status == 0 {
+		h.status = status
+	}
+}
+
+func (h *headWriter) Write(b []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	h.length += len(b)
+	return len(b), nil
+}
+
+// finish sends the headers once the whole response has been rendered
+func (h *headWriter) finish() {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+
+	// Responses without content must not announce its length
+	noContent := h.status == http.StatusNoContent || h.status == http.StatusNotModified
+	if !noContent && len(h.w.Header().Get("Content-Length")) == 0 {
+		h.w.Header().Set("Content-Length", strconv.Itoa(h.length))
+	}
+	h.w.WriteHeader(h.status)
+}
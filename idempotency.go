@@ -0,0 +1,313 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/greenbrew/rest/api"
+)
+
+// DefaultIdempotencyWindow is how long responses to requests with an
+// idempotency key are kept if the service does not set another window
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// DefaultIdempotencyMaxEntries is the most responses to requests with an
+// idempotency key kept if the service does not set another limit
+const DefaultIdempotencyMaxEntries = 10000
+
+// Largest body of the requests with an idempotency key
+const maxIdempotentBodySize = 1 << 20
+
+// Header set in the responses replayed for requests with a known idempotency key
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+var (
+	idempotencyKeyInvalid = &errorResponse{
+		code:    http.StatusBadRequest,
+		msg:     "Invalid idempotency key",
+		errCode: "invalid_idempotency_key",
+	}
+	idempotencyKeyReused = &errorResponse{
+		code:    http.StatusUnprocessableEntity,
+		msg:     "Idempotency key already used for a different request",
+		errCode: "idempotency_key_reused",
+	}
+	idempotencyKeyInProgress = &errorResponse{
+		code:    http.StatusConflict,
+		msg:     "A request with the same idempotency key is in progress",
+		errCode: "idempotency_key_in_progress",
+	}
+	idempotencyKeysExhausted = &errorResponse{
+		code:    http.StatusServiceUnavailable,
+		msg:     "Too many requests with an idempotency key in progress",
+		errCode: "idempotency_keys_exhausted",
+	}
+	idempotentBodyTooLarge = &errorResponse{
+		code:    http.StatusRequestEntityTooLarge,
+		msg:     "Request body too large for an idempotency key",
+		errCode: "request_too_large",
+	}
+)
+
+// idempotencyEntry is the response given to the first request with a key
+type idempotencyEntry struct {
+	key         string
+	fingerprint string
+	expires     time.Time
+
+	// Position in the expiration order once done
+	elem *list.Element
+
+	// Set once the response is recorded. Until then the request is in progress
+	done   bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyStore keeps the responses of the requests with an idempotency
+// key, indexed by key. As the window is the same for all of them, the ones
+// recorded are listed in the order they expire
+type idempotencyStore struct {
+	entries    map[string]*idempotencyEntry
+	expiration *list.List
+	window     time.Duration
+	maxEntries int
+	mux        sync.Mutex
+}
+
+func newIdempotencyStore(window time.Duration, maxEntries int) *idempotencyStore {
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultIdempotencyMaxEntries
+	}
+	return &idempotencyStore{
+		entries:    map[string]*idempotencyEntry{},
+		expiration: list.New(),
+		window:     window,
+		maxEntries: maxEntries,
+	}
+}
+
+// remove drops the recorded entry e
+func (s *idempotencyStore) remove(e *idempotencyEntry) {
+	s.expiration.Remove(e.elem)
+	delete(s.entries, e.key)
+}
+
+// begin returns the recorded entry for the key, if the request is a replay,
+// or registers a new one in progress otherwise. Requests whose key is in use
+// are answered with an error response
+func (s *idempotencyStore) begin(key, fingerprint string) (*idempotencyEntry, Response) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := time.Now()
+	for elem := s.expiration.Front(); elem != nil; elem = s.expiration.Front() {
+		e := elem.Value.(*idempotencyEntry)
+		if !now.After(e.expires) {
+			break
+		}
+		s.remove(e)
+	}
+
+	if e, ok := s.entries[key]; ok {
+		if e.fingerprint != fingerprint {
+			return nil, idempotencyKeyReused
+		}
+		if !e.done {
+			return nil, idempotencyKeyInProgress
+		}
+		return e, nil
+	}
+
+	// Room is made dropping the entry closer to expire
+	if len(s.entries) >= s.maxEntries {
+		elem := s.expiration.Front()
+		if elem == nil {
+			return nil, idempotencyKeysExhausted
+		}
+		s.remove(elem.Value.(*idempotencyEntry))
+	}
+
+	s.entries[key] = &idempotencyEntry{key: key, fingerprint: fingerprint}
+	return nil, nil
+}
+
+// finish records the response to the request with the key. Server errors and
+// requests not answered are not kept, so that the request can be retried. The
+// operation created for the request, if any, is kept as long as the response
+func (s *idempotencyStore) finish(key string, w *recordingWriter, op *Operation) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return
+	}
+
+	if w == nil || w.status == 0 || w.status >= http.StatusInternalServerError {
+		delete(s.entries, key)
+		return
+	}
+
+	e.done = true
+	e.expires = time.Now().Add(s.window)
+	e.status = w.status
+	e.header = w.Header().Clone()
+	e.body = w.body.Bytes()
+	e.elem = s.expiration.PushBack(e)
+
+	if op != nil {
+		op.retainUntil(e.expires)
+	}
+}
+
+// replay writes the recorded response. The request ID is kept as the one of
+// the current request
+func (e *idempotencyEntry) replay(w http.ResponseWriter) {
+	for k, v := range e.header {
+		if k == api.RequestIDHeader {
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// recordingWriter keeps a copy of the response written through it
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// requestFingerprint identifies the method, URL and body of r. The body,
+// hashed as it is read, is left for the handlers to read it. Bodies larger
+// than maxIdempotentBodySize are answered with an error response
+func requestFingerprint(w http.ResponseWriter, r *http.Request) (string, Response) {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+
+	if r.Body != nil {
+		body := &bytes.Buffer{}
+		limited := http.MaxBytesReader(w, r.Body, maxIdempotentBodySize)
+		_, err := io.Copy(io.MultiWriter(h, body), limited)
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return "", idempotentBodyTooLarge
+		}
+		if err != nil {
+			return "", BadRequest(err)
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(body)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// withIdempotency replays the response given to the first request with the
+// same idempotency key, instead of attending the request again with next.
+// Requests with safe methods are always attended
+func (d *Service) withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(api.IdempotencyKeyHeader)
+		if len(key) == 0 || d.idempotency == nil || isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !validIdentifier(key) {
+			renderResponse(w, r, idempotencyKeyInvalid)
+			return
+		}
+
+		fingerprint, resp := requestFingerprint(w, r)
+		if resp != nil {
+			renderResponse(w, r, resp)
+			return
+		}
+
+		// Keys of different callers never match
+		key = requestCaller(r) + " " + key
+
+		e, resp := d.idempotency.begin(key, fingerprint)
+		if resp != nil {
+			renderResponse(w, r, resp)
+			return
+		}
+		if e != nil {
+			e.replay(w)
+			return
+		}
+
+		// The key is released if the request is aborted. If the handler
+		// was given up, not before it returns, as it could still succeed
+		var rec *recordingWriter
+		tracker := &requestTracker{}
+		defer func() {
+			if tracker.finished == nil {
+				d.idempotency.finish(key, rec, tracker.op)
+				return
+			}
+			go func(rec *recordingWriter) {
+				<-tracker.finished
+				d.idempotency.finish(key, rec, tracker.op)
+			}(rec)
+		}()
+
+		recording := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(recording, r.WithContext(context.WithValue(r.Context(), requestTrackerKey, tracker)))
+		rec = recording
+	})
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
@@ -0,0 +1,250 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	check "gopkg.in/check.v1"
+
+	"github.com/greenbrew/rest/api"
+)
+
+type idempotencySuite struct{}
+
+var _ = check.Suite(&idempotencySuite{})
+
+func newIdempotencyService(window time.Duration, post handlerFunc) *Service {
+	d := &Service{IdempotencyWindow: window}
+	d.Init([]*API{{Version: "0.9", Commands: []*Command{{Name: "things", POST: post}}}})
+	return d
+}
+
+func postThing(d *Service, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/0.9/things", strings.NewReader(body))
+	if len(key) > 0 {
+		req.Header.Set(api.IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	d.Router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *idempotencySuite) TestReplay(c *check.C) {
+	calls := 0
+	d := newIdempotencyService(0, func(r *Request) Response {
+		calls++
+		return SyncResponse(true, calls)
+	})
+
+	w := postThing(d, "abc", `{"name": "foo"}`)
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(calls, check.Equals, 1)
+	first := w.Body.String()
+
+	// The same request is answered with the original response
+	w = postThing(d, "abc", `{"name": "foo"}`)
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(w.Body.String(), check.Equals, first)
+	c.Assert(w.Header().Get("Idempotent-Replayed"), check.Equals, "true")
+	c.Assert(w.Header().Get("Content-Type"), check.Equals, "application/json")
+	c.Assert(calls, check.Equals, 1)
+
+	// A different one reusing the key is rejected
+	w = postThing(d, "abc", `{"name": "bar"}`)
+	c.Assert(w.Code, check.Equals, http.StatusUnprocessableEntity)
+	resp := api.Response{}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	c.Assert(err, check.IsNil)
+	details := api.ErrorDetails{}
+	err = resp.MetadataAsStruct(&details)
+	c.Assert(err, check.IsNil)
+	c.Assert(details.Code, check.Equals, "idempotency_key_reused")
+	c.Assert(calls, check.Equals, 1)
+
+	// Requests without key or with a new one are attended
+	postThing(d, "", `{"name": "foo"}`)
+	c.Assert(calls, check.Equals, 2)
+	postThing(d, "def", `{"name": "foo"}`)
+	c.Assert(calls, check.Equals, 3)
+
+	w = postThing(d, "a b", `{"name": "foo"}`)
+	c.Assert(w.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(calls, check.Equals, 3)
+}
+
+func (s *idempotencySuite) TestServerErrorsNotKept(c *check.C) {
+	calls := 0
+	d := newIdempotencyService(0, func(r *Request) Response {
+		calls++
+		if calls == 1 {
+			return InternalError(errors.New("Cannot create thing"))
+		}
+		return EmptySyncResponse
+	})
+
+	w := postThing(d, "abc", `{}`)
+	c.Assert(w.Code, check.Equals, http.StatusInternalServerError)
+	w = postThing(d, "abc", `{}`)
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(calls, check.Equals, 2)
+}
+
+func (s *idempotencySuite) TestTimeoutThenRetry(c *check.C) {
+	var calls int32
+	release := make(chan struct{})
+	d := &Service{HandlerTimeout: 50 * time.Millisecond}
+	d.Init([]*API{{Version: "0.9", Commands: []*Command{{Name: "things", POST: func(r *Request) Response {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return EmptySyncResponse
+	}}}}})
+
+	w := postThing(d, "abc", `{}`)
+	c.Assert(w.Code, check.Equals, http.StatusGatewayTimeout)
+
+	// The handler given up is still running
+	w = postThing(d, "abc", `{}`)
+	c.Assert(w.Code, check.Equals, http.StatusConflict)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+
+	// The key is released once it returns
+	close(release)
+	for i := 0; i < 100; i++ {
+		if w = postThing(d, "abc", `{}`); w.Code != http.StatusConflict {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(2))
+}
+
+func (s *idempotencySuite) TestWindow(c *check.C) {
+	calls := 0
+	d := newIdempotencyService(time.Millisecond, func(r *Request) Response {
+		calls++
+		return EmptySyncResponse
+	})
+
+	postThing(d, "abc", `{}`)
+	time.Sleep(5 * time.Millisecond)
+	postThing(d, "abc", `{}`)
+	c.Assert(calls, check.Equals, 2)
+}
+
+func (s *idempotencySuite) TestInProgress(c *check.C) {
+	store := newIdempotencyStore(0, 0)
+	e, resp := store.begin("abc", "fingerprint")
+	c.Assert(e, check.IsNil)
+	c.Assert(resp, check.IsNil)
+
+	_, resp = store.begin("abc", "fingerprint")
+	c.Assert(resp, check.Equals, idempotencyKeyInProgress)
+}
+
+func (s *idempotencySuite) TestMaxEntries(c *check.C) {
+	store := newIdempotencyStore(0, 2)
+	_, resp := store.begin("a", "fingerprint")
+	c.Assert(resp, check.IsNil)
+	_, resp = store.begin("b", "fingerprint")
+	c.Assert(resp, check.IsNil)
+
+	// No room while all the requests are in progress
+	_, resp = store.begin("c", "fingerprint")
+	c.Assert(resp, check.Equals, idempotencyKeysExhausted)
+
+	// The response closer to expire is dropped to make room
+	rec := &recordingWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	store.finish("a", rec, nil)
+	_, resp = store.begin("c", "fingerprint")
+	c.Assert(resp, check.IsNil)
+
+	e, resp := store.begin("a", "fingerprint")
+	c.Assert(e, check.IsNil)
+	c.Assert(resp, check.Equals, idempotencyKeysExhausted)
+}
+
+func (s *idempotencySuite) TestBodyTooLarge(c *check.C) {
+	calls := 0
+	d := newIdempotencyService(0, func(r *Request) Response {
+		calls++
+		return EmptySyncResponse
+	})
+
+	body := `{"name": "` + strings.Repeat("a", maxIdempotentBodySize) + `"}`
+	w := postThing(d, "abc", body)
+	c.Assert(w.Code, check.Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(calls, check.Equals, 0)
+
+	// The limit only applies to requests with a key
+	w = postThing(d, "", body)
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(calls, check.Equals, 1)
+}
+
+func (s *idempotencySuite) TestReplayedOperationKept(c *check.C) {
+	release := make(chan struct{})
+	d := &Service{OperationRetention: 10 * time.Millisecond}
+	d.Init([]*API{{Version: "0.9", Commands: []*Command{{Name: "things", POST: func(r *Request) Response {
+		op, err := r.CreateOperation("Creating thing", nil, nil, func(*Operation) error {
+			<-release
+			return nil
+		}, nil)
+		if err != nil {
+			return InternalError(err)
+		}
+		return OperationResponse(op)
+	}}}}})
+
+	w := postThing(d, "abc", `{}`)
+	c.Assert(w.Code, check.Equals, http.StatusAccepted)
+	kept := "/" + w.Header().Get("Location")
+	w = postThing(d, "", `{}`)
+	c.Assert(w.Code, check.Equals, http.StatusAccepted)
+	dropped := "/" + w.Header().Get("Location")
+
+	close(release)
+	for _, url := range []string{kept, dropped} {
+		w = httptest.NewRecorder()
+		d.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url+"/wait", nil))
+		c.Assert(w.Code, check.Equals, http.StatusOK)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The operation a replayed response points to is kept as long as it
+	w = postThing(d, "abc", `{}`)
+	c.Assert(w.Code, check.Equals, http.StatusAccepted)
+	c.Assert("/"+w.Header().Get("Location"), check.Equals, kept)
+	for _, t := range []struct {
+		url  string
+		code int
+	}{{kept, http.StatusOK}, {dropped, http.StatusNotFound}} {
+		w = httptest.NewRecorder()
+		d.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, t.url, nil))
+		c.Assert(w.Code, check.Equals, t.code, check.Commentf(t.url))
+	}
+}
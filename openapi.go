@@ -0,0 +1,486 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/greenbrew/rest/api"
+)
+
+const openAPIVersion = "3.0.3"
+
+// Names of the standard response envelopes in the OpenAPI document components
+const (
+	syncResponseSchema  = "SyncResponse"
+	asyncResponseSchema = "AsyncResponse"
+	errorResponseSchema = "ErrorResponse"
+)
+
+type openAPIDocument struct {
+	OpenAPI    string                      `json:"openapi" yaml:"openapi"`
+	Info       openAPIInfo                 `json:"info" yaml:"info"`
+	Paths      map[string]*openAPIPathItem `json:"paths" yaml:"paths"`
+	Components openAPIComponents           `json:"components" yaml:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title" yaml:"title"`
+	Version string `json:"version" yaml:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*openAPISchema `json:"schemas" yaml:"schemas"`
+}
+
+type openAPIPathItem struct {
+	Summary    string              `json:"summary,omitempty" yaml:"summary,omitempty"`
+	Parameters []*openAPIParameter `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	Get        *openAPIOperation   `json:"get,omitempty" yaml:"get,omitempty"`
+	Put        *openAPIOperation   `json:"put,omitempty" yaml:"put,omitempty"`
+	Post       *openAPIOperation   `json:"post,omitempty" yaml:"post,omitempty"`
+	Delete     *openAPIOperation   `json:"delete,omitempty" yaml:"delete,omitempty"`
+	Patch      *openAPIOperation   `json:"patch,omitempty" yaml:"patch,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty" yaml:"summary,omitempty"`
+	Description string                      `json:"description,omitempty" yaml:"description,omitempty"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty" yaml:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses" yaml:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name" yaml:"name"`
+	In          string         `json:"in" yaml:"in"`
+	Description string         `json:"description,omitempty" yaml:"description,omitempty"`
+	Required    bool           `json:"required,omitempty" yaml:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema" yaml:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty" yaml:"required,omitempty"`
+	Content  map[string]*openAPIMediaType `json:"content" yaml:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description" yaml:"description"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty" yaml:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema" yaml:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty" yaml:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty" yaml:"type,omitempty"`
+	Format               string                    `json:"format,omitempty" yaml:"format,omitempty"`
+	Description          string                    `json:"description,omitempty" yaml:"description,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Enum                 []interface{}             `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty" yaml:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty" yaml:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty" yaml:"additionalProperties,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty" yaml:"allOf,omitempty"`
+	Required             []string                  `json:"required,omitempty" yaml:"required,omitempty"`
+}
+
+func schemaRef(name string) *openAPISchema {
+	return &openAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// openAPIGenerator builds an OpenAPI document out of the registered APIs
+type openAPIGenerator struct {
+	doc *openAPIDocument
+	// Go types already registered as component schemas and their names
+	types map[reflect.Type]string
+}
+
+func newOpenAPIGenerator(title, version string) *openAPIGenerator {
+	g := &openAPIGenerator{
+		doc: &openAPIDocument{
+			OpenAPI: openAPIVersion,
+			Info:    openAPIInfo{Title: title, Version: version},
+			Paths:   map[string]*openAPIPathItem{},
+			Components: openAPIComponents{
+				Schemas: map[string]*openAPISchema{},
+			},
+		},
+		types: map[reflect.Type]string{},
+	}
+	g.addEnvelopes()
+	return g
+}
+
+// addEnvelopes registers the standard sync, async and error responses
+func (g *openAPIGenerator) addEnvelopes() {
+	schemas := g.doc.Components.Schemas
+
+	schemas[syncResponseSchema] = &openAPISchema{
+		Type: "object",
+		Properties: map[string]*openAPISchema{
+			"type":        {Type: "string", Enum: []interface{}{string(api.ResponseTypeSync)}},
+			"status":      {Type: "string"},
+			"status_code": {Type: "integer"},
+			"next":        {Type: "string", Description: "Cursor of the next page of a collection"},
+			"metadata":    {},
+		},
+		Required: []string{"type", "status", "status_code"},
+	}
+
+	schemas[asyncResponseSchema] = &openAPISchema{
+		Type: "object",
+		Properties: map[string]*openAPISchema{
+			"type":        {Type: "string", Enum: []interface{}{string(api.ResponseTypeAsync)}},
+			"status":      {Type: "string"},
+			"status_code": {Type: "integer"},
+			"operation":   {Type: "string", Description: "URL of the background operation"},
+			"metadata":    g.schemaFor(reflect.TypeOf(api.Operation{})),
+		},
+		Required: []string{"type", "status", "status_code", "operation"},
+	}
+
+	schemas[errorResponseSchema] = &openAPISchema{
+		Type: "object",
+		Properties: map[string]*openAPISchema{
+			"type":       {Type: "string", Enum: []interface{}{string(api.ResponseTypeError)}},
+			"error":      {Type: "string"},
+			"error_code": {Type: "integer"},
+			"metadata":   g.schemaFor(reflect.TypeOf(api.ErrorDetails{})),
+		},
+		Required: []string{"type", "error", "error_code"},
+	}
+}
+
+func (g *openAPIGenerator) addAPI(a *API) {
+	for _, c := range a.Commands {
+		g.addCommand(a, c)
+	}
+}
+
+func (g *openAPIGenerator) addCommand(a *API, c *Command) {
+	path, pathParams := openAPIPath(filepath.Join("/", a.Version, c.Name))
+
+	item, ok := g.doc.Paths[path]
+	if !ok {
+		item = &openAPIPathItem{Summary: c.Summary, Parameters: pathParams}
+		g.doc.Paths[path] = item
+	}
+
+	methods := []struct {
+		name    string
+		handler handlerFunc
+		op      **openAPIOperation
+	}{
+		{http.MethodGet, c.GET, &item.Get},
+		{http.MethodPut, c.PUT, &item.Put},
+		{http.MethodPost, c.POST, &item.Post},
+		{http.MethodDelete, c.DELETE, &item.Delete},
+		{http.MethodPatch, c.PATCH, &item.Patch},
+	}
+
+	for _, m := range methods {
+		// As it happens when routing, first command registered for a path wins
+		if m.handler == nil || *m.op != nil {
+			continue
+		}
+		*m.op = g.operation(c.Docs[m.name], item.Parameters)
+	}
+}
+
+func (g *openAPIGenerator) operation(doc *MethodDoc, pathParams []*openAPIParameter) *openAPIOperation {
+	op := &openAPIOperation{
+		Responses: map[string]*openAPIResponse{
+			"default": g.mediaResponse("Error", schemaRef(errorResponseSchema)),
+		},
+	}
+
+	if doc == nil {
+		op.Responses["200"] = g.mediaResponse("Success", schemaRef(syncResponseSchema))
+		return op
+	}
+
+	op.Summary = doc.Summary
+	op.Description = doc.Description
+
+	for _, p := range doc.Parameters {
+		// Path parameters are already declared at path level. Only update its description
+		if p.In == "path" {
+			for _, pp := range pathParams {
+				if pp.Name == p.Name && len(p.Description) > 0 {
+					pp.Description = p.Description
+				}
+			}
+			continue
+		}
+
+		in := p.In
+		if len(in) == 0 {
+			in = "query"
+		}
+
+		schema := &openAPISchema{Type: "string"}
+		if p.Type != nil {
+			schema = g.schemaFor(reflect.TypeOf(p.Type))
+		}
+
+		op.Parameters = append(op.Parameters, &openAPIParameter{
+			Name:        p.Name,
+			In:          in,
+			Description: p.Description,
+			Required:    p.Required,
+			Schema:      schema,
+		})
+	}
+
+	if doc.Request != nil {
+		op.RequestBody = &openAPIRequestBody{
+			Required: true,
+			Content: map[string]*openAPIMediaType{
+				"application/json": {Schema: g.schemaFor(reflect.TypeOf(doc.Request))},
+			},
+		}
+	}
+
+	if doc.Async {
+		op.Responses["202"] = g.mediaResponse("Background operation", schemaRef(asyncResponseSchema))
+		return op
+	}
+
+	schema := schemaRef(syncResponseSchema)
+	if doc.Response != nil {
+		schema = &openAPISchema{
+			AllOf: []*openAPISchema{
+				schemaRef(syncResponseSchema),
+				{
+					Type: "object",
+					Properties: map[string]*openAPISchema{
+						"metadata": g.schemaFor(reflect.TypeOf(doc.Response)),
+					},
+				},
+			},
+		}
+	}
+	op.Responses["200"] = g.mediaResponse("Success", schema)
+	return op
+}
+
+func (g *openAPIGenerator) mediaResponse(description string, schema *openAPISchema) *openAPIResponse {
+	return &openAPIResponse{
+		Description: description,
+		Content: map[string]*openAPIMediaType{
+			"application/json": {Schema: schema},
+		},
+	}
+}
+
+// schemaFor returns the schema describing the JSON encoding of the given type.
+// Named structs are registered as components and referenced
+func (g *openAPIGenerator) schemaFor(t reflect.Type) *openAPISchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &openAPISchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		return &openAPISchema{Type: "array", Items: g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return g.structSchema(t)
+		}
+		return schemaRef(g.registerStruct(t))
+	}
+
+	// Interfaces and any other type accept any value
+	return &openAPISchema{}
+}
+
+// registerStruct adds the named struct to the components if not there yet
+// and returns its component name
+func (g *openAPIGenerator) registerStruct(t reflect.Type) string {
+	if name, ok := g.types[t]; ok {
+		return name
+	}
+
+	name := t.Name()
+	for i := 2; ; i++ {
+		if _, taken := g.doc.Components.Schemas[name]; !taken {
+			break
+		}
+		name = fmt.Sprintf("%s%d", t.Name(), i)
+	}
+
+	// Register before generating the properties to support recursive types
+	g.types[t] = name
+	g.doc.Components.Schemas[name] = &openAPISchema{}
+	*g.doc.Components.Schemas[name] = *g.structSchema(t)
+	return name
+}
+
+func (g *openAPIGenerator) structSchema(t reflect.Type) *openAPISchema {
+	schema := &openAPISchema{
+		Type:       "object",
+		Properties: map[string]*openAPISchema{},
+	}
+	g.addStructFields(schema, t)
+	sort.Strings(schema.Required)
+	return schema
+}
+
+func (g *openAPIGenerator) addStructFields(schema *openAPISchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name, omitEmpty, skip := jsonFieldName(f)
+		if skip {
+			continue
+		}
+
+		// Embedded structs without explicit name get their fields promoted
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			g.addStructFields(schema, ft)
+			continue
+		}
+
+		if len(f.PkgPath) > 0 {
+			// Unexported field
+			continue
+		}
+
+		schema.Properties[name] = g.schemaFor(f.Type)
+		if !omitEmpty && f.Type.Kind() != reflect.Ptr {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+// jsonFieldName returns the name a struct field has when encoded as JSON
+func jsonFieldName(f reflect.StructField) (name string, omitEmpty bool, skip bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false, true
+	}
+
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if len(name) == 0 {
+		name = f.Name
+	}
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty, false
+}
+
+// openAPIPath turns a mux route template into an OpenAPI path, returning
+// as well the declared path parameters. For instance, the route
+// /1.0/operations/{id:[a-z]+} becomes /1.0/operations/{id}
+func openAPIPath(route string) (string, []*openAPIParameter) {
+	var path strings.Builder
+	var params []*openAPIParameter
+
+	for i := 0; i < len(route); i++ {
+		if route[i] != '{' {
+			path.WriteByte(route[i])
+			continue
+		}
+
+		// Find the closing brace, taking into account the ones in the pattern
+		depth := 0
+		end := i
+		for ; end < len(route); end++ {
+			if route[end] == '{' {
+				depth++
+			} else if route[end] == '}' {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+
+		variable := route[i+1 : end]
+		name, pattern := variable, ""
+		if idx := strings.Index(variable, ":"); idx >= 0 {
+			name, pattern = variable[:idx], variable[idx+1:]
+		}
+
+		param := &openAPIParameter{
+			Name:     name,
+			In:       "path",
+			Required: true,
+			Schema:   &openAPISchema{Type: "string"},
+		}
+		if len(pattern) > 0 {
+			param.Schema.Pattern = "^" + pattern + "$"
+		}
+		params = append(params, param)
+
+		path.WriteString("{" + name + "}")
+		i = end
+	}
+
+	return path.String(), params
+}
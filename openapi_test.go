@@ -0,0 +1,162 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"net/http"
+
+	check "gopkg.in/check.v1"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/greenbrew/rest/api"
+)
+
+type openAPISuite struct{}
+
+var _ = check.Suite(&openAPISuite{})
+
+type openAPIThing struct {
+	ID       string            `json:"id"`
+	Value    int               `json:"value,omitempty"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels"`
+	Parent   *openAPIThing     `json:"parent"`
+	Ignored  string            `json:"-"`
+	internal string
+}
+
+func (s *openAPISuite) TestPath(c *check.C) {
+	path, params := openAPIPath("/1.0/things/{id:[a-z]{2,4}}/children/{child}")
+	c.Assert(path, check.Equals, "/1.0/things/{id}/children/{child}")
+	c.Assert(params, check.HasLen, 2)
+	c.Assert(params[0].Name, check.Equals, "id")
+	c.Assert(params[0].In, check.Equals, "path")
+	c.Assert(params[0].Required, check.Equals, true)
+	c.Assert(params[0].Schema.Pattern, check.Equals, "^[a-z]{2,4}$")
+	c.Assert(params[1].Name, check.Equals, "child")
+	c.Assert(params[1].Schema.Pattern, check.Equals, "")
+}
+
+func (s *openAPISuite) TestDocument(c *check.C) {
+	thingsAPI := &API{
+		Version: "2.0",
+		Commands: []*Command{
+			{
+				Name:    "things/{id:[a-z]+}",
+				Summary: "A thing",
+				GET:     func(*Request) Response { return EmptySyncResponse },
+				PUT:     func(*Request) Response { return EmptySyncResponse },
+				DELETE:  func(*Request) Response { return EmptySyncResponse },
+				Docs: map[string]*MethodDoc{
+					http.MethodGet: {
+						Summary: "Returns a thing",
+						Parameters: []ParameterDoc{
+							{Name: "id", In: "path", Description: "Thing identifier"},
+							{Name: "verbose", Type: true},
+						},
+						Response: openAPIThing{},
+					},
+					http.MethodPut: {
+						Summary: "Updates a thing",
+						Request: &openAPIThing{},
+						Async:   true,
+					},
+				},
+			},
+		},
+	}
+
+	g := newOpenAPIGenerator("things", "1.2.3")
+	g.addAPI(thingsAPI)
+	g.addAPI(builtinAPI)
+	doc := g.doc
+
+	c.Assert(doc.OpenAPI, check.Equals, openAPIVersion)
+	c.Assert(doc.Info, check.Equals, openAPIInfo{Title: "things", Version: "1.2.3"})
+
+	// Builtin endpoints are documented too
+	c.Assert(doc.Paths["/1.0/operations"], check.NotNil)
+	c.Assert(doc.Paths["/1.0/operations/{id}/wait"].Get, check.NotNil)
+
+	item := doc.Paths["/2.0/things/{id}"]
+	c.Assert(item, check.NotNil)
+	c.Assert(item.Summary, check.Equals, "A thing")
+	c.Assert(item.Parameters, check.HasLen, 1)
+	c.Assert(item.Parameters[0].Description, check.Equals, "Thing identifier")
+	c.Assert(item.Post, check.IsNil)
+
+	// GET documents parameters and metadata type
+	c.Assert(item.Get.Summary, check.Equals, "Returns a thing")
+	c.Assert(item.Get.Parameters, check.HasLen, 1)
+	c.Assert(item.Get.Parameters[0].In, check.Equals, "query")
+	c.Assert(item.Get.Parameters[0].Schema.Type, check.Equals, "boolean")
+	ok := item.Get.Responses["200"].Content["application/json"].Schema
+	c.Assert(ok.AllOf, check.HasLen, 2)
+	c.Assert(ok.AllOf[0].Ref, check.Equals, "#/components/schemas/SyncResponse")
+	c.Assert(ok.AllOf[1].Properties["metadata"].Ref, check.Equals, "#/components/schemas/openAPIThing")
+	c.Assert(item.Get.Responses["default"].Content["application/json"].Schema.Ref, check.Equals, "#/components/schemas/ErrorResponse")
+
+	// PUT is asynchronous and receives a body
+	c.Assert(item.Put.RequestBody.Content["application/json"].Schema.Ref, check.Equals, "#/components/schemas/openAPIThing")
+	c.Assert(item.Put.Responses["202"].Content["application/json"].Schema.Ref, check.Equals, "#/components/schemas/AsyncResponse")
+
+	// DELETE has no docs, but it is still part of the document
+	c.Assert(item.Delete, check.NotNil)
+	c.Assert(item.Delete.Responses["200"], check.NotNil)
+
+	// Struct schemas follow JSON encoding
+	thing := doc.Components.Schemas["openAPIThing"]
+	c.Assert(thing, check.NotNil)
+	c.Assert(thing.Properties, check.HasLen, 5)
+	c.Assert(thing.Properties["id"].Type, check.Equals, "string")
+	c.Assert(thing.Properties["tags"].Items.Type, check.Equals, "string")
+	c.Assert(thing.Properties["labels"].AdditionalProperties.Type, check.Equals, "string")
+	c.Assert(thing.Properties["parent"].Ref, check.Equals, "#/components/schemas/openAPIThing")
+	c.Assert(thing.Required, check.DeepEquals, []string{"id", "labels", "tags"})
+
+	// Standard envelopes reference the operation type
+	op := doc.Components.Schemas["Operation"]
+	c.Assert(op, check.NotNil)
+	c.Assert(op.Properties["created_at"].Format, check.Equals, "date-time")
+	c.Assert(doc.Components.Schemas[asyncResponseSchema].Properties["metadata"].Ref, check.Equals, "#/components/schemas/Operation")
+
+	// Embedded structs get their fields promoted
+	server := doc.Components.Schemas["Server"]
+	c.Assert(server.Properties["api_version"], check.NotNil)
+	c.Assert(server.Properties["api_extensions"], check.NotNil)
+}
+
+func (s *openAPISuite) TestServeYAML(c *check.C) {
+	d := &Service{Name: "foo", Version: "1.0.0"}
+	d.Init([]*API{})
+
+	response := openAPIYAMLGet(&Request{daemon: d, version: api.Version})
+
+	w := newBufferedResponseWriter()
+	err := response.Render(w)
+	c.Assert(err, check.IsNil)
+	c.Assert(w.headers.Get("Content-Type"), check.Equals, "application/yaml")
+
+	var doc map[string]interface{}
+	err = yaml.Unmarshal(w.buffer.Bytes(), &doc)
+	c.Assert(err, check.IsNil)
+	c.Assert(doc["openapi"], check.Equals, openAPIVersion)
+	c.Assert(doc["info"], check.DeepEquals, map[interface{}]interface{}{"title": "foo", "version": "1.0.0"})
+}
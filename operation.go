@@ -21,10 +21,13 @@ package rest
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 
 	"github.com/greenbrew/rest/api"
@@ -32,6 +35,10 @@ import (
 	"github.com/greenbrew/rest/pool"
 )
 
+// DefaultOperationRetention is how long finished operations are kept, for their
+// final state to be read, if the service does not set another time
+const DefaultOperationRetention = 5 * time.Second
+
 // Operation struct holding metadata for an API operation, including handlers
 // for run, cancel or socket connection; metadata, status or dates it was created, updated, etc..
 type Operation struct {
@@ -43,9 +50,16 @@ type Operation struct {
 	resources   map[string][]string
 	metadata    map[string]interface{}
 	errStr      string
+	result      json.RawMessage
 	description string
 	cancel      context.CancelFunc
 
+	// Identifier of the request which created the operation
+	requestID string
+
+	// Caller which created the operation
+	owner string
+
 	// API version for the resources of this operation. Taken from the
 	// handler context where this operation is created
 	version string
@@ -57,11 +71,25 @@ type Operation struct {
 	// Channels used for error reporting and state tracking of background actions
 	doneCh chan error
 
+	// Closed on the next status change, if anybody waits for it
+	changedCh chan struct{}
+
+	// Output of the operation. Created on first use
+	log *operationLog
+
+	// Operation this one is part of, and the ones part of this one
+	parent   *Operation
+	children []*Operation
+
+	// Kept at least until then once done, as responses pointing to it
+	// could be replayed
+	retainedUntil time.Time
+
 	// Locking for concurent access to the operation
 	mux sync.RWMutex
 
-	// Reference to the queue where pushing run, cancel, etc.. jobs
-	operationsQueue *pool.JobChannel
+	// Reference to the dispatcher whose queue receives run, cancel, etc.. jobs
+	dispatcher *pool.Dispatcher
 
 	// Cached map of in progress operations reference
 	cache *cache
@@ -70,6 +98,43 @@ type Operation struct {
 	events *eventsManager
 }
 
+// newOperation returns a pending operation, still to be registered
+func newOperation(
+	description string,
+	opResources map[string][]string,
+	opMetadata interface{},
+	onRun func(*Operation) error,
+	cancel context.CancelFunc) (*Operation, error) {
+
+	metadata, err := parseMetadata(opMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &Operation{}
+	op.id = uuid.NewRandom().String()
+	op.description = description
+	op.createdAt = time.Now()
+	op.updatedAt = op.createdAt
+	op.status = api.Pending
+	op.url = filepath.Join(api.Version, "operations", op.id)
+	op.resources = opResources
+	op.metadata = metadata
+	op.doneCh = make(chan error)
+	op.onRun = onRun
+	op.cancel = cancel
+	return op, nil
+}
+
+// register adds the operation to the cache and lets the events listeners
+// know about it
+func (op *Operation) register() {
+	op.cache.addOperation(op)
+
+	logger.Debugf("New operation: %s", op.logID())
+	op.notify()
+}
+
 // Render writes in response the operation details, included the list of resources (urls)
 func (op *Operation) Render() (string, *api.Operation, error) {
 	op.mux.RLock()
@@ -89,6 +154,13 @@ func (op *Operation) Render() (string, *api.Operation, error) {
 		resources = tmpResources
 	}
 
+	children, metadata := op.renderChildren()
+
+	var parentID string
+	if op.parent != nil {
+		parentID = op.parent.id
+	}
+
 	return op.url, &api.Operation{
 		ID:          op.id,
 		Description: op.description,
@@ -97,11 +169,43 @@ func (op *Operation) Render() (string, *api.Operation, error) {
 		Status:      op.status.String(),
 		StatusCode:  op.status,
 		Resources:   resources,
-		Metadata:    op.metadata,
+		Metadata:    metadata,
 		Err:         op.errStr,
+		RequestID:   op.requestID,
+		Owner:       op.owner,
+		Result:      op.result,
+		ParentID:    parentID,
+		Children:    children,
 	}, nil
 }
 
+// SetResult sets the value computed by the operation, served along with its
+// state. It must be encodable as JSON
+func (op *Operation) SetResult(result interface{}) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrap(err, "Could not encode operation result")
+	}
+
+	op.write(func() {
+		op.result = b
+	})
+	return nil
+}
+
+// WithResult adapts run, returning the value computed by the operation, to be
+// used as its run handler. The value is the result of the operation if it
+// succeeds
+func WithResult(run func(*Operation) (interface{}, error)) func(*Operation) error {
+	return func(op *Operation) error {
+		result, err := run(op)
+		if err != nil {
+			return err
+		}
+		return op.SetResult(result)
+	}
+}
+
 // WaitFinal waits for the operation to be completed
 func (op *Operation) WaitFinal(timeout int) error {
 	// Check current state
@@ -129,7 +233,43 @@ func (op *Operation) WaitFinal(timeout int) error {
 	return nil
 }
 
-// Run executes internal 'onRun' provided handler
+// Wait waits for the operation to reach any of the given statuses or to be
+// done. Without statuses, it waits for the operation to be done. The context
+// error is returned if it is done before
+func (op *Operation) Wait(ctx context.Context, statuses ...api.StatusCode) error {
+	for {
+		changed := op.changed()
+		status := op.getStatus()
+
+		// Final states are completely set once the operation is done
+		if status.IsFinal() {
+			select {
+			case <-op.doneCh:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		for _, s := range statuses {
+			if status == s {
+				return nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-op.doneCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run executes internal 'onRun' provided handler. If the job cannot be
+// enqueued the operation is finished as failed and the enqueue error returned.
+// Operations with children are done once all of them are, failing if any of
+// them does not succeed
 func (op *Operation) Run() error {
 	if op.getStatus() != api.Pending {
 		return errors.New("Only pending operations can be started")
@@ -137,45 +277,71 @@ func (op *Operation) Run() error {
 
 	op.setStatus(api.Running)
 
-	if op.onRun != nil {
+	// Keep a local reference, as the handler is released once the operation is done
+	onRun := op.read(func() interface{} {
+		return op.onRun
+	}).(func(*Operation) error)
+
+	if onRun != nil {
 		job := func() {
-			err := op.onRun(op)
-			if err != nil {
-				op.setStatus(api.Failure)
-				op.setErrStr(SmartError(err).String())
+			err := onRun(op)
+
+			// Waiting for the children does not take a worker, as they
+			// could be queued behind this job
+			op.whenChildrenDone(func() {
+				// Being cancelled meanwhile
+				if op.getStatus() != api.Running {
+					return
+				}
+
+				if err == nil {
+					err = op.childrenError()
+				}
+
+				if err != nil {
+					op.setStatus(api.Failure)
+					op.setErrStr(SmartError(err).String())
+					op.done()
+
+					logger.Errorf("Failure for operation: %s: %s", op.logID(), err)
+					op.notify()
+					return
+				}
+
+				op.setStatus(api.Success)
 				op.done()
 
-				logger.Errorf("Failure for operation: %s: %s", op.getID(), err)
-
-				_, md, _ := op.Render()
-				op.events.send(md)
-				return
-			}
-
-			op.setStatus(api.Success)
-			op.done()
-
-			logger.Debugf("Success for operation: %s", op.getID())
-			_, md, _ := op.Render()
-			op.events.send(md)
+				logger.Debugf("Success for operation: %s", op.logID())
+				op.notify()
+			})
 		}
 
 		// Enqueue job if queue is enabled. Execute it now otherwise
-		if op.operationsQueue != nil {
-			op.operationsQueue.Push(job)
-		} else {
-			go job()
+		if err := op.enqueue(job); err != nil {
+			logger.Errorf("Could not enqueue operation: %s: %s", op.logID(), err)
+			op.discard(err)
+			return err
 		}
 	}
 
-	logger.Debugf("Started operation: %s", op.getID())
-	_, md, _ := op.Render()
-	op.events.send(md)
+	logger.Debugf("Started operation: %s", op.logID())
+	op.notify()
 
 	return nil
 }
 
-// Cancel calls internal context cancel() method
+// discard fails an operation that will never run, not keeping it
+func (op *Operation) discard(err error) {
+	op.cache.deleleOperationByID(op.id)
+
+	op.setStatus(api.Failure)
+	op.setErrStr(err.Error())
+	op.done()
+	op.notify()
+}
+
+// Cancel calls internal context cancel() method. The running children of the
+// operation are cancelled too, and it is done once all of them are
 func (op *Operation) Cancel() error {
 	if op.getStatus() != api.Running {
 		return errors.New("Only running operations can be cancelled")
@@ -183,61 +349,94 @@ func (op *Operation) Cancel() error {
 
 	op.setStatus(api.Cancelling)
 
-	if op.onCancel != nil {
-		job := func() {
-			err := op.onCancel(op)
-			if err != nil {
-				op.setStatus(api.Failure)
-				op.setErrStr(SmartError(err).String())
-				op.done()
-
-				logger.Errorf("Failure for cancelling operation: %s: %s", op.getID(), err)
+	for _, child := range op.getChildren() {
+		if child.getStatus() != api.Running {
+			continue
+		}
+		if err := child.Cancel(); err != nil {
+			logger.Errorf("Could not cancel child operation: %s: %s", child.logID(), err)
+		}
+	}
 
-				_, md, _ := op.Render()
-				op.events.send(md)
-				return
-			}
+	cancelled := func() {
+		op.setStatus(api.Cancelled)
+		op.setErrStr("Operation cancelled")
+		op.done()
 
-			op.setStatus(api.Cancelled)
-			op.setErrStr("Operation cancelled")
-			op.done()
+		logger.Debugf("Cancelled operation: %s", op.logID())
+		op.notify()
+	}
 
-			logger.Debugf("Cancelled operation: %s", op.getID())
-			_, md, _ := op.Render()
-			op.events.send(md)
+	if op.onCancel != nil {
+		job := func() {
+			err := op.onCancel(op)
+			op.whenChildrenDone(func() {
+				if err != nil {
+					op.setStatus(api.Failure)
+					op.setErrStr(SmartError(err).String())
+					op.done()
+
+					logger.Errorf("Failure for cancelling operation: %s: %s", op.logID(), err)
+					op.notify()
+					return
+				}
+
+				cancelled()
+			})
 		}
 
 		// Enqueue job if queue is enabled. Execute it now otherwise
-		if op.operationsQueue != nil {
-			op.operationsQueue.Push(job)
-		} else {
+		if err := op.enqueue(job); err != nil {
+			logger.Errorf("Could not enqueue cancel for operation: %s: %s", op.logID(), err)
 			go job()
 		}
 	}
 
-	logger.Debugf("Cancelling operation: %s", op.getID())
-	_, md, _ := op.Render()
-	op.events.send(md)
+	logger.Debugf("Cancelling operation: %s", op.logID())
+	op.notify()
 
 	if op.onCancel == nil {
-		op.setStatus(api.Cancelled)
-		op.setErrStr("Operation cancelled")
-		op.done()
-
-		logger.Debugf("Cancelled operation: %s", op.getID())
-		_, md, _ := op.Render()
-		op.events.send(md)
+		op.whenChildrenDone(cancelled)
 	}
 
 	return nil
 }
 
+// notify sends the current state of the operation to the events listeners,
+// and the one of its parent, which includes it
+func (op *Operation) notify() {
+	_, md, _ := op.Render()
+	op.events.send(md, op.requestID, op.owner)
+
+	if op.parent != nil {
+		op.parent.notify()
+	}
+}
+
+// enqueue pushes the job to the dispatcher queue if the pool is enabled.
+// Otherwise the job is executed right away in its own goroutine
+func (op *Operation) enqueue(job pool.Job) error {
+	if op.dispatcher == nil {
+		go job()
+		return nil
+	}
+
+	return op.dispatcher.Push(job)
+}
+
+// retryAfter returns the estimated time until the operations queue could
+// accept this operation again
+func (op *Operation) retryAfter() time.Duration {
+	if op.dispatcher == nil {
+		return 0
+	}
+	return op.dispatcher.EstimatedWait()
+}
+
 func (op *Operation) done() {
 	// Ensure that the operation is still enabled
-	select {
-	case <-op.doneCh:
+	if op.isDone() {
 		return
-	default:
 	}
 
 	op.mux.Lock()
@@ -247,8 +446,43 @@ func (op *Operation) done() {
 	op.cancel = nil
 	close(op.doneCh)
 
-	// TODO Watch out this. Original code delays 5 secs to do it
-	op.cache.deleleOperationByID(op.id)
+	// Followers of the output are done too
+	if op.log == nil {
+		op.log = newOperationLog()
+	}
+	op.log.close()
+
+	// Keep it for a while for its final state to be read
+	id := op.id
+	var remove func()
+	remove = func() {
+		until := op.read(func() interface{} { return op.retainedUntil }).(time.Time)
+		if wait := time.Until(until); wait > 0 {
+			time.AfterFunc(wait, remove)
+			return
+		}
+		op.cache.deleleOperationByID(id)
+	}
+	time.AfterFunc(op.cache.operationRetention(), remove)
+}
+
+// retainUntil keeps the operation, once done, at least until the given time
+func (op *Operation) retainUntil(t time.Time) {
+	op.write(func() {
+		if t.After(op.retainedUntil) {
+			op.retainedUntil = t
+		}
+	})
+}
+
+// isDone returns whether the operation reached its final state
+func (op *Operation) isDone() bool {
+	select {
+	case <-op.doneCh:
+		return true
+	default:
+		return false
+	}
 }
 
 func (op *Operation) read(fn func() interface{}) interface{} {
@@ -269,6 +503,15 @@ func (op *Operation) getID() string {
 	}).(string)
 }
 
+// logID identifies the operation in the logs, along with the request
+// which created it
+func (op *Operation) logID() string {
+	if len(op.requestID) == 0 {
+		return op.getID()
+	}
+	return fmt.Sprintf("%s (request %s)", op.getID(), op.requestID)
+}
+
 func (op *Operation) getStatus() api.StatusCode {
 	return op.read(func() interface{} {
 		return op.status
@@ -278,9 +521,24 @@ func (op *Operation) getStatus() api.StatusCode {
 func (op *Operation) setStatus(status api.StatusCode) {
 	op.write(func() {
 		op.status = status
+		if op.changedCh != nil {
+			close(op.changedCh)
+			op.changedCh = nil
+		}
 	})
 }
 
+// changed returns a channel closed on the next status change
+func (op *Operation) changed() <-chan struct{} {
+	op.mux.Lock()
+	defer op.mux.Unlock()
+
+	if op.changedCh == nil {
+		op.changedCh = make(chan struct{})
+	}
+	return op.changedCh
+}
+
 func (op *Operation) setErrStr(errStr string) {
 	op.write(func() {
 		op.errStr = errStr
@@ -0,0 +1,108 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/greenbrew/rest/cert"
+	"github.com/greenbrew/rest/endpoints"
+	"github.com/greenbrew/rest/errs"
+)
+
+// OperationPolicy decides whether the caller of r can view and cancel the
+// operations created by owner. Owners are given as returned by Caller
+type OperationPolicy func(r *Request, owner string) bool
+
+// OwnerPolicy lets callers access only the operations they created, unless
+// they are any of the privileged ones. Operations created by anonymous
+// callers are only accessible by the privileged ones
+func OwnerPolicy(privileged ...string) OperationPolicy {
+	return func(r *Request, owner string) bool {
+		caller := r.Caller()
+		for _, p := range privileged {
+			if caller == p {
+				return true
+			}
+		}
+		return isOwner(caller, owner)
+	}
+}
+
+// OwnerGroupsPolicy lets callers access only the operations they created,
+// unless they are authenticated as members of any of the given groups
+func OwnerGroupsPolicy(groups ...string) OperationPolicy {
+	return func(r *Request, owner string) bool {
+		if identity := r.Identity(); identity != nil && identity.InGroup(groups...) {
+			return true
+		}
+		return isOwner(r.Caller(), owner)
+	}
+}
+
+func isOwner(caller, owner string) bool {
+	return len(owner) > 0 && caller == owner
+}
+
+// Caller identifies who sent the request: its identity if authenticated or,
+// otherwise, "tls:" followed by the fingerprint of the client certificate for
+// clients sending one, "unix:" followed by the user ID of the process for
+// local clients, just "unix" if not known, or an empty string for anonymous
+// ones
+func (r *Request) Caller() string {
+	return requestCaller(r.HTTPRequest)
+}
+
+func requestCaller(r *http.Request) string {
+	if identity := RequestIdentity(r); identity != nil {
+		return identity.String()
+	}
+	if requestUsesUnixSocket(r) {
+		if creds, ok := endpoints.PeerCredentialsFromContext(r.Context()); ok {
+			return "unix:" + strconv.FormatUint(uint64(creds.UID), 10)
+		}
+		return "unix"
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "tls:" + cert.Fingerprint(r.TLS.PeerCertificates[0])
+	}
+	return ""
+}
+
+// canAccess returns whether the caller can access the operations created by
+// owner, as decided by the service policy. Everybody can if there is none
+func (r *Request) canAccess(owner string) bool {
+	policy := r.daemon.OperationPolicy
+	return policy == nil || policy(r, owner)
+}
+
+// operationByID returns the operation with the given id if the caller can
+// access it. Operations out of reach are not found, not to disclose them
+func (r *Request) operationByID(id string) (*Operation, error) {
+	op, err := r.daemon.cache.getOperationByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !r.canAccess(op.owner) {
+		return nil, errs.NewNotFound("Operation")
+	}
+	return op, nil
+}
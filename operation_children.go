@@ -0,0 +1,195 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/greenbrew/rest/api"
+)
+
+// CreateChild creates and starts an operation as part of this one, through
+// the same dispatcher. The operation is not done until all its children are,
+// so its run handler must not wait for them
+func (op *Operation) CreateChild(
+	description string,
+	opResources map[string][]string,
+	opMetadata interface{},
+	onRun func(*Operation) error,
+	cancel context.CancelFunc) (*Operation, error) {
+
+	if op.getStatus() != api.Running {
+		return nil, errors.New("Only running operations can have children")
+	}
+
+	child, err := newOperation(description, opResources, opMetadata, onRun, cancel)
+	if err != nil {
+		return nil, err
+	}
+
+	child.parent = op
+	child.requestID = op.requestID
+	child.owner = op.owner
+	child.version = op.version
+	child.dispatcher = op.dispatcher
+	child.cache = op.cache
+	child.events = op.events
+
+	op.write(func() {
+		op.children = append(op.children, child)
+	})
+	child.register()
+
+	// Children never started are not part of the operation
+	if err := child.Run(); err != nil {
+		op.write(func() {
+			for i, c := range op.children {
+				if c == child {
+					op.children = append(op.children[:i], op.children[i+1:]...)
+					break
+				}
+			}
+		})
+		op.notify()
+		return nil, err
+	}
+
+	return child, nil
+}
+
+// SetProgress sets the percentage of the work of the operation already done.
+// The progress of operations with children is the one of their children
+func (op *Operation) SetProgress(percent int) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+
+	op.write(func() {
+		if op.metadata == nil {
+			op.metadata = map[string]interface{}{}
+		}
+		op.metadata["progress"] = percent
+	})
+	op.notify()
+}
+
+func (op *Operation) getChildren() []*Operation {
+	op.mux.RLock()
+	defer op.mux.RUnlock()
+	return append([]*Operation(nil), op.children...)
+}
+
+// whenChildrenDone calls fn once all the children of the operation are done,
+// right away if there are none pending
+func (op *Operation) whenChildrenDone(fn func()) {
+	pending := op.pendingChildren()
+	if len(pending) == 0 {
+		fn()
+		return
+	}
+
+	go func() {
+		// Children can still be created while waiting for others
+		for len(pending) > 0 {
+			for _, child := range pending {
+				<-child.doneCh
+			}
+			pending = op.pendingChildren()
+		}
+		fn()
+	}()
+}
+
+func (op *Operation) pendingChildren() []*Operation {
+	var pending []*Operation
+	for _, child := range op.getChildren() {
+		if !child.isDone() {
+			pending = append(pending, child)
+		}
+	}
+	return pending
+}
+
+// childrenError returns an error if any of the children of the operation
+// did not succeed
+func (op *Operation) childrenError() error {
+	children := op.getChildren()
+
+	var failed int
+	for _, child := range children {
+		if child.getStatus() != api.Success {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d child operations did not succeed", failed, len(children))
+	}
+	return nil
+}
+
+// renderChildren returns the state of the children of the operation, along
+// with its metadata including their aggregated progress and statuses. It
+// must be called with the operation locked
+func (op *Operation) renderChildren() ([]api.Operation, map[string]interface{}) {
+	if len(op.children) == 0 {
+		return nil, op.metadata
+	}
+
+	metadata := map[string]interface{}{}
+	for k, v := range op.metadata {
+		metadata[k] = v
+	}
+
+	children := make([]api.Operation, 0, len(op.children))
+	statuses := map[string]int{}
+	var progress int
+	for _, child := range op.children {
+		_, md, _ := child.Render()
+		children = append(children, *md)
+		statuses[md.Status]++
+		progress += operationProgress(md)
+	}
+
+	metadata["progress"] = progress / len(children)
+	metadata["children"] = statuses
+	return children, metadata
+}
+
+// operationProgress returns the percentage of the work of the operation
+// already done
+func operationProgress(op *api.Operation) int {
+	if op.StatusCode.IsFinal() {
+		return 100
+	}
+
+	switch progress := op.Metadata["progress"].(type) {
+	case int:
+		return progress
+	case float64:
+		return int(progress)
+	}
+	return 0
+}
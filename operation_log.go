@@ -0,0 +1,224 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/greenbrew/rest/api"
+)
+
+// Largest output kept for every operation. Older output is discarded
+const maxOperationLogSize = 1 << 20
+
+// Size of the chunks the output is kept in, for older output to be discarded
+// without copying the rest
+const operationLogChunkSize = 64 << 10
+
+var errOperationLogClosed = errors.New("Operation log is closed")
+
+// operationLog is the output of an operation. It is closed once the
+// operation is done
+type operationLog struct {
+	mux    sync.Mutex
+	chunks [][]byte
+	size   int
+	// Offset of the first byte of the chunks in the whole output
+	start  int64
+	closed bool
+	// Closed on the next write, or when the log is closed
+	changed chan struct{}
+}
+
+func newOperationLog() *operationLog {
+	return &operationLog{changed: make(chan struct{})}
+}
+
+func (l *operationLog) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.closed {
+		return 0, errOperationLogClosed
+	}
+
+	n := len(p)
+	if over := len(p) - maxOperationLogSize; over > 0 {
+		l.discard(l.size)
+		l.start += int64(over)
+		p = p[over:]
+	}
+
+	for len(p) > 0 {
+		last := len(l.chunks) - 1
+		if last < 0 || len(l.chunks[last]) == cap(l.chunks[last]) {
+			l.chunks = append(l.chunks, make([]byte, 0, operationLogChunkSize))
+			last++
+		}
+		chunk := l.chunks[last]
+		copied := copy(chunk[len(chunk):cap(chunk)], p)
+		l.chunks[last] = chunk[:len(chunk)+copied]
+		l.size += copied
+		p = p[copied:]
+	}
+	l.discard(l.size - maxOperationLogSize)
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return n, nil
+}
+
+// discard drops the first n bytes kept
+func (l *operationLog) discard(n int) {
+	for n > 0 {
+		chunk := l.chunks[0]
+		if len(chunk) > n {
+			chunk, l.chunks[0] = chunk[:n], chunk[n:]
+		} else {
+			l.chunks[0] = nil
+			l.chunks = l.chunks[1:]
+		}
+		n -= len(chunk)
+		l.size -= len(chunk)
+		l.start += int64(len(chunk))
+	}
+}
+
+func (l *operationLog) close() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		close(l.changed)
+	}
+}
+
+// read returns the output kept from offset on, the offset it starts at and
+// the one after it, whether the log is closed and a channel closed on the
+// next change
+func (l *operationLog) read(offset int64) ([]byte, int64, int64, bool, <-chan struct{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	end := l.start + int64(l.size)
+	if offset < l.start {
+		offset = l.start
+	}
+	if offset > end {
+		offset = end
+	}
+
+	data := make([]byte, 0, end-offset)
+	skip := offset - l.start
+	for _, chunk := range l.chunks {
+		if skip >= int64(len(chunk)) {
+			skip -= int64(len(chunk))
+			continue
+		}
+		data = append(data, chunk[skip:]...)
+		skip = 0
+	}
+	return data, offset, end, l.closed, l.changed
+}
+
+// Logf adds a line to the output of the operation
+func (op *Operation) Logf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line += "\n"
+	}
+	op.getLog().Write([]byte(line))
+}
+
+// LogWriter returns a writer adding to the output of the operation. Writes
+// fail once the operation is done
+func (op *Operation) LogWriter() io.Writer {
+	return op.getLog()
+}
+
+func (op *Operation) getLog() *operationLog {
+	op.mux.Lock()
+	defer op.mux.Unlock()
+
+	if op.log == nil {
+		op.log = newOperationLog()
+	}
+	return op.log
+}
+
+// Operation log response, following the output until the operation is done
+// if requested. Following ends as well if output not sent yet is discarded,
+// for the client to learn it from the offset it is requested again from
+type operationLogResponse struct {
+	log    *operationLog
+	offset int64
+	follow bool
+	ctx    context.Context
+}
+
+func (r *operationLogResponse) Render(w http.ResponseWriter) error {
+	data, start, offset, closed, changed := r.log.read(r.offset)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set(api.LogOffsetHeader, strconv.FormatInt(start, 10))
+	if closed {
+		w.Header().Set(api.LogCompleteHeader, "true")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(data); err != nil || !r.follow || closed {
+		return err
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return nil
+		}
+
+		var end int64
+		data, start, end, closed, changed = r.log.read(offset)
+		if start > offset {
+			return nil
+		}
+		offset = end
+		if _, err := w.Write(data); err != nil || closed {
+			return err
+		}
+	}
+}
+
+func (r *operationLogResponse) String() string {
+	return "operation log"
+}
@@ -0,0 +1,460 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/greenbrew/rest/errs"
+)
+
+// Media types of the supported patch documents
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+// PatchError is returned when a patch cannot be applied. Malformed patches
+// are rendered as bad requests, and well formed ones that cannot be applied
+// to the resource as unprocessable entities
+type PatchError struct {
+	// Index of the failing operation of a JSON patch, -1 if not applicable
+	Operation int
+	Path      string
+	Message   string
+	Malformed bool
+}
+
+func (e *PatchError) Error() string {
+	msg := "Invalid patch"
+	if e.Operation >= 0 {
+		msg = fmt.Sprintf("%s operation %d", msg, e.Operation)
+	}
+	if len(e.Path) > 0 {
+		msg = fmt.Sprintf("%s at %q", msg, e.Path)
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Message)
+}
+
+// Patch applies the patch in the request body to target, a pointer to the
+// current value of the resource. The Content-Type of the request selects
+// the format of the patch: a JSON Patch (RFC 6902) for JSONPatchContentType,
+// or a JSON Merge Patch (RFC 7396) for MergePatchContentType or plain JSON.
+//
+// If the request has an If-Match header, it must match the etag of target
+// as SyncResponseETag would compute it, or errs.ErrPreconditionFailed is
+// returned. The patched resource is decoded into a new value, validated
+// with the same rules as Bind and, only if valid, stored in target.
+// Note that fields not serialized to JSON are then left empty.
+//
+// A *PatchError is returned if the patch cannot be applied, and an
+// *ValidationError if the resulting resource is not valid
+func (r *Request) Patch(target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("Cannot patch %T. A pointer is required", target)
+	}
+
+	if header := r.HTTPRequest.Header.Get("If-Match"); len(header) > 0 {
+		etag, err := etagHash(target)
+		if err != nil {
+			return err
+		}
+		if !ifMatch(header, etag) {
+			return errs.ErrPreconditionFailed
+		}
+	}
+
+	var doc interface{}
+	current, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(current, &doc); err != nil {
+		return err
+	}
+
+	if r.HTTPRequest.Body == nil {
+		return &PatchError{Operation: -1, Message: "missing patch document", Malformed: true}
+	}
+	patch, err := ioutil.ReadAll(r.HTTPRequest.Body)
+	if err != nil {
+		return err
+	}
+
+	mediaType := ""
+	if ct := r.HTTPRequest.Header.Get("Content-Type"); len(ct) > 0 {
+		mediaType, _, _ = mime.ParseMediaType(ct)
+	}
+
+	switch mediaType {
+	case JSONPatchContentType:
+		doc, err = applyJSONPatch(doc, patch)
+	case MergePatchContentType, "application/json", "":
+		doc, err = applyMergePatch(doc, patch)
+	default:
+		err = &PatchError{
+			Operation: -1,
+			Message:   fmt.Sprintf("unsupported patch media type %q", mediaType),
+			Malformed: true,
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Decode the result into a new value to reset removed fields
+	patched, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	verr := &ValidationError{}
+	result := reflect.New(v.Elem().Type())
+	err = json.Unmarshal(patched, result.Interface())
+	if e, ok := err.(*json.UnmarshalTypeError); ok {
+		verr.add(e.Field, "must be %v", e.Type)
+		return verr
+	} else if err != nil {
+		return err
+	}
+
+	present := fieldSet{}
+	present.addJSON(doc, "")
+	if err := validate(result, "", present, verr); err != nil {
+		return err
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+
+	v.Elem().Set(result.Elem())
+	return nil
+}
+
+// applyMergePatch applies a JSON Merge Patch document to doc
+func applyMergePatch(doc interface{}, patch []byte) (interface{}, error) {
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, &PatchError{Operation: -1, Message: fmt.Sprintf("not valid JSON: %v", err), Malformed: true}
+	}
+	return mergePatch(doc, p), nil
+}
+
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = map[string]interface{}{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergePatch(d[k], v)
+	}
+	return d
+}
+
+// An operation of a JSON Patch document
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies the operations of a JSON Patch document to doc.
+// Operations are applied in order, failing at the first one not applicable
+func applyJSONPatch(doc interface{}, patch []byte) (interface{}, error) {
+	ops := []jsonPatchOperation{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, &PatchError{Operation: -1, Message: fmt.Sprintf("not a valid JSON patch: %v", err), Malformed: true}
+	}
+
+	for i, op := range ops {
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			pe := err.(*PatchError)
+			pe.Operation = i
+			return nil, pe
+		}
+	}
+	return doc, nil
+}
+
+func (o *jsonPatchOperation) apply(doc interface{}) (interface{}, error) {
+	malformed := func(format string, args ...interface{}) error {
+		return &PatchError{Message: fmt.Sprintf(format, args...), Malformed: true}
+	}
+
+	if o.Path == nil {
+		return nil, malformed("missing path")
+	}
+	path, err := parseJSONPointer(*o.Path)
+	if err != nil {
+		return nil, malformed("%v", err)
+	}
+
+	var from jsonPointer
+	switch o.Op {
+	case "move", "copy":
+		if o.From == nil {
+			return nil, malformed("missing from")
+		}
+		from, err = parseJSONPointer(*o.From)
+		if err != nil {
+			return nil, malformed("%v", err)
+		}
+	}
+
+	var value interface{}
+	switch o.Op {
+	case "add", "replace", "test":
+		if len(o.Value) == 0 {
+			return nil, malformed("missing value")
+		}
+		if err := json.Unmarshal(o.Value, &value); err != nil {
+			return nil, malformed("invalid value: %v", err)
+		}
+	}
+
+	switch o.Op {
+	case "add":
+		doc, err = path.add(doc, value)
+	case "remove":
+		doc, _, err = path.remove(doc)
+	case "replace":
+		if len(path) == 0 {
+			doc = value
+			break
+		}
+		doc, _, err = path.remove(doc)
+		if err == nil {
+			doc, err = path.add(doc, value)
+		}
+	case "move":
+		if strings.HasPrefix(*o.Path+"/", *o.From+"/") && *o.Path != *o.From {
+			return nil, &PatchError{Path: *o.Path, Message: "cannot move a value into one of its children"}
+		}
+		doc, value, err = from.remove(doc)
+		if err == nil {
+			doc, err = path.add(doc, value)
+		}
+	case "copy":
+		value, err = from.get(doc)
+		if err == nil {
+			doc, err = path.add(doc, deepCopy(value))
+		}
+	case "test":
+		var current interface{}
+		current, err = path.get(doc)
+		if err == nil && !reflect.DeepEqual(current, value) {
+			err = fmt.Errorf("test failed, value is %s", mustJSON(current))
+		}
+	default:
+		return nil, malformed("unknown operation %q", o.Op)
+	}
+
+	if err != nil {
+		return nil, &PatchError{Path: *o.Path, Message: err.Error()}
+	}
+	return doc, nil
+}
+
+// jsonPointer is a parsed JSON Pointer (RFC 6901)
+type jsonPointer []string
+
+func parseJSONPointer(s string) (jsonPointer, error) {
+	if len(s) == 0 {
+		return jsonPointer{}, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", s)
+	}
+
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// get returns the value referenced by the pointer
+func (p jsonPointer) get(doc interface{}) (interface{}, error) {
+	for _, token := range p {
+		switch n := doc.(type) {
+		case map[string]interface{}:
+			v, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = n[i]
+		default:
+			return nil, fmt.Errorf("cannot reference %q in a scalar value", token)
+		}
+	}
+	return doc, nil
+}
+
+// add inserts the value at the location referenced by the pointer and
+// returns the updated document
+func (p jsonPointer) add(doc, value interface{}) (interface{}, error) {
+	if len(p) == 0 {
+		return value, nil
+	}
+
+	return p.update(doc, func(container interface{}, token string) (interface{}, error) {
+		switch n := container.(type) {
+		case map[string]interface{}:
+			n[token] = value
+			return n, nil
+		case []interface{}:
+			if token == "-" {
+				return append(n, value), nil
+			}
+			i, err := arrayIndex(token, len(n))
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+			return n, nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to a scalar value", token)
+		}
+	})
+}
+
+// remove deletes the value referenced by the pointer and returns the
+// updated document and the removed value
+func (p jsonPointer) remove(doc interface{}) (interface{}, interface{}, error) {
+	if len(p) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+
+	var removed interface{}
+	doc, err := p.update(doc, func(container interface{}, token string) (interface{}, error) {
+		switch n := container.(type) {
+		case map[string]interface{}:
+			v, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			removed = v
+			delete(n, token)
+			return n, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = n[i]
+			return append(n[:i], n[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("cannot remove %q from a scalar value", token)
+		}
+	})
+	return doc, removed, err
+}
+
+// update replaces the container holding the last token of the pointer with
+// the result of f, and returns the updated document. Containers are replaced
+// because growing or shrinking arrays results in new slices
+func (p jsonPointer) update(doc interface{}, f func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(p) == 1 {
+		return f(doc, p[0])
+	}
+
+	child, err := jsonPointer(p[:1]).get(doc)
+	if err != nil {
+		return nil, err
+	}
+	child, err = p[1:].update(child, f)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n := doc.(type) {
+	case map[string]interface{}:
+		n[p[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(p[0], len(n)-1)
+		n[i] = child
+	}
+	return doc, nil
+}
+
+// arrayIndex parses an array index token, checking it is not over max
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+// deepCopy returns a copy of a decoded JSON value not sharing any container
+func deepCopy(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(n))
+		for k, e := range n {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(n))
+		for i, e := range n {
+			s[i] = deepCopy(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+func mustJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
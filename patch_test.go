@@ -0,0 +1,146 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	check "gopkg.in/check.v1"
+
+	"github.com/greenbrew/rest/api"
+	"github.com/greenbrew/rest/errs"
+)
+
+type patchSuite struct{}
+
+var _ = check.Suite(&patchSuite{})
+
+type patchThing struct {
+	Name  string            `json:"name" validate:"required"`
+	Tags  []string          `json:"tags,omitempty"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+func newPatchRequest(contentType, body string) *Request {
+	req := httptest.NewRequest(http.MethodPatch, "/1.0/things/abc", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return &Request{HTTPRequest: req}
+}
+
+func (s *patchSuite) TestMergePatch(c *check.C) {
+	thing := &patchThing{Name: "foo", Tags: []string{"a"}, Attrs: map[string]string{"x": "1", "y": "2"}}
+	r := newPatchRequest(MergePatchContentType, `{"tags": null, "attrs": {"x": null, "z": "3"}}`)
+
+	err := r.Patch(thing)
+	c.Assert(err, check.IsNil)
+	c.Assert(thing, check.DeepEquals, &patchThing{Name: "foo", Attrs: map[string]string{"y": "2", "z": "3"}})
+}
+
+func (s *patchSuite) TestJSONPatch(c *check.C) {
+	thing := &patchThing{Name: "foo", Tags: []string{"a", "c"}}
+	r := newPatchRequest(JSONPatchContentType, `[
+		{"op": "test", "path": "/name", "value": "foo"},
+		{"op": "add", "path": "/tags/1", "value": "b"},
+		{"op": "add", "path": "/tags/-", "value": "d"},
+		{"op": "replace", "path": "/name", "value": "bar"},
+		{"op": "add", "path": "/attrs", "value": {"a~b": "1"}},
+		{"op": "copy", "from": "/attrs/a~0b", "path": "/attrs/c"},
+		{"op": "move", "from": "/tags/0", "path": "/attrs/d"},
+		{"op": "remove", "path": "/attrs/a~0b"}
+	]`)
+
+	err := r.Patch(thing)
+	c.Assert(err, check.IsNil)
+	c.Assert(thing, check.DeepEquals, &patchThing{
+		Name:  "bar",
+		Tags:  []string{"b", "c", "d"},
+		Attrs: map[string]string{"c": "1", "d": "a"},
+	})
+}
+
+func (s *patchSuite) TestPatchErrors(c *check.C) {
+	original := patchThing{Name: "foo", Tags: []string{"a"}}
+
+	for _, t := range []struct {
+		contentType string
+		body        string
+		code        int
+		msg         string
+	}{
+		{MergePatchContentType, `{"name": `, 400, "Invalid patch: not valid JSON: unexpected end of JSON input"},
+		{JSONPatchContentType, `{}`, 400, "Invalid patch: not a valid JSON patch: json: cannot unmarshal object into Go value of type []rest.jsonPatchOperation"},
+		{JSONPatchContentType, `[{"op": "jump", "path": "/name"}]`, 400, `Invalid patch operation 0: unknown operation "jump"`},
+		{JSONPatchContentType, `[{"op": "add", "path": "/name"}]`, 400, "Invalid patch operation 0: missing value"},
+		{JSONPatchContentType, `[{"op": "remove", "path": "/tags/0"}, {"op": "remove", "path": "/tags/0"}]`, 422,
+			`Invalid patch operation 1 at "/tags/0": array index 0 out of bounds`},
+		{JSONPatchContentType, `[{"op": "test", "path": "/name", "value": "bar"}]`, 422,
+			`Invalid patch operation 0 at "/name": test failed, value is "foo"`},
+		{JSONPatchContentType, `[{"op": "replace", "path": "/missing/x", "value": 1}]`, 422,
+			`Invalid patch operation 0 at "/missing/x": member "missing" not found`},
+		{"text/plain", `name`, 400, `Invalid patch: unsupported patch media type "text/plain"`},
+	} {
+		thing := original
+		err := newPatchRequest(t.contentType, t.body).Patch(&thing)
+		c.Assert(err, check.NotNil)
+		c.Assert(err.Error(), check.Equals, t.msg, check.Commentf(t.body))
+		c.Assert(thing, check.DeepEquals, original)
+
+		resp, ok := SmartError(err).(*errorResponse)
+		c.Assert(ok, check.Equals, true)
+		c.Assert(resp.code, check.Equals, t.code)
+	}
+}
+
+func (s *patchSuite) TestPatchValidation(c *check.C) {
+	thing := &patchThing{Name: "foo"}
+	r := newPatchRequest(JSONPatchContentType, `[{"op": "remove", "path": "/name"}]`)
+
+	err := r.Patch(thing)
+	verr, ok := err.(*ValidationError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(verr.Fields, check.DeepEquals, []api.FieldError{{Field: "name", Message: "is required"}})
+	c.Assert(thing.Name, check.Equals, "foo")
+
+	r = newPatchRequest(MergePatchContentType, `{"tags": "a"}`)
+	err = r.Patch(thing)
+	verr, ok = err.(*ValidationError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(verr.Fields, check.DeepEquals, []api.FieldError{{Field: "tags", Message: "must be []string"}})
+}
+
+func (s *patchSuite) TestPatchPrecondition(c *check.C) {
+	thing := &patchThing{Name: "foo"}
+	etag, err := etagHash(thing)
+	c.Assert(err, check.IsNil)
+
+	r := newPatchRequest(MergePatchContentType, `{"name": "bar"}`)
+	r.HTTPRequest.Header.Set("If-Match", "other")
+	err = r.Patch(thing)
+	c.Assert(err, check.Equals, errs.ErrPreconditionFailed)
+	c.Assert(thing.Name, check.Equals, "foo")
+
+	r = newPatchRequest(MergePatchContentType, `{"name": "bar"}`)
+	r.HTTPRequest.Header.Set("If-Match", etag)
+	err = r.Patch(thing)
+	c.Assert(err, check.IsNil)
+	c.Assert(thing.Name, check.Equals, "bar")
+}
@@ -21,6 +21,7 @@ package pool
 
 import (
 	"errors"
+	"sync"
 	"time"
 )
 
@@ -43,6 +44,13 @@ const (
 	statusChangeCheckStep = 100 * time.Millisecond
 )
 
+const (
+	// Job duration assumed when no job has been completed yet
+	defaultJobDurationEstimate = time.Second
+	// Weight of the last completed job into the average job duration
+	jobDurationSmoothing = 0.2
+)
+
 var errDispatcherStatusTimeout = errors.New("Timeout waiting for dispatcher status change")
 
 // Dispatcher is the pool engine. Holds the queue receiving the jobs
@@ -60,6 +68,11 @@ type Dispatcher struct {
 
 	stopChan chan bool
 	doneChan chan struct{}
+
+	// Average job duration, used to estimate how long a new job would wait.
+	// The mutex guards the queue being replaced too
+	avgDuration time.Duration
+	statsMux    sync.Mutex
 }
 
 // NewDispatcher returns a new dispatcher with a new workers pool of the requested size
@@ -85,9 +98,11 @@ func (d *Dispatcher) Start() {
 	}
 
 	// Build queue only if it nil. Otherwise we are reusing the same queue
+	d.statsMux.Lock()
 	if d.Queue == nil || d.Queue.closed {
 		d.Queue = newJobChannel(d.queueSize)
 	}
+	d.statsMux.Unlock()
 	d.pool = make(chan *Worker, d.poolSize)
 
 	// Initialize our channels as they supposed to be closed at this time
@@ -100,13 +115,14 @@ func (d *Dispatcher) Start() {
 		worker.Start()
 	}
 
-	go d.run()
-
-	// Wait until reached the capacity to update the status
+	// Wait until reached the capacity to update the status. The pool is
+	// drained by the dispatcher as jobs arrive
 	for len(d.pool) < cap(d.pool) {
 		time.Sleep(time.Millisecond)
 	}
 
+	go d.run()
+
 	d.running = true
 }
 
@@ -145,16 +161,31 @@ func (d *Dispatcher) run() {
 		close(d.doneChan)
 	}()
 
+	stop := func(mustClose bool) {
+		if mustClose {
+			// Close jobQueue to stop receiving more jobs
+			d.Queue.Close()
+		}
+	}
+
 	for {
+		// Jobs are kept in the queue until a worker is idle to attend
+		// them, for the queue to fill up while all of them are busy
+		var worker *Worker
+		select {
+		case worker = <-d.pool:
+		case mustClose := <-d.stopChan:
+			stop(mustClose)
+			return
+		}
+
 		select {
 		case job := <-d.Queue.queue:
 			// a job request has been received
-			go d.dispatch(job)
+			worker.jobChannel <- d.measure(job)
 		case mustClose := <-d.stopChan:
-			if mustClose {
-				// Close jobQueue to stop receiving more jobs
-				d.Queue.Close()
-			}
+			d.pool <- worker
+			stop(mustClose)
 			return
 		}
 	}
@@ -164,8 +195,63 @@ func (d *Dispatcher) dispatch(job Job) {
 	// try to obtain a worker job channel that is available.
 	// this will block until a worker is idle
 	nextWorker := <-d.pool
+
 	// dispatch the job to the worker job channel
-	nextWorker.jobChannel <- job
+	nextWorker.jobChannel <- d.measure(job)
+}
+
+// Push adds job to the queue of the dispatcher. It fails with
+// ErrJobQueueFull if all the workers are busy and the queue is full
+func (d *Dispatcher) Push(job Job) error {
+	d.statsMux.Lock()
+	queue := d.Queue
+	d.statsMux.Unlock()
+
+	if queue == nil {
+		return ErrJobQueueClosed
+	}
+	return queue.Push(job)
+}
+
+// measure wraps the job to record its duration once finished
+func (d *Dispatcher) measure(job Job) Job {
+	return func() {
+		start := time.Now()
+		job()
+		d.recordDuration(time.Since(start))
+	}
+}
+
+func (d *Dispatcher) recordDuration(elapsed time.Duration) {
+	d.statsMux.Lock()
+	defer d.statsMux.Unlock()
+
+	if d.avgDuration == 0 {
+		d.avgDuration = elapsed
+		return
+	}
+	d.avgDuration = time.Duration(jobDurationSmoothing*float64(elapsed) +
+		(1-jobDurationSmoothing)*float64(d.avgDuration))
+}
+
+// EstimatedWait returns how long a job pushed now would wait before being
+// attended by a worker, based on the number of jobs queued ahead of it and
+// the average duration of the jobs completed so far
+func (d *Dispatcher) EstimatedWait() time.Duration {
+	d.statsMux.Lock()
+	defer d.statsMux.Unlock()
+
+	avg := d.avgDuration
+	if avg == 0 {
+		avg = defaultJobDurationEstimate
+	}
+
+	pending := 1
+	if d.Queue != nil {
+		pending += d.Queue.Len()
+	}
+
+	return time.Duration(pending) * avg / time.Duration(d.poolSize)
 }
 
 func (d *Dispatcher) foreachWorker(f func(w *Worker)) {
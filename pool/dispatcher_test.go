@@ -24,6 +24,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	check "gopkg.in/check.v1"
 )
@@ -138,13 +139,22 @@ func (s *dispatcherSuite) TestCannotPushWhenQueueIsFull(c *check.C) {
 	d.Start()
 	defer d.Stop(true)
 
-	for i := 0; i < poolSize+1; i++ {
-		err := d.Queue.Push(func() {})
-		c.Assert(err, check.IsNil)
-	}
+	// The only worker is kept busy
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	err := d.Push(func() {
+		close(started)
+		<-release
+	})
+	c.Assert(err, check.IsNil)
+	<-started
+
+	// The next job waits in the queue
+	c.Assert(d.Push(func() {}), check.IsNil)
 
 	// A third job will received a queue full error
-	c.Assert(d.Queue.Push(func() {}), check.Equals, ErrJobQueueFull)
+	c.Assert(d.Push(func() {}), check.Equals, ErrJobQueueFull)
+	c.Assert(d.Queue.Len(), check.Equals, 1)
 }
 
 func (s *dispatcherSuite) TestUnattendedJobsAfterClosing(c *check.C) {
@@ -155,29 +165,31 @@ func (s *dispatcherSuite) TestUnattendedJobsAfterClosing(c *check.C) {
 	d := NewDispatcher(queueSize, poolSize)
 	d.Start()
 
-	// Let's add nJobs blocked during execution until the end of the tests
-	var wg sync.WaitGroup
-	for i := 0; i < nJobs; i++ {
-		wg.Add(1)
-		err := d.Queue.Push(func() {
-			wg.Wait()
-		})
+	// The first job keeps the only worker busy until the dispatcher loop
+	// has finished, so that the rest of them are never attended
+	started, release := make(chan struct{}), make(chan struct{})
+	err := d.Push(func() {
+		close(started)
+		<-release
+	})
+	c.Assert(err, check.IsNil)
+	<-started
+
+	for i := 1; i < nJobs; i++ {
+		err := d.Push(func() {})
 		c.Assert(err, check.IsNil)
 	}
 
-	d.Stop(false)
+	go func() {
+		<-d.doneChan
+		close(release)
+	}()
 
-	// as first job is waiting forever while attended by unique worker,
-	// then, there should be in the queue the remaining ones.
-	// depending on how the sequence is resolved, at this point the queue
-	// will have more or less workers to finish, but never the nJobs
-	if len(d.Queue.queue) == nJobs {
-		c.Fail()
-	}
+	d.Stop(false)
 
-	for i := 0; i < nJobs; i++ {
-		wg.Done()
-	}
+	// as first job was attended by the unique worker, the remaining
+	// ones must still be in the queue
+	c.Assert(d.Queue.Len(), check.Equals, nJobs-1)
 }
 
 func (s *dispatcherSuite) TestDispatcherCanBeRestarted(c *check.C) {
@@ -223,3 +235,32 @@ func (s *dispatcherSuite) TestDispatcherCanBeRestarted(c *check.C) {
 	// Verify no jobs remain in queue
 	c.Assert(d.Queue.queue, check.HasLen, 0)
 }
+
+func (s *dispatcherSuite) TestEstimatedWait(c *check.C) {
+	queueSize := 10
+	poolSize := 2
+	d := NewDispatcher(queueSize, poolSize)
+	d.Start()
+	defer d.Stop(true)
+
+	// Without any job completed a default duration is assumed
+	c.Assert(d.EstimatedWait(), check.Equals, defaultJobDurationEstimate/time.Duration(poolSize))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	err := d.Queue.Push(func() {
+		time.Sleep(100 * time.Millisecond)
+		wg.Done()
+	})
+	c.Assert(err, check.IsNil)
+	wg.Wait()
+
+	// Wait for the job duration to be registered
+	for i := 0; i < 100 && d.EstimatedWait() == defaultJobDurationEstimate/time.Duration(poolSize); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wait := d.EstimatedWait()
+	c.Assert(wait >= 50*time.Millisecond, check.Equals, true)
+	c.Assert(wait < defaultJobDurationEstimate/time.Duration(poolSize), check.Equals, true)
+}
@@ -69,6 +69,11 @@ func (c *JobChannel) Push(job Job) error {
 	return nil
 }
 
+// Len returns the number of jobs waiting in the queue
+func (c *JobChannel) Len() int {
+	return len(c.queue)
+}
+
 // Close closes the queue
 func (c *JobChannel) Close() {
 	c.mux.Lock()
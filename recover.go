@@ -0,0 +1,112 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/greenbrew/rest/logger"
+)
+
+var errPanic = errors.New("Internal error attending the request")
+
+// recoverPanic recovers from a panic attending a request of the command at
+// the given route, answering with an internal error instead of letting the
+// connection be closed. If the response was already being sent, the
+// connection is aborted as it cannot be answered anymore. It must be deferred
+func (d *Service) recoverPanic(w *sentWriter, r *http.Request, route string) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+
+	// Panics of handlers come with the stack of the goroutine running them
+	stack := logger.GetStack()
+	if p, ok := rec.(*handlerPanic); ok {
+		rec = p.value
+		stack = "\n\t" + string(p.stack)
+	}
+
+	// Aborting the handler is the way of deliberately closing the connection
+	if rec == http.ErrAbortHandler {
+		panic(rec)
+	}
+
+	if counter, ok := d.panics[route]; ok {
+		atomic.AddUint64(counter, 1)
+	}
+
+	logger.Errorf("Panic attending %s %s (request %s): %v%s", r.Method, r.URL.Path, RequestID(r), rec, stack)
+
+	if w.sent {
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := renderResponse(w, r, InternalError(errPanic)); err != nil {
+		logger.Errorf("Failed writing error for panic, giving up")
+	}
+}
+
+// Panics returns the number of panics recovered attending the requests of
+// every command, indexed by route
+func (d *Service) Panics() map[string]uint64 {
+	panics := map[string]uint64{}
+	for route, counter := range d.panics {
+		panics[route] = atomic.LoadUint64(counter)
+	}
+	return panics
+}
+
+// sentWriter keeps track of whether the response started to be sent
+type sentWriter struct {
+	http.ResponseWriter
+	sent bool
+}
+
+func (w *sentWriter) WriteHeader(status int) {
+	w.sent = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sentWriter) Write(b []byte) (int, error) {
+	w.sent = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sentWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.sent = true
+		flusher.Flush()
+	}
+}
+
+func (w *sentWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Connection cannot be hijacked")
+	}
+	w.sent = true
+	return hijacker.Hijack()
+}
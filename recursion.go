@@ -0,0 +1,283 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Expander returns the resource addressed by the request, as its GET handler
+// would. Commands provide it to have their resources expanded in place of the
+// references to them on recursion level 2 or higher
+type Expander func(r *Request) (interface{}, error)
+
+// RecursionLevel returns the level of recursion requested through the
+// "recursion" form value:
+//
+//	0   references (URLs) to the resources are returned
+//	1   the resources are returned instead of their references
+//	2   references nested in the resources are expanded as well
+//
+// Levels not valid are considered 0
+func (r *Request) RecursionLevel() int {
+	if r.HTTPRequest == nil {
+		return 0
+	}
+	return RecursionLevel(r.HTTPRequest)
+}
+
+// RecursionLevel returns the level of recursion requested through the
+// "recursion" form value of the given HTTP request
+func RecursionLevel(r *http.Request) int {
+	recursion, err := strconv.Atoi(r.FormValue("recursion"))
+	if err != nil || recursion < 0 {
+		return 0
+	}
+	return recursion
+}
+
+// Fields returns the list of fields requested through the "fields" form
+// value, a comma separated list of JSON field names using dots for nested
+// ones. Nil if all fields are requested
+func (r *Request) Fields() []string {
+	if r.HTTPRequest == nil {
+		return nil
+	}
+
+	var fields []string
+	for _, f := range strings.Split(r.HTTPRequest.FormValue("fields"), ",") {
+		if f = strings.TrimSpace(f); len(f) > 0 {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// SelectFields keeps only the requested fields of the given resource, or of
+// each of them if a list is given. Values other than JSON objects are kept
+// as they are. The resource is returned untouched if no fields are requested
+func (r *Request) SelectFields(v interface{}) (interface{}, error) {
+	fields := r.Fields()
+	if len(fields) == 0 {
+		return v, nil
+	}
+
+	doc, err := toJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if list, ok := doc.([]interface{}); ok {
+		for i, item := range list {
+			list[i] = selectFields(item, fields)
+		}
+		return list, nil
+	}
+	return selectFields(doc, fields), nil
+}
+
+func selectFields(v interface{}, fields []string) interface{} {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+
+	// Group nested fields by their parent
+	nested := map[string][]string{}
+	selected := map[string]interface{}{}
+	for _, f := range fields {
+		parts := strings.SplitN(f, ".", 2)
+		value, ok := obj[parts[0]]
+		if !ok {
+			continue
+		}
+		if len(parts) == 1 {
+			selected[parts[0]] = value
+			continue
+		}
+		nested[parts[0]] = append(nested[parts[0]], parts[1])
+	}
+
+	for k, sub := range nested {
+		if _, all := selected[k]; all {
+			continue
+		}
+		if child, ok := selectFields(obj[k], sub).(map[string]interface{}); ok {
+			selected[k] = child
+		}
+	}
+	return selected
+}
+
+// ExpandReferences replaces the references to resources nested in the given
+// value with the resources themselves, if recursion level 2 or higher is
+// requested. Only references to resources of Commands with an Expander are
+// replaced, and the expanded resources are not expanded again
+func (r *Request) ExpandReferences(v interface{}) (interface{}, error) {
+	if r.RecursionLevel() < 2 || r.daemon == nil {
+		return v, nil
+	}
+
+	doc, err := toJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var expand func(v interface{}) interface{}
+	expand = func(v interface{}) interface{} {
+		switch n := v.(type) {
+		case map[string]interface{}:
+			for k, e := range n {
+				n[k] = expand(e)
+			}
+		case []interface{}:
+			for i, e := range n {
+				n[i] = expand(e)
+			}
+		case string:
+			if res, ok := r.daemon.expandReference(r, n); ok {
+				return res
+			}
+		}
+		return v
+	}
+	return expand(doc), nil
+}
+
+// ShapeResource expands the references of a resource, or list of resources,
+// and selects its fields, as requested
+func (r *Request) ShapeResource(v interface{}) (interface{}, error) {
+	v, err := r.ExpandReferences(v)
+	if err != nil {
+		return nil, err
+	}
+	return r.SelectFields(v)
+}
+
+// expandReference returns the resource addressed by the reference, if it
+// is the URL of a resource whose command has an Expander and the caller of
+// r would be allowed to GET it. References can be relative to the root, as
+// the resources of the operations are
+func (d *Service) expandReference(r *Request, ref string) (interface{}, bool) {
+	if len(ref) == 0 || len(d.expanders) == 0 {
+		return nil, false
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.IsAbs() || len(u.Host) > 0 {
+		return nil, false
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+
+	// The caller is the same than the one of the original request
+	e := &expansion{}
+	ctx := context.WithValue(r.HTTPRequest.Context(), expansionKey, e)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.Path, nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header = r.HTTPRequest.Header.Clone()
+	req.RemoteAddr = r.HTTPRequest.RemoteAddr
+	req.TLS = r.HTTPRequest.TLS
+
+	var match mux.RouteMatch
+	if !d.Router.Match(req, &match) || match.Route == nil {
+		return nil, false
+	}
+
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return nil, false
+	}
+
+	handler, ok := d.expanders[template]
+	if !ok {
+		return nil, false
+	}
+
+	// Refused requests never reach the expander, keeping the reference
+	handler.ServeHTTP(&discardWriter{header: http.Header{}}, mux.SetURLVars(req, match.Vars))
+	return e.res, e.done
+}
+
+// expansion keeps the resource loaded by an expander handler
+type expansion struct {
+	res  interface{}
+	done bool
+}
+
+// expandHandler returns the handler loading the resources of a command with
+// expand, for them to be returned through the expansion in the context
+func (d *Service) expandHandler(version string, expand Expander) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := r.Context().Value(expansionKey).(*expansion)
+		if !ok {
+			return
+		}
+
+		// Keep the reference if the resource cannot be loaded, as it
+		// could have been removed in the meantime
+		res, err := expand(&Request{
+			HTTPRequest: r,
+			daemon:      d,
+			version:     version,
+		})
+		if err != nil {
+			return
+		}
+		e.res, e.done = res, true
+	})
+}
+
+// discardWriter drops the responses written to it
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// toJSONValue turns v into its generic JSON representation
+func toJSONValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	err = json.Unmarshal(b, &doc)
+	return doc, err
+}
+
+// Recursion related documentation for resource endpoints
+var recursionParamsDoc = []ParameterDoc{
+	{Name: "recursion", Description: "1 to return resources instead of URLs, 2 to expand the nested references as well", Type: 0},
+	{Name: "fields", Description: "Comma separated list of the fields to return, using dots for nested ones"},
+}
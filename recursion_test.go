@@ -0,0 +1,272 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/gorilla/mux"
+	check "gopkg.in/check.v1"
+
+	"github.com/greenbrew/rest/api"
+	"github.com/greenbrew/rest/errs"
+	"github.com/greenbrew/rest/freeport"
+)
+
+type recursionSuite struct{}
+
+var _ = check.Suite(&recursionSuite{})
+
+func (s *recursionSuite) TestRecursionLevel(c *check.C) {
+	for query, level := range map[string]int{"": 0, "recursion=0": 0, "recursion=1": 1, "recursion=2": 2, "recursion=-1": 0, "recursion=yes": 0} {
+		r := &Request{HTTPRequest: httptest.NewRequest("GET", "/1.0/things?"+query, nil)}
+		c.Assert(r.RecursionLevel(), check.Equals, level, check.Commentf(query))
+		c.Assert(r.IsRecursionRequest(), check.Equals, level > 0)
+	}
+}
+
+func (s *recursionSuite) TestSelectFields(c *check.C) {
+	type owner struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+	type thing struct {
+		ID    string `json:"id"`
+		Size  int    `json:"size"`
+		Owner owner  `json:"owner"`
+	}
+	things := []thing{
+		{ID: "a", Size: 1, Owner: owner{Name: "x", Email: "x@example.com"}},
+		{ID: "b", Size: 2, Owner: owner{Name: "y", Email: "y@example.com"}},
+	}
+
+	r := &Request{HTTPRequest: httptest.NewRequest("GET", "/1.0/things?fields=id,owner.name,missing", nil)}
+	v, err := r.SelectFields(things)
+	c.Assert(err, check.IsNil)
+	c.Assert(v, check.DeepEquals, []interface{}{
+		map[string]interface{}{"id": "a", "owner": map[string]interface{}{"name": "x"}},
+		map[string]interface{}{"id": "b", "owner": map[string]interface{}{"name": "y"}},
+	})
+
+	v, err = r.SelectFields(things[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(v, check.DeepEquals, map[string]interface{}{"id": "a", "owner": map[string]interface{}{"name": "x"}})
+
+	// All fields if none requested
+	r = &Request{HTTPRequest: httptest.NewRequest("GET", "/1.0/things", nil)}
+	v, err = r.SelectFields(things)
+	c.Assert(err, check.IsNil)
+	c.Assert(v, check.DeepEquals, things)
+}
+
+func (s *recursionSuite) TestExpandReferences(c *check.C) {
+	owners := map[string]map[string]string{"x": {"name": "x", "email": "x@example.com"}}
+	ownerCmd := &Command{
+		Name: "owners/{name}",
+		Expand: func(r *Request) (interface{}, error) {
+			owner, ok := owners[mux.Vars(r.HTTPRequest)["name"]]
+			if !ok {
+				return nil, errs.NewNotFound("Owner")
+			}
+			return owner, nil
+		},
+	}
+	thingsCmd := &Command{
+		Name: "things",
+		GET: func(r *Request) Response {
+			things := []map[string]interface{}{
+				{"id": "a", "owner": "/0.9/owners/x"},
+				{"id": "b", "owner": "/0.9/owners/removed", "tags": []string{"/0.9/unknown"}},
+			}
+			v, err := r.ShapeResource(things)
+			if err != nil {
+				return InternalError(err)
+			}
+			return SyncResponse(true, v)
+		},
+	}
+
+	port, err := freeport.Get()
+	c.Assert(err, check.IsNil)
+
+	d := Service{
+		Port: port,
+	}
+
+	d.Init([]*API{{Version: "0.9", Commands: []*Command{ownerCmd, thingsCmd}}})
+	err = d.Start()
+	c.Assert(err, check.IsNil)
+	defer d.Shutdown()
+
+	host, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+
+	get := func(query string) interface{} {
+		response, err := http.Get(fmt.Sprintf("http://%s:%d/0.9/things?%s", host, port, query))
+		c.Assert(err, check.IsNil)
+		c.Assert(response.StatusCode, check.Equals, 200)
+
+		resp := &api.Response{}
+		err = json.NewDecoder(response.Body).Decode(resp)
+		c.Assert(err, check.IsNil)
+
+		var v interface{}
+		err = resp.MetadataAsStruct(&v)
+		c.Assert(err, check.IsNil)
+		return v
+	}
+
+	// References are kept on recursion level 1
+	c.Assert(get("recursion=1"), check.DeepEquals, []interface{}{
+		map[string]interface{}{"id": "a", "owner": "/0.9/owners/x"},
+		map[string]interface{}{"id": "b", "owner": "/0.9/owners/removed", "tags": []interface{}{"/0.9/unknown"}},
+	})
+
+	// Only the references that can be loaded are expanded
+	c.Assert(get("recursion=2"), check.DeepEquals, []interface{}{
+		map[string]interface{}{"id": "a", "owner": map[string]interface{}{"name": "x", "email": "x@example.com"}},
+		map[string]interface{}{"id": "b", "owner": "/0.9/owners/removed", "tags": []interface{}{"/0.9/unknown"}},
+	})
+
+	// Fields can be selected from the expanded resources
+	c.Assert(get("recursion=2&fields=owner.email"), check.DeepEquals, []interface{}{
+		map[string]interface{}{"owner": map[string]interface{}{"email": "x@example.com"}},
+		map[string]interface{}{},
+	})
+}
+
+func (s *recursionSuite) TestExpandReferencesAuthorization(c *check.C) {
+	expand := func(r *Request) (interface{}, error) {
+		return map[string]string{"name": mux.Vars(r.HTTPRequest)["name"]}, nil
+	}
+	refused := false
+	d := &Service{
+		Authenticators: []Authenticator{
+			&TokenAuthenticator{Tokens: map[string]Identity{
+				"secret": {Name: "alice", Groups: []string{"admin"}},
+				"other":  {Name: "bob"},
+			}},
+		},
+	}
+	d.Init([]*API{{
+		Version: "0.9",
+		Commands: []*Command{
+			{Name: "owners/{name}", Expand: expand, Groups: []string{"admin"}},
+			{
+				Name:   "groups/{name}",
+				Expand: expand,
+				Middleware: func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						if refused {
+							Forbidden.Render(w)
+							return
+						}
+						next.ServeHTTP(w, r)
+					})
+				},
+			},
+			{
+				Name: "things",
+				GET: func(r *Request) Response {
+					v, err := r.ShapeResource(map[string]interface{}{"owner": "/0.9/owners/x", "group": "/0.9/groups/y"})
+					if err != nil {
+						return InternalError(err)
+					}
+					return SyncResponse(true, v)
+				},
+			},
+		},
+	}})
+
+	get := func(token string) interface{} {
+		r := httptest.NewRequest("GET", "/0.9/things?recursion=2", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		d.Router.ServeHTTP(w, r)
+		c.Assert(w.Code, check.Equals, http.StatusOK)
+
+		resp := &api.Response{}
+		c.Assert(json.Unmarshal(w.Body.Bytes(), resp), check.IsNil)
+		var v interface{}
+		c.Assert(resp.MetadataAsStruct(&v), check.IsNil)
+		return v
+	}
+
+	c.Assert(get("secret"), check.DeepEquals, map[string]interface{}{
+		"owner": map[string]interface{}{"name": "x"},
+		"group": map[string]interface{}{"name": "y"},
+	})
+
+	// References to the resources the caller cannot get are kept
+	c.Assert(get("other"), check.DeepEquals, map[string]interface{}{
+		"owner": "/0.9/owners/x",
+		"group": map[string]interface{}{"name": "y"},
+	})
+
+	// as well as those refused by the middleware of their command
+	refused = true
+	c.Assert(get("secret"), check.DeepEquals, map[string]interface{}{
+		"owner": map[string]interface{}{"name": "x"},
+		"group": "/0.9/groups/y",
+	})
+}
+
+func (s *recursionSuite) TestExpandOperationResources(c *check.C) {
+	d := &Service{}
+	d.Init(nil)
+
+	release := make(chan struct{})
+	defer close(release)
+	r := &Request{HTTPRequest: httptest.NewRequest("POST", "/1.0/things", nil), daemon: d, version: api.Version}
+	target, err := r.CreateOperation("Creating thing", nil, nil, func(*Operation) error {
+		<-release
+		return nil
+	}, nil)
+	c.Assert(err, check.IsNil)
+	_, err = r.CreateOperation("Following", map[string][]string{"operations": {target.id}}, nil, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	w := httptest.NewRecorder()
+	d.Router.ServeHTTP(w, httptest.NewRequest("GET", "/1.0/operations?recursion=2", nil))
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+
+	resp := &api.Response{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), resp), check.IsNil)
+	var md map[string][]map[string]interface{}
+	c.Assert(resp.MetadataAsStruct(&md), check.IsNil)
+
+	// The resources of the listed operations are expanded as well
+	found := false
+	for _, op := range md["pending"] {
+		if op["description"] != "Following" {
+			continue
+		}
+		found = true
+		resources := op["resources"].(map[string]interface{})["operations"].([]interface{})
+		expanded, ok := resources[0].(map[string]interface{})
+		c.Assert(ok, check.Equals, true, check.Commentf("%v", resources[0]))
+		c.Assert(expanded["id"], check.Equals, target.id)
+	}
+	c.Assert(found, check.Equals, true)
+}
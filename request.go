@@ -22,13 +22,7 @@ package rest
 import (
 	"context"
 	"net/http"
-	"path/filepath"
-	"strconv"
-	"time"
 
-	"github.com/greenbrew/rest/api"
-	"github.com/greenbrew/rest/logger"
-	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -47,43 +41,22 @@ func (r *Request) CreateOperation(
 	onRun func(*Operation) error,
 	cancel context.CancelFunc) (*Operation, error) {
 
-	// Main attributes
-	op := &Operation{}
-	op.id = uuid.NewRandom().String()
-	op.description = description
-	op.createdAt = time.Now()
-	op.updatedAt = op.createdAt
-	op.status = api.Pending
-	op.url = filepath.Join(api.Version, "operations", op.id)
-	op.resources = opResources
-	op.doneCh = make(chan error)
+	if r.daemon.cache == nil {
+		return nil, errors.New("Cache not initialized")
+	}
 
-	var err error
-	op.metadata, err = parseMetadata(opMetadata)
+	op, err := newOperation(description, opResources, opMetadata, onRun, cancel)
 	if err != nil {
 		return nil, err
 	}
 
-	op.onRun = onRun
-	op.cancel = cancel
-
+	op.requestID = r.RequestID()
+	op.owner = r.Caller()
 	op.version = r.version
-
-	if r.daemon.dispatcher != nil {
-		op.operationsQueue = r.daemon.dispatcher.Queue
-	}
-
-	if r.daemon.cache == nil {
-		return nil, errors.New("Cache not initialized")
-	}
+	op.dispatcher = r.daemon.dispatcher
 	op.cache = r.daemon.cache
-	op.cache.addOperation(op)
-
-	logger.Debugf("New operation: %s", op.id)
-	_, md, _ := op.Render()
-
 	op.events = r.daemon.events
-	op.events.send(md)
+	op.register()
 
 	return op, nil
 }
@@ -91,28 +64,11 @@ func (r *Request) CreateOperation(
 // IsRecursionRequest checks whether the given HTTP request is marked with the
 // "recursion" flag in its form values.
 func (r *Request) IsRecursionRequest() bool {
-	if r.HTTPRequest == nil {
-		return false
-	}
-
-	recursionStr := r.HTTPRequest.FormValue("recursion")
-	recursion, err := strconv.Atoi(recursionStr)
-	if err != nil {
-		return false
-	}
-
-	return recursion != 0
+	return r.RecursionLevel() > 0
 }
 
 // IsRecursionRequest checks whether the given HTTP request is marked with the
 // "recursion" flag in its form values.
 func IsRecursionRequest(r *http.Request) bool {
-	recursionStr := r.FormValue("recursion")
-
-	recursion, err := strconv.Atoi(recursionStr)
-	if err != nil {
-		return false
-	}
-
-	return recursion != 0
+	return RecursionLevel(r) > 0
 }
@@ -0,0 +1,82 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pborman/uuid"
+
+	"github.com/greenbrew/rest/api"
+)
+
+// Longest request ID or idempotency key accepted from clients
+const maxIdentifierLength = 128
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	identityKey
+	expansionKey
+	requestTrackerKey
+)
+
+// withRequestID identifies every request attended by next with the ID given
+// by the client, or a new one if not given or not valid. The ID is returned
+// in the response headers and kept in the request context
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(api.RequestIDHeader)
+		if !validIdentifier(id) {
+			id = uuid.NewRandom().String()
+		}
+
+		w.Header().Set(api.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// validIdentifier checks that id is not empty and only has printable ASCII
+// characters, so that it can be safely logged
+func validIdentifier(id string) bool {
+	if len(id) == 0 || len(id) > maxIdentifierLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID returns the identifier of the given HTTP request, or an empty
+// string if it was not attended by the service
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// RequestID returns the identifier of the request
+func (r *Request) RequestID() string {
+	return RequestID(r.HTTPRequest)
+}
@@ -0,0 +1,85 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	check "gopkg.in/check.v1"
+
+	"github.com/greenbrew/rest/api"
+)
+
+type requestIDSuite struct{}
+
+var _ = check.Suite(&requestIDSuite{})
+
+func (s *requestIDSuite) TestWithRequestID(c *check.C) {
+	var got string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RequestID(r)
+	}))
+
+	// The ID given by the client is kept
+	req := httptest.NewRequest("GET", "/1.0/things", nil)
+	req.Header.Set(api.RequestIDHeader, "abc")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	c.Assert(got, check.Equals, "abc")
+	c.Assert(w.Header().Get(api.RequestIDHeader), check.Equals, "abc")
+
+	// Not valid ones are replaced
+	for _, id := range []string{"", "a b", "abc\n", strings.Repeat("a", maxIdentifierLength+1)} {
+		req = httptest.NewRequest("GET", "/1.0/things", nil)
+		req.Header.Set(api.RequestIDHeader, id)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		c.Assert(got, check.Not(check.Equals), id)
+		c.Assert(validIdentifier(got), check.Equals, true)
+		c.Assert(w.Header().Get(api.RequestIDHeader), check.Equals, got)
+	}
+
+	c.Assert(RequestID(httptest.NewRequest("GET", "/1.0/things", nil)), check.Equals, "")
+}
+
+func (s *requestIDSuite) TestOperationRequestID(c *check.C) {
+	d := &Service{
+		cache:  &cache{operations: make(map[string]*Operation)},
+		events: &eventsManager{listeners: make(map[string]*eventsListener)},
+	}
+
+	var r *Request
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r = &Request{HTTPRequest: req, daemon: d, version: api.Version}
+	}))
+	req := httptest.NewRequest("POST", "/1.0/things", nil)
+	req.Header.Set(api.RequestIDHeader, "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(r.RequestID(), check.Equals, "abc")
+
+	op, err := r.CreateOperation("Creating thing", nil, nil, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	_, md, err := op.Render()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.RequestID, check.Equals, "abc")
+}
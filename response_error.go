@@ -21,11 +21,15 @@ package rest
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/json"
-	"io"
+	"math"
+	"mime"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/greenbrew/rest/api"
 	"github.com/greenbrew/rest/errs"
@@ -33,17 +37,24 @@ import (
 
 // Different error responses
 var (
-	NotImplemented     = &errorResponse{http.StatusNotImplemented, "not implemented"}
-	NotFound           = &errorResponse{http.StatusNotFound, "not found"}
-	Forbidden          = &errorResponse{http.StatusForbidden, "not authorized"}
-	Conflict           = &errorResponse{http.StatusConflict, "already exists"}
-	ServiceUnavailable = &errorResponse{http.StatusServiceUnavailable, "service unavailable"}
+	NotImplemented     = &errorResponse{code: http.StatusNotImplemented, msg: "not implemented"}
+	MethodNotAllowed   = &errorResponse{code: http.StatusMethodNotAllowed, msg: "method not allowed"}
+	NotFound           = &errorResponse{code: http.StatusNotFound, msg: "not found"}
+	Forbidden          = &errorResponse{code: http.StatusForbidden, msg: "not authorized"}
+	Conflict           = &errorResponse{code: http.StatusConflict, msg: "already exists"}
+	ServiceUnavailable = &errorResponse{code: http.StatusServiceUnavailable, msg: "service unavailable"}
+	GatewayTimeout     = &errorResponse{code: http.StatusGatewayTimeout, msg: "request timed out"}
 )
 
 // Error response
 type errorResponse struct {
 	code int
 	msg  string
+
+	// Machine readable code. Derived from the status if empty
+	errCode string
+	details interface{}
+	fields  []api.FieldError
 }
 
 func (r *errorResponse) String() string {
@@ -51,68 +62,186 @@ func (r *errorResponse) String() string {
 }
 
 func (r *errorResponse) Render(w http.ResponseWriter) error {
-	var output io.Writer
+	return r.renderError(w, false)
+}
 
-	buf := &bytes.Buffer{}
-	output = buf
+// apiError returns the machine readable description of the error
+func (r *errorResponse) apiError(w http.ResponseWriter) api.ErrorDetails {
+	code := r.errCode
+	if len(code) == 0 {
+		code = errorCode(r.code)
+	}
+
+	return api.ErrorDetails{
+		Code:      code,
+		Details:   r.details,
+		Fields:    r.fields,
+		RequestID: w.Header().Get(api.RequestIDHeader),
+	}
+}
+
+// renderError writes the error as a standard error response or, if problem
+// is set, as a problem details document
+func (r *errorResponse) renderError(w http.ResponseWriter, problem bool) error {
+	var body interface{}
+	contentType := "application/json"
+	if problem {
+		contentType = api.ProblemContentType
+		body = api.Problem{
+			Type:         "about:blank",
+			Title:        http.StatusText(r.code),
+			Status:       r.code,
+			Detail:       r.msg,
+			ErrorDetails: r.apiError(w),
+		}
+	} else {
+		body = jmap{
+			"type":       api.ResponseTypeError,
+			"error":      r.msg,
+			"error_code": r.code,
+			"metadata":   r.apiError(w),
+		}
+	}
 
-	err := json.NewEncoder(output).Encode(jmap{
-		"type":       api.ResponseTypeError,
-		"error":      r.msg,
-		"error_code": r.code,
-	})
+	buf := &bytes.Buffer{}
+	err := json.NewEncoder(buf).Encode(body)
 	if err != nil {
 		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(r.code)
 	_, err = w.Write(buf.Bytes())
 	return err
 }
 
+// errorRenderer is implemented by the error responses that can be rendered
+// as problem details documents
+type errorRenderer interface {
+	renderError(w http.ResponseWriter, problem bool) error
+}
+
+// acceptsProblem returns whether the client prefers errors as problem
+// details documents, as stated in its Accept header
+func acceptsProblem(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == api.ProblemContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// renderResponse renders the response for the request, using the problem
+// details format for errors if the client accepts it
+func renderResponse(w http.ResponseWriter, r *http.Request, resp Response) error {
+	if er, ok := resp.(errorRenderer); ok && acceptsProblem(r) {
+		return er.renderError(w, true)
+	}
+	return resp.Render(w)
+}
+
 // BadRequest returns a 400 http response renderer
 func BadRequest(err error) Response {
-	return &errorResponse{http.StatusBadRequest, err.Error()}
+	return &errorResponse{code: http.StatusBadRequest, msg: err.Error()}
 }
 
 // InternalError returns a 500 http response renderer
 func InternalError(err error) Response {
-	return &errorResponse{http.StatusInternalServerError, err.Error()}
+	return &errorResponse{code: http.StatusInternalServerError, msg: err.Error()}
 }
 
 // AuthorizationError returns a 401 http response renderer
 func AuthorizationError(err error) Response {
-	return &errorResponse{http.StatusUnauthorized, err.Error()}
+	return &errorResponse{code: http.StatusUnauthorized, msg: err.Error()}
 }
 
 // PreconditionFailed returns a 412 http response renderer
 func PreconditionFailed(err error) Response {
-	return &errorResponse{http.StatusPreconditionFailed, err.Error()}
+	return &errorResponse{code: http.StatusPreconditionFailed, msg: err.Error()}
+}
+
+// UnprocessableEntity returns a 422 http response renderer
+func UnprocessableEntity(err error) Response {
+	return &errorResponse{code: http.StatusUnprocessableEntity, msg: err.Error()}
 }
 
 // NotFoundError returns a 404 http response renderer
 func NotFoundError(what string) Response {
-	return &errorResponse{http.StatusNotFound, errs.NewNotFound(what).Error()}
+	return &errorResponse{code: http.StatusNotFound, msg: errs.NewNotFound(what).Error()}
+}
+
+// ServiceUnavailableRetry returns a 503 http response renderer including a
+// Retry-After header with the time the client should wait before retrying
+func ServiceUnavailableRetry(err error, after time.Duration) Response {
+	return &retryAfterResponse{
+		errorResponse: &errorResponse{code: http.StatusServiceUnavailable, msg: err.Error()},
+		after:         after,
+	}
+}
+
+// Error response including a Retry-After header
+type retryAfterResponse struct {
+	*errorResponse
+	after time.Duration
+}
+
+func (r *retryAfterResponse) Render(w http.ResponseWriter) error {
+	return r.renderError(w, false)
 }
 
-// SmartError returns the right error message based on err.
+func (r *retryAfterResponse) renderError(w http.ResponseWriter, problem bool) error {
+	// Retry-After is expressed in whole seconds. Never ask for an
+	// immediate retry, as the service is already overloaded
+	seconds := int(math.Ceil(r.after.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return r.errorResponse.renderError(w, problem)
+}
+
+// SmartError returns the right error response based on err. Validation and
+// patch errors include their details, and other errors are described by the
+// status and code registered for them, being internal errors otherwise
 func SmartError(err error) Response {
-	switch err {
-	case nil:
+	if err == nil {
 		return EmptySyncResponse
-	case os.ErrNotExist:
-		return NotFound
-	case sql.ErrNoRows:
-		return NotFound
-	case errs.ErrNoSuchObject:
-		return NotFound
-	case os.ErrPermission:
-		return Forbidden
-	case errs.ErrAlreadyExists:
-		return Conflict
-	default:
-		return InternalError(err)
 	}
+
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		return &errorResponse{
+			code:    http.StatusBadRequest,
+			msg:     verr.Error(),
+			errCode: "invalid_request",
+			fields:  verr.Fields,
+		}
+	}
+
+	var perr *PatchError
+	if errors.As(err, &perr) {
+		code := http.StatusUnprocessableEntity
+		if perr.Malformed {
+			code = http.StatusBadRequest
+		}
+		details := jmap{"path": perr.Path}
+		if perr.Operation >= 0 {
+			details["operation"] = perr.Operation
+		}
+		return &errorResponse{code: code, msg: perr.Error(), errCode: "invalid_patch", details: details}
+	}
+
+	if m, ok := lookupErrorMapping(err); ok {
+		msg := m.msg
+		if len(msg) == 0 {
+			msg = err.Error()
+		}
+		return &errorResponse{code: m.status, msg: msg, errCode: m.code}
+	}
+
+	return InternalError(err)
 }
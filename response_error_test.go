@@ -20,8 +20,12 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"os"
 
 	"github.com/pkg/errors"
 
@@ -42,19 +46,19 @@ func (s *responseErrorSuite) SetUpSuite(c *check.C) {
 }
 
 func (s *responseErrorSuite) TestBadRequest(c *check.C) {
-	s.testErrorResponse(BadRequest, http.StatusBadRequest, c)
+	s.testErrorResponse(BadRequest, http.StatusBadRequest, "bad_request", c)
 }
 
 func (s *responseErrorSuite) TestInternalError(c *check.C) {
-	s.testErrorResponse(InternalError, http.StatusInternalServerError, c)
+	s.testErrorResponse(InternalError, http.StatusInternalServerError, "internal_server_error", c)
 }
 
 func (s *responseErrorSuite) TestAuthorizationError(c *check.C) {
-	s.testErrorResponse(AuthorizationError, http.StatusUnauthorized, c)
+	s.testErrorResponse(AuthorizationError, http.StatusUnauthorized, "unauthorized", c)
 }
 
 func (s *responseErrorSuite) TestPreconditionFailed(c *check.C) {
-	s.testErrorResponse(PreconditionFailed, http.StatusPreconditionFailed, c)
+	s.testErrorResponse(PreconditionFailed, http.StatusPreconditionFailed, "precondition_failed", c)
 }
 
 func (s *responseErrorSuite) TestNotFoundError(c *check.C) {
@@ -69,7 +73,7 @@ func (s *responseErrorSuite) TestNotFoundError(c *check.C) {
 		Type:     api.ResponseTypeError,
 		Code:     http.StatusNotFound,
 		Error:    errs.NewNotFound(s.err.Error()).Error(),
-		Metadata: nil,
+		Metadata: json.RawMessage(`{"code":"not_found"}`),
 	}
 
 	desired := &api.Response{}
@@ -78,7 +82,7 @@ func (s *responseErrorSuite) TestNotFoundError(c *check.C) {
 	c.Assert(expected, check.DeepEquals, desired)
 }
 
-func (s *responseErrorSuite) testErrorResponse(fn func(error) Response, code int, c *check.C) {
+func (s *responseErrorSuite) testErrorResponse(fn func(error) Response, code int, errCode string, c *check.C) {
 	response := fn(s.err)
 
 	w := newBufferedResponseWriter()
@@ -90,7 +94,7 @@ func (s *responseErrorSuite) testErrorResponse(fn func(error) Response, code int
 		Type:     api.ResponseTypeError,
 		Code:     code,
 		Error:    s.err.Error(),
-		Metadata: nil,
+		Metadata: json.RawMessage(fmt.Sprintf(`{"code":%q}`, errCode)),
 	}
 
 	desired := &api.Response{}
@@ -98,3 +102,86 @@ func (s *responseErrorSuite) testErrorResponse(fn func(error) Response, code int
 	c.Assert(err, check.IsNil)
 	c.Assert(expected, check.DeepEquals, desired)
 }
+
+type quotaError struct {
+	limit int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("Quota of %d exceeded", e.limit)
+}
+
+var errTeapot = errors.New("I'm a teapot")
+
+func (s *responseErrorSuite) TestSmartError(c *check.C) {
+	RegisterErrorType(&quotaError{}, http.StatusTooManyRequests, "quota_exceeded")
+	RegisterError(errTeapot, http.StatusTeapot, "")
+
+	for _, t := range []struct {
+		err     error
+		code    int
+		errCode string
+		msg     string
+	}{
+		{errs.NewNotFound("Thing"), http.StatusNotFound, "not_found", ""},
+		{errors.Wrap(errs.NewNotFound("Thing"), "Cannot load"), http.StatusNotFound, "not_found", ""},
+		{errors.Wrap(os.ErrNotExist, "Cannot open"), http.StatusNotFound, "not_found", "not found"},
+		{&os.PathError{Op: "open", Path: "/var/lib/secret", Err: os.ErrPermission}, http.StatusForbidden, "forbidden", "not authorized"},
+		{errs.ErrAlreadyExists, http.StatusConflict, "already_exists", "already exists"},
+		{errors.Wrap(context.Canceled, "Cannot load"), http.StatusServiceUnavailable, "service_unavailable", "service unavailable"},
+		{errors.Wrap(&quotaError{limit: 3}, "Cannot create"), http.StatusTooManyRequests, "quota_exceeded", ""},
+		{errTeapot, http.StatusTeapot, "im_a_teapot", ""},
+		{s.err, http.StatusInternalServerError, "internal_server_error", ""},
+		{&ValidationError{}, http.StatusBadRequest, "invalid_request", ""},
+	} {
+		resp, ok := SmartError(t.err).(*errorResponse)
+		c.Assert(ok, check.Equals, true)
+		c.Assert(resp.code, check.Equals, t.code, check.Commentf("%v", t.err))
+
+		// Builtin mappings keep their usual messages
+		if len(t.msg) == 0 {
+			t.msg = t.err.Error()
+		}
+		c.Assert(resp.msg, check.Equals, t.msg)
+
+		w := newBufferedResponseWriter()
+		c.Assert(resp.apiError(w).Code, check.Equals, t.errCode)
+	}
+}
+
+func (s *responseErrorSuite) TestProblemDetails(c *check.C) {
+	verr := &ValidationError{}
+	verr.add("name", "is required")
+
+	r := httptest.NewRequest("POST", "/1.0/things", nil)
+	r.Header.Set("Accept", "application/json, application/problem+json")
+
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "abc")
+	err := renderResponse(w, r, SmartError(verr))
+	c.Assert(err, check.IsNil)
+	c.Assert(w.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(w.Header().Get("Content-Type"), check.Equals, api.ProblemContentType)
+
+	problem := api.Problem{}
+	err = json.Unmarshal(w.Body.Bytes(), &problem)
+	c.Assert(err, check.IsNil)
+	c.Assert(problem, check.DeepEquals, api.Problem{
+		Type:   "about:blank",
+		Title:  "Bad Request",
+		Status: http.StatusBadRequest,
+		Detail: "Invalid request: name is required",
+		ErrorDetails: api.ErrorDetails{
+			Code:      "invalid_request",
+			Fields:    []api.FieldError{{Field: "name", Message: "is required"}},
+			RequestID: "abc",
+		},
+	})
+
+	// Standard error responses otherwise
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	err = renderResponse(w, r, SmartError(verr))
+	c.Assert(err, check.IsNil)
+	c.Assert(w.Header().Get("Content-Type"), check.Equals, "application/json")
+}
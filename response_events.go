@@ -35,6 +35,7 @@ var websocketUpgrader = websocket.Upgrader{
 type eventsResponse struct {
 	req    *http.Request
 	events *eventsManager
+	canSee func(owner string) bool
 }
 
 func (r *eventsResponse) Render(w http.ResponseWriter) error {
@@ -51,6 +52,7 @@ func (r *eventsResponse) Render(w http.ResponseWriter) error {
 	listener := &eventsListener{
 		id:         uuid.NewRandom().String(),
 		connection: c,
+		canSee:     r.canSee,
 		doneCh:     make(chan struct{}),
 	}
 
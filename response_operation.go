@@ -20,23 +20,49 @@
 package rest
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/greenbrew/rest/api"
+	"github.com/greenbrew/rest/pool"
 )
 
 // Operation response
 type operationResponse struct {
 	op *Operation
+
+	// How long to wait for the operation to finish before answering. The
+	// final state is returned in a sync response if it finishes in time
+	wait time.Duration
+	ctx  context.Context
 }
 
 func (r *operationResponse) Render(w http.ResponseWriter) error {
 	err := r.op.Run()
 	if err != nil {
+		// The operation could not be enqueued and was discarded. Let the
+		// client know when it is worth to try again
+		switch errors.Cause(err) {
+		case pool.ErrJobQueueFull, pool.ErrJobQueueClosed:
+			return ServiceUnavailableRetry(err, r.op.retryAfter()).Render(w)
+		}
 		return err
 	}
 
+	if r.wait > 0 && r.waitDone() {
+		_, md, err := r.op.Render()
+		if err != nil {
+			return err
+		}
+		return SyncResponse(md.StatusCode == api.Success, md).Render(w)
+	}
+
 	url, md, err := r.op.Render()
 	if err != nil {
 		return err
@@ -67,7 +93,64 @@ func (r *operationResponse) String() string {
 	return md.ID
 }
 
-// OperationResponse returns an http response renderer for an operation request
+// waitDone waits for the operation to be done, until the wait time elapses or
+// the request is given up
+func (r *operationResponse) waitDone() bool {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	timer := time.NewTimer(r.wait)
+	defer timer.Stop()
+
+	select {
+	case <-r.op.doneCh:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// OperationResponse returns an http response renderer for an operation request.
+// Callers can ask to wait for the operation to finish, with the "wait" query
+// parameter or a "Prefer: wait=<seconds>" header, to get its final state in
+// a sync response instead
 func OperationResponse(op *Operation) Response {
-	return &operationResponse{op}
+	return &operationResponse{op: op}
+}
+
+// operationWait returns how long the caller of r waits for the operations it
+// creates to finish, given as a duration ("30s") or number of seconds in the
+// "wait" query parameter or the "Prefer" header. Values not valid are ignored
+func operationWait(r *http.Request) time.Duration {
+	if wait, ok := parseWait(r.URL.Query().Get("wait")); ok {
+		return wait
+	}
+
+	for _, prefer := range r.Header["Prefer"] {
+		for _, pref := range strings.FieldsFunc(prefer, func(c rune) bool { return c == ',' || c == ';' }) {
+			name, value, found := strings.Cut(strings.TrimSpace(pref), "=")
+			if found && strings.EqualFold(name, "wait") {
+				if wait, ok := parseWait(value); ok {
+					return wait
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func parseWait(value string) (time.Duration, bool) {
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if wait, err := time.ParseDuration(value); err == nil && wait > 0 {
+		return wait, true
+	}
+	return 0, false
 }
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/greenbrew/rest/api"
+	"github.com/greenbrew/rest/pool"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	check "gopkg.in/check.v1"
@@ -304,3 +305,160 @@ func (s *responseOperationSuite) TestCancelOperationWithoutCancelHandler(c *chec
 	_, operation, err := op.Render()
 	c.Assert(operation.StatusCode, check.Equals, api.Cancelled)
 }
+
+func (s *responseOperationSuite) TestOperationCannotBeEnqueued(c *check.C) {
+	id := uuid.NewRandom().String()
+
+	// A stopped dispatcher does not accept more jobs
+	dispatcher := pool.NewDispatcher(1, 1)
+	dispatcher.Start()
+	dispatcher.Stop(true)
+
+	op := &Operation{
+		id:          id,
+		description: "foo operation",
+		status:      api.Pending,
+		url:         filepath.Join("1.0/operations", id),
+		onRun:       func(*Operation) error { return nil },
+		doneCh:      make(chan error),
+		dispatcher:  dispatcher,
+		cache:       &cache{operations: make(map[string]*Operation)},
+		events:      &eventsManager{listeners: make(map[string]*eventsListener)},
+	}
+	op.cache.addOperation(op)
+
+	response := OperationResponse(op)
+
+	w := newBufferedResponseWriter()
+	err := response.Render(w)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(w.statusCode, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(w.headers.Get("Retry-After"), check.Equals, "1")
+
+	body := &api.Response{}
+	err = json.Unmarshal(w.buffer.Bytes(), body)
+	c.Assert(err, check.IsNil)
+	c.Assert(body.Type, check.Equals, api.ResponseTypeError)
+	c.Assert(body.Error, check.Equals, pool.ErrJobQueueClosed.Error())
+
+	// The operation is not kept as it will never run
+	_, err = op.cache.getOperationByID(id)
+	c.Assert(err, check.NotNil)
+	c.Assert(op.getStatus(), check.Equals, api.Failure)
+}
+
+func (s *responseOperationSuite) TestOperationQueueIsFull(c *check.C) {
+	id := uuid.NewRandom().String()
+
+	// The only worker is kept busy and the queue holds another job
+	dispatcher := pool.NewDispatcher(1, 1)
+	dispatcher.Start()
+	defer dispatcher.Stop(true)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	err := dispatcher.Push(func() {
+		close(started)
+		<-release
+	})
+	c.Assert(err, check.IsNil)
+	<-started
+	c.Assert(dispatcher.Push(func() {}), check.IsNil)
+
+	op := &Operation{
+		id:          id,
+		description: "foo operation",
+		status:      api.Pending,
+		url:         filepath.Join("1.0/operations", id),
+		onRun:       func(*Operation) error { return nil },
+		doneCh:      make(chan error),
+		dispatcher:  dispatcher,
+		cache:       &cache{operations: make(map[string]*Operation)},
+		events:      &eventsManager{listeners: make(map[string]*eventsListener)},
+	}
+	op.cache.addOperation(op)
+
+	response := OperationResponse(op)
+
+	w := newBufferedResponseWriter()
+	err = response.Render(w)
+	c.Assert(err, check.IsNil)
+
+	// Waiting for the queued job and the new one, one second each
+	c.Assert(w.statusCode, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(w.headers.Get("Retry-After"), check.Equals, "2")
+
+	body := &api.Response{}
+	err = json.Unmarshal(w.buffer.Bytes(), body)
+	c.Assert(err, check.IsNil)
+	c.Assert(body.Error, check.Equals, pool.ErrJobQueueFull.Error())
+
+	_, err = op.cache.getOperationByID(id)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *responseOperationSuite) TestOperationResponseWait(c *check.C) {
+	newOp := func(d time.Duration) *Operation {
+		return &Operation{
+			id:     uuid.NewRandom().String(),
+			status: api.Pending,
+			onRun: func(*Operation) error {
+				time.Sleep(d)
+				return nil
+			},
+			doneCh: make(chan error),
+			cache:  &cache{operations: make(map[string]*Operation)},
+			events: &eventsManager{listeners: make(map[string]*eventsListener)},
+		}
+	}
+
+	// Operations finishing in time are answered with their final state
+	op := newOp(10 * time.Millisecond)
+	w := newBufferedResponseWriter()
+	err := (&operationResponse{op: op, wait: time.Second}).Render(w)
+	c.Assert(err, check.IsNil)
+	c.Assert(w.statusCode, check.Equals, 0)
+
+	resp := api.Response{}
+	err = json.Unmarshal(w.buffer.Bytes(), &resp)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.Type, check.Equals, api.ResponseTypeSync)
+	md, err := resp.MetadataAsOperation()
+	c.Assert(err, check.IsNil)
+	c.Assert(md.ID, check.Equals, op.id)
+	c.Assert(md.StatusCode, check.Equals, api.Success)
+
+	// Operations still running once the wait elapses are answered as usual
+	op = newOp(500 * time.Millisecond)
+	w = newBufferedResponseWriter()
+	err = (&operationResponse{op: op, wait: 10 * time.Millisecond}).Render(w)
+	c.Assert(err, check.IsNil)
+	c.Assert(w.statusCode, check.Equals, http.StatusAccepted)
+	c.Assert(op.WaitFinal(10), check.IsNil)
+}
+
+func (s *responseOperationSuite) TestOperationWait(c *check.C) {
+	for _, t := range []struct {
+		query  string
+		prefer string
+		wait   time.Duration
+	}{
+		{"", "", 0},
+		{"?wait=30", "", 30 * time.Second},
+		{"?wait=1m30s", "", 90 * time.Second},
+		{"?wait=10", "wait=5", 10 * time.Second},
+		{"", "respond-async, wait=5", 5 * time.Second},
+		{"", "handling=lenient; Wait=2s", 2 * time.Second},
+		{"?wait=soon", "", 0},
+		{"?wait=-1", "", 0},
+		{"", "wait", 0},
+	} {
+		r, err := http.NewRequest("POST", "/1.0/things"+t.query, nil)
+		c.Assert(err, check.IsNil)
+		if len(t.prefer) > 0 {
+			r.Header.Set("Prefer", t.prefer)
+		}
+		c.Assert(operationWait(r), check.Equals, t.wait, check.Commentf("%s %s", t.query, t.prefer))
+	}
+}
@@ -33,6 +33,7 @@ type syncResponse struct {
 	location string
 	code     int
 	headers  map[string]string
+	next     string
 }
 
 func (r *syncResponse) String() string {
@@ -76,7 +77,8 @@ func (r *syncResponse) Render(w http.ResponseWriter) error {
 		Response: api.Response{
 			Type:       api.ResponseTypeSync,
 			Status:     status.String(),
-			StatusCode: int(status)},
+			StatusCode: int(status),
+			Next:       r.next},
 		Metadata: r.metadata,
 	}
 
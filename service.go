@@ -20,13 +20,16 @@
 package rest
 
 import (
+	"context"
 	"net/http"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/greenbrew/rest/api"
 	"github.com/greenbrew/rest/endpoints"
 	"github.com/greenbrew/rest/logger"
 	"github.com/greenbrew/rest/pool"
@@ -39,6 +42,13 @@ type Service struct {
 	endpoints []endpoints.EndpointEngine
 	events    *eventsManager
 
+	// APIs registered in the service, builtin one included
+	apis []*API
+
+	// Name and version of the service. Used to describe it in the OpenAPI document
+	Name    string
+	Version string
+
 	UnixSocketPath string
 	// Group to own the unix socket created to expose REST locally
 	UnixSocketOwner string
@@ -61,6 +71,47 @@ type Service struct {
 	dispatcher              *pool.Dispatcher
 
 	cache *cache
+
+	// How long finished operations are kept for their final state and the
+	// history of operations to be queried. Defaults to DefaultOperationRetention
+	OperationRetention time.Duration
+
+	// Decides who can view and cancel every operation, and receive its
+	// events. Everybody can if not set
+	OperationPolicy OperationPolicy
+
+	// Identify the callers of the commands, tried in order until any of
+	// them does. Commands can set their own. Callers are not identified
+	// if there are none
+	Authenticators []Authenticator
+
+	// Groups allowed to send requests other than GET, HEAD and OPTIONS to
+	// the commands, if set and there are authenticators. Commands can set
+	// their own
+	WriteGroups []string
+
+	// Longest time handlers have to answer before giving up with a 504.
+	// Handlers are not stopped, so they must honour the context of the
+	// request. Zero means no limit
+	HandlerTimeout time.Duration
+
+	// How long the responses to requests with an idempotency key are kept
+	// to be replayed. Defaults to DefaultIdempotencyWindow
+	IdempotencyWindow time.Duration
+	// Most responses kept to be replayed. The ones closer to expire are
+	// dropped to make room. Defaults to DefaultIdempotencyMaxEntries
+	IdempotencyMaxEntries int
+	idempotency           *idempotencyStore
+
+	// Context of the service lifetime, cancelled on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Expanders of the commands resources, indexed by route
+	expanders map[string]http.Handler
+
+	// Number of panics recovered attending every command, indexed by route
+	panics map[string]*uint64
 }
 
 // Init initializes REST service daemon by creating mux router if not created, populate
@@ -72,7 +123,7 @@ func (d *Service) Init(apis []*API) {
 	}
 
 	if d.Router.NotFoundHandler == nil {
-		d.Router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+		d.Router.NotFoundHandler = withRequestID(http.HandlerFunc(notFoundHandler))
 	}
 
 	d.checkTLSConfig()
@@ -81,11 +132,15 @@ func (d *Service) Init(apis []*API) {
 		d.dispatcher = pool.NewDispatcher(d.MaxQueuedOperations, d.MaxConcurrentOperations)
 	}
 
-	d.cache = &cache{operations: make(map[string]*Operation)}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.cache = &cache{operations: make(map[string]*Operation), retention: d.OperationRetention}
+	d.idempotency = newIdempotencyStore(d.IdempotencyWindow, d.IdempotencyMaxEntries)
 	d.events = &eventsManager{listeners: make(map[string]*eventsListener)}
 
-	apis = append(apis, builtinAPI)
-	for _, api := range apis {
+	d.expanders = map[string]http.Handler{}
+	d.panics = map[string]*uint64{}
+	d.apis = append(apis, builtinAPI)
+	for _, api := range d.apis {
 		for _, c := range api.Commands {
 			d.createCmd(api, c)
 		}
@@ -108,6 +163,11 @@ func (d *Service) Start() error {
 
 // Shutdown additional tasks when service shutdown
 func (d *Service) Shutdown() error {
+	// Requests being attended are given up
+	if d.cancel != nil {
+		d.cancel()
+	}
+
 	var errs []string
 	for _, ep := range d.endpoints {
 		err := ep.Stop()
@@ -128,6 +188,55 @@ func (d *Service) Shutdown() error {
 	return errors.New(strings.Join(errs, " - "))
 }
 
+// apiVersions returns the list of different versions of the registered APIs
+func (d *Service) apiVersions() []string {
+	versions := []string{}
+	seen := map[string]bool{}
+	for _, api := range d.apis {
+		if seen[api.Version] {
+			continue
+		}
+		seen[api.Version] = true
+		versions = append(versions, api.Version)
+	}
+	return versions
+}
+
+// apiExtensions returns the list of extensions declared by the registered APIs
+func (d *Service) apiExtensions() []string {
+	extensions := []string{}
+	seen := map[string]bool{}
+	for _, api := range d.apis {
+		for _, extension := range api.Extensions {
+			if seen[extension] {
+				continue
+			}
+			seen[extension] = true
+			extensions = append(extensions, extension)
+		}
+	}
+	return extensions
+}
+
+// openAPI returns the OpenAPI document describing all the registered APIs
+func (d *Service) openAPI() *openAPIDocument {
+	title := d.Name
+	if len(title) == 0 {
+		title = "REST API"
+	}
+
+	version := d.Version
+	if len(version) == 0 {
+		version = api.FrameworkVersion
+	}
+
+	g := newOpenAPIGenerator(title, version)
+	for _, a := range d.apis {
+		g.addAPI(a)
+	}
+	return g.doc
+}
+
 func (d *Service) checkTLSConfig() {
 	// Try TLS enabled by default
 	d.schema = "https"
@@ -153,51 +262,86 @@ func (d *Service) createCmd(api *API, c *Command) {
 		mws = append(mws, api.Middleware)
 	}
 
-	d.Router.Handle(uri, doMws(mws, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if c.Expand != nil {
+		// References are expanded only for the callers allowed to GET
+		// the resources, going through the same chain of handlers
+		d.expanders[uri] = d.withAuthentication(c, doMws(mws, d.expandHandler(api.Version, c.Expand)))
+	}
+	d.panics[uri] = new(uint64)
+
+	allow := strings.Join(c.allowedMethods(), ", ")
+
+	timeout := d.HandlerTimeout
+	if c.Timeout > 0 {
+		timeout = c.Timeout
+	}
+
+	// Requests are identified and their callers authenticated before
+	// running any middleware, and replayed after them
+	d.Router.Handle(uri, withRequestID(d.withAuthentication(c, doMws(mws, d.withIdempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		var resp Response
-		var handler handlerFunc
-
-		switch r.Method {
-		case "HEAD":
-			// Intercept any response body by hijacking the response writter
-			w = &hijack{w}
-			fallthrough
-		case "GET":
-			handler = c.GET
-		case "PUT":
-			handler = c.PUT
-		case "POST":
-			handler = c.POST
-		case "DELETE":
-			handler = c.DELETE
-		case "PATCH":
-			handler = c.PATCH
-		default:
-			resp = NotImplemented
+		// Supported methods are announced for OPTIONS requests or when
+		// the requested one is not supported
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 
-		if resp == nil {
-			if handler != nil {
-				req := &Request{
-					HTTPRequest: r,
-					daemon:      d,
-					version:     api.Version,
-				}
-				resp = handler(req)
-			} else {
-				resp = NotFound
+		var resp Response
+		handler := c.handler(r.Method)
+		if handler == nil {
+			w.Header().Set("Allow", allow)
+			resp = MethodNotAllowed
+		} else {
+			if r.Method == http.MethodHead {
+				// Render the GET response, only sending its headers
+				hw := &headWriter{w: w}
+				defer hw.finish()
+				w = hw
+			}
+
+			// Panics are recovered before sending the headers of HEAD requests
+			sw := &sentWriter{ResponseWriter: w}
+			defer d.recoverPanic(sw, r, uri)
+			w = sw
+
+			ctx, cancel := d.requestContext(r, timeout)
+			defer cancel()
+
+			req := &Request{
+				HTTPRequest: r.WithContext(ctx),
+				daemon:      d,
+				version:     api.Version,
+			}
+			resp = c.checkPrecondition(req)
+			if resp == nil {
+				resp = d.runHandler(ctx, handler, req)
+			}
+
+			// Nobody is waiting for the response
+			if r.Context().Err() != nil {
+				logger.Debugf("Client gone attending %s %s (request %s)", r.Method, r.URL.Path, RequestID(r))
+				discardResponse(resp)
+				return
+			}
+			if nm := notModified(r, resp); nm != nil {
+				resp = nm
+			}
+			if or, ok := resp.(*operationResponse); ok {
+				resp = &operationResponse{op: or.op, wait: operationWait(r), ctx: ctx}
+				trackOperation(r, or.op)
 			}
 		}
 
-		if err := resp.Render(w); err != nil {
-			err := SmartError(err).Render(w)
+		if err := renderResponse(w, r, resp); err != nil {
+			err := renderResponse(w, r, SmartError(err))
 			if err != nil {
 				logger.Errorf("Failed writing error for error, giving up")
 			}
 		}
-	})))
+	}))))))
 }
 
 func (d *Service) startEndpoints() error {
@@ -273,7 +417,12 @@ func doMws(fs []MiddlewareFunc, inner http.Handler) http.Handler {
 	return inner
 }
 
+// requestUsesUnixSocket returns whether r was received through the local
+// endpoint
 func requestUsesUnixSocket(r *http.Request) bool {
+	if _, ok := endpoints.PeerCredentialsFromContext(r.Context()); ok {
+		return true
+	}
 	return r.RemoteAddr == "@"
 }
 
@@ -282,6 +431,6 @@ func notFoundHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write(nil)
 	} else {
-		NotFound.Render(w)
+		renderResponse(w, r, NotFound)
 	}
 }
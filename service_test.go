@@ -21,19 +21,24 @@ package rest
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	telnet "github.com/reiver/go-telnet"
 
 	check "gopkg.in/check.v1"
 
+	"github.com/greenbrew/rest/api"
 	"github.com/greenbrew/rest/cert"
 	"github.com/greenbrew/rest/freeport"
 	"github.com/greenbrew/rest/tlsconfig"
@@ -158,7 +163,7 @@ func (s *daemonSuite) TestAPI(c *check.C) {
 		Name: "notfound",
 		GET:  notFoundResourceGet,
 	}
-	var api = &API{
+	var whateverAPI = &API{
 		Version: "0.9",
 		Commands: []*Command{
 			whateverCmd,
@@ -174,7 +179,7 @@ func (s *daemonSuite) TestAPI(c *check.C) {
 		Port: port,
 	}
 
-	d.Init([]*API{api})
+	d.Init([]*API{whateverAPI})
 	err = d.Start()
 	c.Assert(err, check.IsNil)
 
@@ -185,21 +190,26 @@ func (s *daemonSuite) TestAPI(c *check.C) {
 	host, err := os.Hostname()
 	c.Assert(err, check.IsNil)
 
-	// HEAD
-	response, err := http.Head(fmt.Sprintf("http://%s:%d/0.9/whatever", host, port))
+	// GET
+	response, err := http.Get(fmt.Sprintf("http://%s:%d/0.9/whatever", host, port))
 	c.Assert(err, check.IsNil)
 	c.Assert(response.StatusCode, check.Equals, 200)
-	c.Assert(response.ContentLength <= 0, check.Equals, true)
+	body, err := ioutil.ReadAll(response.Body)
+	c.Assert(err, check.IsNil)
 
-	// GET
-	response, err = http.Get(fmt.Sprintf("http://%s:%d/0.9/whatever", host, port))
+	// HEAD gets the same headers than GET, without body
+	response, err = http.Head(fmt.Sprintf("http://%s:%d/0.9/whatever", host, port))
 	c.Assert(err, check.IsNil)
 	c.Assert(response.StatusCode, check.Equals, 200)
+	c.Assert(response.ContentLength, check.Equals, int64(len(body)))
+	c.Assert(response.Header.Get("Content-Type"), check.Equals, "application/json")
 
 	// GET 'notfound' resource
 	response, err = http.Get(fmt.Sprintf("http://%s:%d/0.9/notfound", host, port))
 	c.Assert(err, check.IsNil)
 	c.Assert(response.StatusCode, check.Equals, 404)
+	body, err = ioutil.ReadAll(response.Body)
+	c.Assert(err, check.IsNil)
 
 	// POST
 	var jsonStr = []byte(`{"title":"Buy cheese and bread for breakfast."}`)
@@ -222,13 +232,266 @@ func (s *daemonSuite) TestAPI(c *check.C) {
 	response, err = http.Head(fmt.Sprintf("http://%s:%d/0.9/notfound", host, port))
 	c.Assert(err, check.IsNil)
 	c.Assert(response.StatusCode, check.Equals, 404)
-	c.Assert(response.ContentLength <= 0, check.Equals, true)
+	c.Assert(response.ContentLength, check.Equals, int64(len(body)))
+
+	// Not supported method
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s:%d/0.9/whatever", host, port), nil)
+	c.Assert(err, check.IsNil)
+	response, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, 405)
+	c.Assert(response.Header.Get("Allow"), check.Equals, "GET, HEAD, POST, OPTIONS")
+
+	resp := &api.Response{}
+	err = json.NewDecoder(response.Body).Decode(resp)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.Code, check.Equals, 405)
+
+	// OPTIONS
+	req, err = http.NewRequest(http.MethodOptions, fmt.Sprintf("http://%s:%d/0.9/notfound", host, port), nil)
+	c.Assert(err, check.IsNil)
+	response, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, 204)
+	c.Assert(response.Header.Get("Allow"), check.Equals, "GET, HEAD, OPTIONS")
 
 	err = d.Shutdown()
 	c.Assert(err, check.IsNil)
 
 }
 
+func (s *daemonSuite) TestServerInfo(c *check.C) {
+	port, err := freeport.Get()
+	c.Assert(err, check.IsNil)
+
+	d := Service{
+		Port: port,
+	}
+
+	d.Init([]*API{{Version: "0.9", Extensions: []string{"whatever_feature"}}})
+	err = d.Start()
+	c.Assert(err, check.IsNil)
+	defer d.Shutdown()
+
+	host, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+
+	// Server information
+	response, err := http.Get(fmt.Sprintf("http://%s:%d/1.0", host, port))
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, 200)
+	c.Assert(response.Header.Get("ETag"), check.Not(check.Equals), "")
+
+	resp := &api.Response{}
+	err = json.NewDecoder(response.Body).Decode(resp)
+	c.Assert(err, check.IsNil)
+
+	server := &api.Server{}
+	err = resp.MetadataAsStruct(server)
+	c.Assert(err, check.IsNil)
+	c.Assert(server.FrameworkVersion, check.Equals, api.FrameworkVersion)
+	c.Assert(server.APIVersion, check.Equals, api.Version)
+	c.Assert(server.APIVersions, check.DeepEquals, []string{"0.9", api.Version})
+	c.Assert(server.Endpoints, check.DeepEquals, []string{"http"})
+	c.Assert(server.APIExtensions, check.DeepEquals, append([]string{"whatever_feature"}, builtinAPI.Extensions...))
+	c.Assert(server.CertificateFingerprint, check.Equals, "")
+
+	// Versions
+	response, err = http.Get(fmt.Sprintf("http://%s:%d/1.0/version", host, port))
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, 200)
+
+	resp = &api.Response{}
+	err = json.NewDecoder(response.Body).Decode(resp)
+	c.Assert(err, check.IsNil)
+
+	version := api.ServerVersion{}
+	err = resp.MetadataAsStruct(&version)
+	c.Assert(err, check.IsNil)
+	c.Assert(version, check.DeepEquals, api.ServerVersion{
+		FrameworkVersion: api.FrameworkVersion,
+		APIVersion:       api.Version,
+	})
+}
+
+func (s *daemonSuite) TestConditionalRequests(c *check.C) {
+	state := map[string]string{"name": "whatever"}
+	etagCalls := 0
+	putCalls := 0
+	cmd := &Command{
+		Name: "conditional",
+		GET: func(r *Request) Response {
+			return SyncResponseETag(true, state, state)
+		},
+		PUT: func(r *Request) Response {
+			putCalls++
+			return EmptySyncResponse
+		},
+		ETag: func(r *Request) (interface{}, error) {
+			etagCalls++
+			return state, nil
+		},
+	}
+
+	port, err := freeport.Get()
+	c.Assert(err, check.IsNil)
+
+	d := Service{
+		Port: port,
+	}
+
+	d.Init([]*API{{Version: "0.9", Commands: []*Command{cmd}}})
+	err = d.Start()
+	c.Assert(err, check.IsNil)
+	defer d.Shutdown()
+
+	host, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+	url := fmt.Sprintf("http://%s:%d/0.9/conditional", host, port)
+
+	etag, err := etagHash(state)
+	c.Assert(err, check.IsNil)
+
+	do := func(method, header, value string) *http.Response {
+		req, err := http.NewRequest(method, url, nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set(header, value)
+		response, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		return response
+	}
+
+	// Not modified
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		response := do(method, "If-None-Match", fmt.Sprintf("%q", etag))
+		c.Assert(response.StatusCode, check.Equals, http.StatusNotModified)
+		c.Assert(response.Header.Get("ETag"), check.Equals, etag)
+	}
+
+	// Modified
+	response := do(http.MethodGet, "If-None-Match", "other")
+	c.Assert(response.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(response.Header.Get("ETag"), check.Equals, etag)
+
+	// Precondition failed does not run the handler
+	response = do(http.MethodPut, "If-Match", "other")
+	c.Assert(response.StatusCode, check.Equals, http.StatusPreconditionFailed)
+	c.Assert(etagCalls, check.Equals, 1)
+	c.Assert(putCalls, check.Equals, 0)
+
+	// Weak etags are not enough to modify the resource
+	response = do(http.MethodPut, "If-Match", fmt.Sprintf("W/%q", etag))
+	c.Assert(response.StatusCode, check.Equals, http.StatusPreconditionFailed)
+	c.Assert(etagCalls, check.Equals, 2)
+	c.Assert(putCalls, check.Equals, 0)
+
+	// Precondition met
+	response = do(http.MethodPut, "If-Match", etag)
+	c.Assert(response.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(etagCalls, check.Equals, 3)
+	c.Assert(putCalls, check.Equals, 1)
+}
+
+func (s *daemonSuite) TestRecoverPanic(c *check.C) {
+	cmd := &Command{
+		Name: "panic",
+		GET: func(r *Request) Response {
+			var m map[string]string
+			m["boom"] = "nil map"
+			return EmptySyncResponse
+		},
+	}
+
+	port, err := freeport.Get()
+	c.Assert(err, check.IsNil)
+
+	d := Service{
+		Port: port,
+	}
+
+	d.Init([]*API{{Version: "0.9", Commands: []*Command{cmd}}})
+	err = d.Start()
+	c.Assert(err, check.IsNil)
+	defer d.Shutdown()
+
+	host, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+	url := fmt.Sprintf("http://%s:%d/0.9/panic", host, port)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("X-Request-ID", "abc")
+	response, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, http.StatusInternalServerError)
+	c.Assert(response.Header.Get("X-Request-ID"), check.Equals, "abc")
+
+	resp := &api.Response{}
+	err = json.NewDecoder(response.Body).Decode(resp)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.Type, check.Equals, api.ResponseTypeError)
+	c.Assert(resp.Error, check.Equals, errPanic.Error())
+
+	details := api.ErrorDetails{}
+	err = resp.MetadataAsStruct(&details)
+	c.Assert(err, check.IsNil)
+	c.Assert(details.RequestID, check.Equals, "abc")
+
+	// A request ID is generated if none given
+	response, err = http.Head(url)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, http.StatusInternalServerError)
+	c.Assert(response.Header.Get("X-Request-ID"), check.Not(check.Equals), "")
+
+	c.Assert(d.Panics()["/0.9/panic"], check.Equals, uint64(2))
+	c.Assert(d.Panics()["/1.0/operations"], check.Equals, uint64(0))
+}
+
+// panickingResponse panics after starting to send the response
+type panickingResponse struct{}
+
+func (r *panickingResponse) Render(w http.ResponseWriter) error {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"type": "sync", `))
+	w.(http.Flusher).Flush()
+	panic("boom")
+}
+
+func (r *panickingResponse) String() string { return "panicking" }
+
+func (s *daemonSuite) TestRecoverPanicAfterHeaders(c *check.C) {
+	cmd := &Command{
+		Name: "panic",
+		GET: func(r *Request) Response {
+			return &panickingResponse{}
+		},
+	}
+
+	port, err := freeport.Get()
+	c.Assert(err, check.IsNil)
+
+	d := Service{
+		Port: port,
+	}
+
+	d.Init([]*API{{Version: "0.9", Commands: []*Command{cmd}}})
+	err = d.Start()
+	c.Assert(err, check.IsNil)
+	defer d.Shutdown()
+
+	host, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+
+	// The response cannot be fixed anymore, so the connection is aborted
+	response, err := http.Get(fmt.Sprintf("http://%s:%d/0.9/panic", host, port))
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, http.StatusOK)
+	_, err = ioutil.ReadAll(response.Body)
+	c.Assert(err, check.NotNil)
+
+	c.Assert(d.Panics()["/0.9/panic"], check.Equals, uint64(1))
+}
+
 func whateverGet(r *Request) Response {
 	return SyncResponse(true, []string{filepath.Join(r.HTTPRequest.URL.Path, "1")})
 }
@@ -328,3 +591,135 @@ func assertNotHTTPS(port int, c *check.C) {
 	_, err = cert.FetchRemoteCertificate(fmt.Sprintf("https://%s:%d", host, port))
 	c.Assert(err, check.NotNil)
 }
+
+func (s *daemonSuite) TestHandlerTimeout(c *check.C) {
+	gaveUp := make(chan error, 2)
+	wait := func(r *Request) Response {
+		select {
+		case <-r.Context().Done():
+			gaveUp <- r.Context().Err()
+		case <-time.After(5 * time.Second):
+		}
+		return EmptySyncResponse
+	}
+	cmds := []*Command{
+		{Name: "slow", GET: wait, Timeout: 50 * time.Millisecond},
+		{Name: "unlimited", GET: wait},
+	}
+
+	port, err := freeport.Get()
+	c.Assert(err, check.IsNil)
+
+	d := Service{
+		Port: port,
+	}
+
+	d.Init([]*API{{Version: "0.9", Commands: cmds}})
+	err = d.Start()
+	c.Assert(err, check.IsNil)
+	defer d.Shutdown()
+
+	host, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+
+	do := func(name, timeout string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:%d/0.9/%s", host, port, name), nil)
+		c.Assert(err, check.IsNil)
+		if len(timeout) > 0 {
+			req.Header.Set(api.RequestTimeoutHeader, timeout)
+		}
+		response, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		return response
+	}
+
+	// The command timeout applies
+	response := do("slow", "")
+	c.Assert(response.StatusCode, check.Equals, http.StatusGatewayTimeout)
+	resp := &api.Response{}
+	err = json.NewDecoder(response.Body).Decode(resp)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.Type, check.Equals, api.ResponseTypeError)
+	c.Assert(resp.Code, check.Equals, http.StatusGatewayTimeout)
+	c.Assert(<-gaveUp, check.Equals, context.DeadlineExceeded)
+
+	// Clients can shorten it, but not make it longer
+	response = do("unlimited", "0.05")
+	c.Assert(response.StatusCode, check.Equals, http.StatusGatewayTimeout)
+	c.Assert(<-gaveUp, check.Equals, context.DeadlineExceeded)
+
+	start := time.Now()
+	response = do("slow", "10")
+	c.Assert(response.StatusCode, check.Equals, http.StatusGatewayTimeout)
+	c.Assert(time.Since(start) < time.Second, check.Equals, true)
+	<-gaveUp
+}
+
+func (s *daemonSuite) TestHandlerTimeoutDiscardsOperation(c *check.C) {
+	created := make(chan *Operation, 1)
+	cmd := &Command{
+		Name:    "slow",
+		Timeout: 50 * time.Millisecond,
+		POST: func(r *Request) Response {
+			// Not honouring the context of the request
+			time.Sleep(200 * time.Millisecond)
+			op, err := r.CreateOperation("Slow operation", nil, nil, func(*Operation) error { return nil }, nil)
+			if err != nil {
+				return InternalError(err)
+			}
+			created <- op
+			return OperationResponse(op)
+		},
+	}
+
+	port, err := freeport.Get()
+	c.Assert(err, check.IsNil)
+
+	d := Service{
+		Port: port,
+	}
+
+	d.Init([]*API{{Version: "0.9", Commands: []*Command{cmd}}})
+	err = d.Start()
+	c.Assert(err, check.IsNil)
+	defer d.Shutdown()
+
+	host, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+
+	response, err := http.Post(fmt.Sprintf("http://%s:%d/0.9/slow", host, port), "application/json", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, http.StatusGatewayTimeout)
+
+	// The operation nobody knows about is not left pending
+	op := <-created
+	err = op.WaitFinal(5)
+	c.Assert(err, check.IsNil)
+	c.Assert(op.getStatus(), check.Equals, api.Failure)
+	_, err = op.cache.getOperationByID(op.id)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *daemonSuite) TestServiceTimeout(c *check.C) {
+	d := &Service{HandlerTimeout: time.Millisecond}
+	ctx, cancel := d.requestContext(httptest.NewRequest("GET", "/1.0/things", nil), d.HandlerTimeout)
+	defer cancel()
+
+	resp := d.runHandler(ctx, func(r *Request) Response {
+		<-r.Context().Done()
+		return EmptySyncResponse
+	}, &Request{HTTPRequest: httptest.NewRequest("GET", "/1.0/things", nil).WithContext(ctx)})
+	c.Assert(resp, check.Equals, GatewayTimeout)
+
+	// Requests are given up when the service shuts down
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	ctx, cancel = d.requestContext(httptest.NewRequest("GET", "/1.0/things", nil), 0)
+	defer cancel()
+	d.cancel()
+
+	resp = d.runHandler(ctx, func(r *Request) Response {
+		<-r.Context().Done()
+		return EmptySyncResponse
+	}, &Request{HTTPRequest: httptest.NewRequest("GET", "/1.0/things", nil).WithContext(ctx)})
+	c.Assert(resp, check.Equals, ServiceUnavailable)
+}
@@ -0,0 +1,296 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2018 Roberto Mier Escandon <rmescandon@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package rest
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/greenbrew/rest/api"
+)
+
+// ValidationError is returned when a request does not pass the validation
+// of its fields. It is rendered as a bad request including field details
+type ValidationError struct {
+	Fields []api.FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := []string{}
+	for _, f := range e.Fields {
+		if len(f.Field) == 0 {
+			msgs = append(msgs, f.Message)
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("%s %s", f.Field, f.Message))
+	}
+	return "Invalid request: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, api.FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// A validation rule parsed from a 'validate' struct tag
+type validationRule struct {
+	name string
+	arg  string
+	num  float64
+	re   *regexp.Regexp
+}
+
+var (
+	// Parsed rules indexed by tag, as tags are the same for every request
+	rulesCache = map[string][]validationRule{}
+	rulesMux   sync.Mutex
+)
+
+// parseRules parses a validate tag like "required,min=1,max=10,enum=a|b,regex=^[a-z]+$".
+// As regular expressions can contain commas, regex must be the last rule of the tag
+func parseRules(tag string) ([]validationRule, error) {
+	rulesMux.Lock()
+	defer rulesMux.Unlock()
+
+	if rules, ok := rulesCache[tag]; ok {
+		return rules, nil
+	}
+
+	rules := []validationRule{}
+	rest := tag
+	for len(rest) > 0 {
+		var item string
+		if strings.HasPrefix(rest, "regex=") {
+			item, rest = rest, ""
+		} else if idx := strings.Index(rest, ","); idx >= 0 {
+			item, rest = rest[:idx], rest[idx+1:]
+		} else {
+			item, rest = rest, ""
+		}
+
+		r := validationRule{name: item}
+		if idx := strings.Index(item, "="); idx >= 0 {
+			r.name, r.arg = item[:idx], item[idx+1:]
+		}
+
+		var err error
+		switch r.name {
+		case "required":
+		case "min", "max":
+			r.num, err = strconv.ParseFloat(r.arg, 64)
+		case "regex":
+			r.re, err = regexp.Compile(r.arg)
+		case "enum":
+			if len(r.arg) == 0 {
+				err = fmt.Errorf("no values")
+			}
+		default:
+			err = fmt.Errorf("unknown rule")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid validation rule '%s': %v", item, err)
+		}
+
+		rules = append(rules, r)
+	}
+
+	rulesCache[tag] = rules
+	return rules, nil
+}
+
+// fieldSet holds the names of the fields present in a request, named the
+// same way than in the field errors. Names are compared ignoring case, as
+// the JSON decoder matches the fields
+type fieldSet map[string]bool
+
+func (s fieldSet) add(name string) {
+	s[strings.ToLower(name)] = true
+}
+
+func (s fieldSet) has(name string) bool {
+	return s[strings.ToLower(name)]
+}
+
+// addJSON adds the fields present in a decoded JSON document, prefixing
+// their names with prefix
+func (s fieldSet) addJSON(doc interface{}, prefix string) {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range d {
+			name := key
+			if len(prefix) > 0 {
+				name = prefix + "." + key
+			}
+			s.add(name)
+			s.addJSON(value, name)
+		}
+	case []interface{}:
+		for i, value := range d {
+			name := fmt.Sprintf("%s[%d]", prefix, i)
+			s.add(name)
+			s.addJSON(value, name)
+		}
+	}
+}
+
+// validate checks the fields of the given struct against the rules in their
+// 'validate' tags, including nested structs. Only required is checked for the
+// fields not present in the request. Field errors are added to verr.
+// Returned error is only set if the rules themselves are not valid
+func validate(v reflect.Value, prefix string, present fieldSet, verr *ValidationError) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			err := validate(v.Index(i), fmt.Sprintf("%s[%d]", prefix, i), present, verr)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+
+		name := bindFieldName(f)
+		if len(prefix) > 0 {
+			name = prefix + "." + name
+		}
+
+		if tag, ok := f.Tag.Lookup("validate"); ok {
+			rules, err := parseRules(tag)
+			if err != nil {
+				return err
+			}
+			checkRules(v.Field(i), name, present.has(name), rules, verr)
+		}
+
+		err := validate(v.Field(i), name, present, verr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkRules(v reflect.Value, name string, present bool, rules []validationRule, verr *ValidationError) {
+	if isEmptyValue(v) {
+		for _, r := range rules {
+			if r.name == "required" {
+				verr.add(name, "is required")
+			}
+		}
+	}
+
+	// Rest of rules only apply to provided values, even if zero
+	if !present {
+		return
+	}
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	for _, r := range rules {
+		switch r.name {
+		case "min", "max":
+			checkLimit(v, name, r, verr)
+		case "regex":
+			if v.Kind() == reflect.String && !r.re.MatchString(v.String()) {
+				verr.add(name, "must match %q", r.arg)
+			}
+		case "enum":
+			values := strings.Split(r.arg, "|")
+			found := false
+			for _, value := range values {
+				if fmt.Sprint(v.Interface()) == value {
+					found = true
+					break
+				}
+			}
+			if !found {
+				verr.add(name, "must be one of: %s", strings.Join(values, ", "))
+			}
+		}
+	}
+}
+
+func checkLimit(v reflect.Value, name string, r validationRule, verr *ValidationError) {
+	var value float64
+	what := ""
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		value = v.Float()
+	case reflect.String:
+		value = float64(utf8.RuneCountInString(v.String()))
+		what = " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		value = float64(v.Len())
+		what = " elements"
+	default:
+		return
+	}
+
+	verb := "must have"
+	if len(what) == 0 {
+		verb = "must be"
+	}
+
+	if r.name == "min" && value < r.num {
+		verr.add(name, "%s at least %v%s", verb, r.num, what)
+	} else if r.name == "max" && value > r.num {
+		verr.add(name, "%s at most %v%s", verb, r.num, what)
+	}
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}